@@ -1,21 +1,69 @@
 package main
 
 import (
+	"blockchain_demo/pkg/ballance_storage"
+	"blockchain_demo/pkg/blockchain"
+	"blockchain_demo/pkg/contract_storage"
 	"blockchain_demo/pkg/script_vm"
 	"blockchain_demo/pkg/sign/sign_ed25519"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction/coin_transfer"
+	"blockchain_demo/pkg/transaction/contract_call"
+	"blockchain_demo/pkg/transaction/contract_deploy"
+	"blockchain_demo/pkg/transaction/token_transfer"
+	"blockchain_demo/pkg/transaction/utxo_transfer"
+	"blockchain_demo/pkg/transaction_processor"
+	"blockchain_demo/pkg/transaction_processor/coin_transfer_processor"
+	"blockchain_demo/pkg/transaction_processor/contract_call_processor"
+	"blockchain_demo/pkg/transaction_processor/contract_deploy_processor"
+	"blockchain_demo/pkg/transaction_processor/token_transfer_processor"
+	"blockchain_demo/pkg/transaction_processor/utxo_transfer_processor"
+	"blockchain_demo/pkg/utxo_storage"
 	"blockchain_demo/pkg/wallet"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 
 	"github.com/gin-contrib/static"
 	"github.com/gin-gonic/gin"
 )
 
+// node is the blockchain served by the mining API.
+var node *blockchain.Blockchain
+
 type Script struct {
 	ScriptSig    string `json:"script_sig" xml:"script_sig"`
 	ScriptPubKey string `json:"script_pub_key" xml:"script_pub_key"`
 	SignedData   string `json:"signed_data" xml:"signed_data"`
+	// Params are hex values of the <name> placeholders of compiled scripts.
+	Params       map[string]string `json:"params" xml:"params"`
+}
+
+type DebugScript struct {
+	Script
+	Breakpoints []int `json:"breakpoints" xml:"breakpoints"`
+}
+
+type Work struct {
+	TemplateID uint64 `json:"template_id" xml:"template_id"`
+	Nonce      uint64 `json:"nonce" xml:"nonce"`
+}
+
+func newNode() (*blockchain.Blockchain, error) {
+	storage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
+	utxos := utxo_storage.NewMemoryStorage()
+	signer := sign_ed25519.Ed25519Signer{}
+	processors := map[transaction.TransactionType]transaction_processor.TransactionProcessor{
+		coin_transfer.CoinTransfer:     coin_transfer_processor.NewProcessor(storage),
+		token_transfer.TokenTransfer:   token_transfer_processor.NewProcessor(storage),
+		contract_deploy.ContractDeploy: contract_deploy_processor.NewProcessor(storage, contracts),
+		contract_call.ContractCall:     contract_call_processor.NewProcessor(storage, contracts, signer),
+		utxo_transfer.UtxoTransfer:     utxo_transfer_processor.NewProcessor(storage, utxos, signer, script_vm.DefaultFlags),
+	}
+	return blockchain.NewBlockchain(50000, 8, blockchain.EmptyAddress, signer, storage, processors, blockchain.WithContractStorage(contracts), blockchain.WithUtxoStorage(utxos))
 }
 
 func CreateWallet(c *gin.Context) {
@@ -62,7 +110,7 @@ func runScript (vm *script_vm.VM,  script []byte, signedData []byte) (string, er
 		return "", fmt.Errorf("failed to parse script: %v", err)
 	}
 	scriptCode := vm.String()
-	_, err = vm.Execute(signedData)
+	_, err = vm.Execute(script_vm.TxContext{SignedData: signedData})
 	if err != nil {
 		return "", fmt.Errorf("failed to execute script: %v", err)
 	}
@@ -121,6 +169,75 @@ func ScriptRun(c *gin.Context) {
 	})
 }
 
+// ScriptDebug runs a script in the debugger and returns the trace of every executed
+// operation. With breakpoints the run stops before the first breakpoint reached.
+func ScriptDebug(c *gin.Context) {
+	script := DebugScript{}
+	if err := c.ShouldBind(&script); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to bind script: %v", err),
+		})
+		return
+	}
+	scriptSig, err := hex.DecodeString(script.ScriptSig)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to decode script_sig: %v", err),
+		})
+		return
+	}
+	scriptPubKey, err := hex.DecodeString(script.ScriptPubKey)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to decode script_pub_key: %v", err),
+		})
+		return
+	}
+	fullScript := append(scriptSig, scriptPubKey...)
+	signedData, err := hex.DecodeString(script.SignedData)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to decode signed_data: %v", err),
+		})
+		return
+	}
+	signer := sign_ed25519.Ed25519Signer{}
+	vm := script_vm.New(&signer)
+	if err := vm.ParseScript(fullScript); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to parse script: %v", err),
+		})
+		return
+	}
+	code := vm.String()
+	debugger := vm.Debug(script_vm.TxContext{SignedData: signedData})
+	for _, pc := range script.Breakpoints {
+		debugger.SetBreakpoint(pc)
+	}
+	paused := debugger.Continue()
+	result := gin.H{
+		"success":  true,
+		"code":     code,
+		"trace":    debugger.Trace(),
+		"paused":   paused,
+		"pc":       debugger.PC(),
+		"gas_used": vm.GasUsed(),
+	}
+	if !paused {
+		top, err := debugger.Result()
+		result["result"] = hex.EncodeToString(top)
+		if err != nil {
+			result["error"] = err.Error()
+		}
+	}
+	c.JSON(http.StatusOK, result)
+}
+
 func ScriptCompile(c *gin.Context) {
 	script := Script{}
 	if err := c.ShouldBind(&script); err != nil {
@@ -131,9 +248,20 @@ func ScriptCompile(c *gin.Context) {
 		return
 	}
 
-	signer := sign_ed25519.Ed25519Signer{}
-	vm := script_vm.New(&signer)
-	scriptSigByteCode, err := vm.ParseString(script.ScriptSig)
+	params := make(map[string][]byte, len(script.Params))
+	for name, value := range script.Params {
+		data, err := hex.DecodeString(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": fmt.Sprintf("failed to decode param %s: %v", name, err),
+			})
+			return
+		}
+		params[name] = data
+	}
+
+	scriptSigByteCode, err := script_vm.Assemble(script.ScriptSig, params)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -142,8 +270,7 @@ func ScriptCompile(c *gin.Context) {
 		return
 	}
 
-	vm = script_vm.New(&signer)
-	scriptPubKeyByteCode, err := vm.ParseString(script.ScriptPubKey)
+	scriptPubKeyByteCode, err := script_vm.Assemble(script.ScriptPubKey, params)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"success": false,
@@ -222,7 +349,103 @@ func ScriptParse(c *gin.Context) {
 	})
 }
 
+func MiningTemplate(c *gin.Context) {
+	creator := c.Query("creator")
+	if _, err := hex.DecodeString(creator); err != nil || len(creator) != 40 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "creator must be a hex encoded 20 byte address",
+		})
+		return
+	}
+	template, err := node.GetBlockTemplate(creator)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to create block template: %v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    template,
+	})
+}
+
+func MiningSubmit(c *gin.Context) {
+	work := Work{}
+	if err := c.ShouldBind(&work); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("failed to bind work: %v", err),
+		})
+		return
+	}
+	block, err := node.SubmitWork(work.TemplateID, work.Nonce)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, blockchain.ErrUnknownTemplate) || errors.Is(err, blockchain.ErrStaleTemplate) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{
+			"success": false,
+			"message": fmt.Sprintf("%v", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"index":   block.Index,
+		"hash":    hex.EncodeToString(block.Hash[:]),
+	})
+}
+
+func TokenSupply(c *gin.Context) {
+	token, err := hex.DecodeString(c.Param("token"))
+	if err != nil || len(token) != 20 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "token must be a hex encoded 20 byte address",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"token":   hex.EncodeToString(token),
+		"supply":  node.GetTokenSupply(token),
+	})
+}
+
+func TokenBallance(c *gin.Context) {
+	token, tokenErr := hex.DecodeString(c.Param("token"))
+	holder, holderErr := hex.DecodeString(c.Param("holder"))
+	if tokenErr != nil || holderErr != nil || len(token) != 20 || len(holder) != 20 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "token and holder must be hex encoded 20 byte addresses",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":  true,
+		"token":    hex.EncodeToString(token),
+		"holder":   hex.EncodeToString(holder),
+		"ballance": node.GetTokenBallance(token, holder),
+	})
+}
+
 func main() {
+	var err error
+	node, err = newNode()
+	if err != nil {
+		log.Fatalf("failed to create blockchain: %v", err)
+	}
+
+
 	router := gin.Default()
 	router.Use(static.Serve("/", static.LocalFile("../public/dist", true)))
 	
@@ -234,8 +457,13 @@ func main() {
 	})
 	api.POST("/wallet", CreateWallet)
 	api.POST("/sript/run", ScriptRun)
+	api.POST("/sript/debug", ScriptDebug)
 	api.POST("/sript/compile", ScriptCompile)
 	api.POST("/sript/parse", ScriptParse)
+	api.GET("/mining/template", MiningTemplate)
+	api.POST("/mining/submit", MiningSubmit)
+	api.GET("/tokens/:token", TokenSupply)
+	api.GET("/tokens/:token/:holder", TokenBallance)
 	router.Run()
 }
 
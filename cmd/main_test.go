@@ -3,6 +3,8 @@ package main
 import (
 	"blockchain_demo/pkg/ballance_storage"
 	"blockchain_demo/pkg/blockchain"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/script_vm"
 	"blockchain_demo/pkg/sign"
 	"blockchain_demo/pkg/sign/sign_ed25519"
 	"blockchain_demo/pkg/transaction"
@@ -15,10 +17,18 @@ import (
 	"blockchain_demo/pkg/transaction_processor/contract_call_processor"
 	"blockchain_demo/pkg/transaction_processor/contract_deploy_processor"
 	"blockchain_demo/pkg/transaction_processor/token_transfer_processor"
+	"blockchain_demo/pkg/utils"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
+
+	"github.com/gin-gonic/gin"
 )
 
 func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
@@ -31,15 +41,35 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 	for i := 0; i < 3; i++ {
 		signatures[i], _ = signer.GenerateKeyPair()
 	}
-	creator := "ad23947398423423cd234fe34345345323423423"
+	creatorKeys, _ := signer.GenerateKeyPair()
+	creator := hex.EncodeToString(sign.PublicKeyHash(creatorKeys.PublicKey))
+	// the contract deployed by the creator with nonce 1, also naming its token
+	contract := hex.EncodeToString(contract_deploy.ContractAddress(sign.PublicKeyHash(creatorKeys.PublicKey), 1))
 
 	// Add BallanceStorage and TransactionProcessor map
 	ballanceStorage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
 	processors := map[transaction.TransactionType]transaction_processor.TransactionProcessor{
 		coin_transfer.CoinTransfer:        coin_transfer_processor.NewProcessor(ballanceStorage),
 		token_transfer.TokenTransfer:      token_transfer_processor.NewProcessor(ballanceStorage),
-		contract_deploy.ContractDeploy:    contract_deploy_processor.NewProcessor(ballanceStorage),
-		contract_call.ContractCall:        contract_call_processor.NewProcessor(ballanceStorage),
+		contract_deploy.ContractDeploy:    contract_deploy_processor.NewProcessor(ballanceStorage, contracts),
+		contract_call.ContractCall:        contract_call_processor.NewProcessor(ballanceStorage, contracts, signer),
+	}
+	// transfer moves contract tokens of the caller to the to param
+	code, err := script_vm.New(signer).ParseString(`
+		OP_METHOD
+		OP_PUSHDATA 7472616e73666572
+		OP_EQUALVERIFY
+		OP_CALLER
+		OP_0
+		OP_ARG
+		OP_1
+		OP_ARG
+		OP_TOKENTRANSFER
+		OP_1
+	`)
+	if err != nil {
+		t.Fatalf("failed to compile contract: %v", err)
 	}
 
 
@@ -51,6 +81,7 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 		signer,
 		ballanceStorage,
 		processors,
+		blockchain.WithContractStorage(contracts),
 	)
 	if err != nil {
 		t.Fatalf("failed to create blockchain: %v", err)
@@ -65,24 +96,7 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to create transaction: %v", err)
 	}
-	err = tx.AddSing(signer, signatures[senderInd])
-	if err != nil {
-		t.Fatalf("failed to sign transaction: %v", err)
-	}
-	err = bc.AddTransactionToPool(tx)
-	if err != nil {
-		t.Fatalf("failed to add transaction to pool: %v", err)
-	}
-
-	tx, err = transaction.CreateTransaction(token_transfer.TokenTransfer, creator, rnd.Int63n(1000), rnd.Int63n(10), map[string]any{
-		"recipient": addresses[1],
-		"token": "2345678901abcdef2345678901abcdef23456789",
-		"amount": rnd.Int63n(100),
-	})
-	if err != nil {
-		t.Fatalf("failed to create transaction: %v", err)
-	}
-	err = tx.AddSing(signer, signatures[senderInd])
+	err = tx.AddSing(signer, creatorKeys)
 	if err != nil {
 		t.Fatalf("failed to sign transaction: %v", err)
 	}
@@ -92,15 +106,15 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 	}
 
 	tx, err = transaction.CreateTransaction(contract_deploy.ContractDeploy, creator, rnd.Int63n(1000), rnd.Int63n(10), map[string]any{
-		"code": "2345678901abcdef2345678901abcdef23456789",
-		"contractAddress": "abcdef1234567890abcdef1234567890abcdef12",
-		"owner": "2345678901abcdef2345678901abcdef23456789",
+		"code": hex.EncodeToString(code),
+		"owner": creator,
 		"initialSupplay": 1000,		
+		"nonce": 1,
 	})
 	if err != nil {
 		t.Fatalf("failed to create transaction: %v", err)
 	}
-	err = tx.AddSing(signer, signatures[senderInd])
+	err = tx.AddSing(signer, creatorKeys)
 	if err != nil {
 		t.Fatalf("failed to sign transaction: %v", err)
 	}
@@ -120,16 +134,37 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 	}
 
 	// 3 - block
-	tx, err = transaction.CreateTransaction(contract_call.ContractCall, creator, rnd.Int63n(1000), rnd.Int63n(10), map[string]any{
-		"contractAddress": "abcdef1234567890abcdef1234567890abcdef12",
+	tokenValue := rnd.Int63n(500) + 1
+	callAmount := rnd.Int63n(500)
+	tx, err = transaction.CreateTransaction(token_transfer.TokenTransfer, creator, tokenValue, rnd.Int63n(10), map[string]any{
+		"recipient": addresses[1],
+		"token": contract,
+		"amount": rnd.Int63n(100),
+		"nonce": 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to create transaction: %v", err)
+	}
+	err = tx.AddSing(signer, creatorKeys)
+	if err != nil {
+		t.Fatalf("failed to sign transaction: %v", err)
+	}
+	err = bc.AddTransactionToPool(tx)
+	if err != nil {
+		t.Fatalf("failed to add transaction to pool: %v", err)
+	}
+
+	tx, err = transaction.CreateTransaction(contract_call.ContractCall, creator, rnd.Int63n(1000), 1+rnd.Int63n(10), map[string]any{
+		"contractAddress": contract,
 		"method": "transfer",
 		"to": "2345678901abcdef2345678901abcdef23456789",
-		"amount": rnd.Int63n(1000),
+		"amount": callAmount,
+		"nonce": 3,
 	})
 	if err != nil {
 		t.Fatalf("failed to create transaction: %v", err)
 	}
-	err = tx.AddSing(signer, signatures[senderInd])
+	err = tx.AddSing(signer, creatorKeys)
 	if err != nil {
 		t.Fatalf("failed to sign transaction: %v", err)
 	}
@@ -148,5 +183,112 @@ func TestBlockchainWithDifferentTransactionTypes(t *testing.T) {
 		t.Errorf("Blockchain verification failed: %v", err)
 	}
 
+	token, _ := hex.DecodeString(contract)
+	owner, _ := hex.DecodeString(creator)
+	if supply := bc.GetTokenSupply(token); supply != 1000 {
+		t.Errorf("token supply = %d, want 1000", supply)
+	}
+	if got := bc.GetTokenBallance(token, owner); got != 1000-tokenValue-callAmount {
+		t.Errorf("owner token ballance = %d, want %d", got, 1000-tokenValue-callAmount)
+	}
+
 	fmt.Println(bc)
 }
+
+func TestMiningEndpoints(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var err error
+	node, err = newNode()
+	if err != nil {
+		t.Fatalf("failed to create node: %v", err)
+	}
+	router := gin.New()
+	router.GET("/api/mining/template", MiningTemplate)
+	router.POST("/api/mining/submit", MiningSubmit)
+
+	creator := "ad23947398423423cd234fe34345345323423423"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/mining/template?creator=xyz", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("template with bad creator returned %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/mining/template?creator="+creator, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("template returned %d: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Data blockchain.BlockTemplate `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse template: %v", err)
+	}
+	tmpl := response.Data
+
+	var nonce uint64
+	for ; ; nonce++ {
+		hash, _ := utils.GetHash(tmpl.Index, tmpl.Time, []byte(tmpl.Prev), nonce, []byte(tmpl.MerkleRoot))
+		if bytes.Compare(hash, tmpl.Target) <= 0 {
+			break
+		}
+	}
+	submit := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(Work{TemplateID: tmpl.ID, Nonce: nonce})
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/mining/submit", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	if w := submit(); w.Code != http.StatusOK {
+		t.Fatalf("submit returned %d: %s", w.Code, w.Body.String())
+	}
+	if node.GetTip().Index != 2 {
+		t.Errorf("tip index = %d, want 2", node.GetTip().Index)
+	}
+	if w := submit(); w.Code != http.StatusConflict {
+		t.Errorf("second submit returned %d, want %d", w.Code, http.StatusConflict)
+	}
+}
+
+func TestScriptDebugEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/api/sript/debug", ScriptDebug)
+	debug := func(script DebugScript) (int, map[string]any) {
+		body, _ := json.Marshal(script)
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api/sript/debug", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		var response map[string]any
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w.Code, response
+	}
+
+	// 1 2 ADD | 3 NUMEQUAL
+	code, response := debug(DebugScript{Script: Script{ScriptSig: "515293", ScriptPubKey: "539c"}})
+	if code != http.StatusOK || response["paused"] != false || response["error"] != nil {
+		t.Fatalf("debug returned %d: %v", code, response)
+	}
+	trace, _ := response["trace"].([]any)
+	if len(trace) != 5 {
+		t.Fatalf("trace has %d steps, want 5", len(trace))
+	}
+	if step := trace[2].(map[string]any); step["opcode"] != "OP_ADD" || fmt.Sprint(step["stack_after"]) != "[03]" {
+		t.Errorf("OP_ADD step = %v", step)
+	}
+
+	code, response = debug(DebugScript{Script: Script{ScriptSig: "515293", ScriptPubKey: "549c"}, Breakpoints: []int{3}})
+	if code != http.StatusOK || response["paused"] != true || response["pc"] != float64(3) || len(response["trace"].([]any)) != 3 {
+		t.Errorf("debug with a breakpoint returned %d: %v", code, response)
+	}
+	code, response = debug(DebugScript{Script: Script{ScriptSig: "515293", ScriptPubKey: "549c"}})
+	if code != http.StatusOK || response["error"] == nil {
+		t.Errorf("failing script returned %d: %v", code, response)
+	}
+	if code, _ := debug(DebugScript{Script: Script{ScriptSig: "zz"}}); code != http.StatusBadRequest {
+		t.Errorf("bad hex returned %d, want %d", code, http.StatusBadRequest)
+	}
+}
@@ -4,7 +4,7 @@ go 1.24.2
 
 require github.com/gin-gonic/gin v1.10.0
 
-require github.com/gin-contrib/static v1.1.5 // indirect
+require github.com/gin-contrib/static v1.1.5
 
 require (
 	github.com/btcsuite/btcutil v1.0.2
@@ -28,7 +28,7 @@ require (
 	github.com/twitchyliquid64/golang-asm v0.15.1 // indirect
 	github.com/ugorji/go/codec v1.2.12 // indirect
 	golang.org/x/arch v0.16.0 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/crypto v0.37.0
 	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
@@ -1,22 +1,65 @@
 package ballance_storage
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 )
 
+// ErrUndoPruned fails a revert to a height whose undo records were already pruned.
+var ErrUndoPruned = errors.New("undo records were pruned")
+
+// BallanceStorage accumulates ballance changes of a block as pending deltas. Confirm
+// commits them as the next height and keeps an undo record, RevertTo rewinds the
+// committed ballances to a lower height using those records. Account nonces and token
+// ledgers are kept the same way, so they are confirmed and reverted together with the
+// coin ballances.
 type BallanceStorage interface {
 	GetBallance(address string) int64
+	GetNonce(address string) uint64
+	UseNonce(address string, nonce uint64) error
+	GetTokenBallance(token string, holder string) int64
+	GetTokenSupply(token string) int64
+	MintToken(token string, holder string, value int64) error
+	TransferToken(token string, sender string, reciver string, value int64) error
 	AddBallance(address string, value int64) (int64, error)
 	SubBallance(address string, value int64) (int64, error)
 	Transfer(sender string, reciver string, value int64) error
 	Confirm() error
 	Reject() error
+	Height() uint32
+	RevertTo(height uint32) error
+}
+
+// nonceKey is the pool key holding the next expected nonce of address.
+func nonceKey(address string) string {
+	return "nonce:" + address
+}
+
+// tokenKey is the pool key holding the ballance of holder in token. The token length
+// is part of the key, so different token and holder pairs never share a key.
+func tokenKey(token string, holder string) string {
+	return "token:" + string(rune(len(token))) + token + holder
+}
+
+// supplyKey is the pool key holding the total minted units of token.
+func supplyKey(token string) string {
+	return "supply:" + token
+}
+
+type undoRecord struct {
+	height uint32
+	deltas map[string]int64
 }
 
 type BallanceStorageMemory struct {
 	ballancePool map[string]int64
 	txPool       map[string]int64
-	mu           sync.Mutex
+	height       uint32
+	undo         []undoRecord
+	// undoDepth limits the kept undo records, zero keeps all of them
+	undoDepth uint32
+	mu        sync.Mutex
 }
 
 func NewMemoryStorage() BallanceStorage {
@@ -31,15 +74,74 @@ func NewMemoryStorage() BallanceStorage {
 func (s *BallanceStorageMemory) Confirm() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.confirm()
+	return nil
+}
+
+func (s *BallanceStorageMemory) confirm() {
+	var undo = make(map[string]int64, len(s.txPool))
 	for k, v := range s.txPool {
 		if _, ok := s.ballancePool[k]; !ok {
 			s.ballancePool[k] = 0
 		}
 		s.ballancePool[k] += v
+		undo[k] = -v
+	}
+	for k := range s.txPool {
+		delete(s.txPool, k)
+	}
+	s.height++
+	s.undo = append(s.undo, undoRecord{height: s.height, deltas: undo})
+	if pruned := len(s.undo) - int(s.undoDepth); s.undoDepth > 0 && pruned > 0 {
+		s.undo = s.undo[pruned:]
+	}
+}
+
+func (s *BallanceStorageMemory) Height() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.height
+}
+
+// RevertTo drops pending changes and undoes every confirmed height above height. Height
+// zero is the empty state, so it is reachable even after the undo records were pruned.
+func (s *BallanceStorageMemory) RevertTo(height uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revertTo(height)
+}
+
+func (s *BallanceStorageMemory) revertTo(height uint32) error {
+	if err := s.checkRevert(height); err != nil {
+		return err
 	}
 	for k := range s.txPool {
 		delete(s.txPool, k)
 	}
+	if height == 0 {
+		s.ballancePool = make(map[string]int64)
+		s.undo = nil
+		s.height = 0
+		return nil
+	}
+	for s.height > height {
+		var record = s.undo[len(s.undo)-1]
+		for k, v := range record.deltas {
+			s.ballancePool[k] += v
+		}
+		s.undo = s.undo[:len(s.undo)-1]
+		s.height--
+	}
+	return nil
+}
+
+func (s *BallanceStorageMemory) checkRevert(height uint32) error {
+	if height > s.height {
+		return fmt.Errorf("can not revert to height %d, current height is %d", height, s.height)
+	}
+	if height > 0 && s.height-height > uint32(len(s.undo)) {
+		return fmt.Errorf("%w: can not revert to height %d, current height is %d", ErrUndoPruned, height, s.height)
+	}
 	return nil
 }
 
@@ -67,6 +169,27 @@ func (p *BallanceStorageMemory) GetBallance(address string) int64 {
 	return ballance + tempTx
 }
 
+// GetNonce returns the nonce the next transaction of address must have.
+func (s *BallanceStorageMemory) GetNonce(address string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint64(s.ballancePool[nonceKey(address)] + s.txPool[nonceKey(address)])
+}
+
+// UseNonce accepts nonce only if it is the expected one and moves the expected nonce
+// of address forward as a pending change.
+func (s *BallanceStorageMemory) UseNonce(address string, nonce uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var key = nonceKey(address)
+	var expected = uint64(s.ballancePool[key] + s.txPool[key])
+	if nonce != expected {
+		return fmt.Errorf("nonce %d is invalid, expected %d", nonce, expected)
+	}
+	s.addBallance(key, 1)
+	return nil
+}
+
 func (s *BallanceStorageMemory) addBallance(address string, value int64) int64 {
 	if _, ok := s.txPool[address]; !ok {
 		s.txPool[address] = 0
@@ -102,3 +225,37 @@ func (s *BallanceStorageMemory) Transfer(sender string, reciver string, value in
 	s.addBallance(reciver, value)
 	return nil
 }
+
+func (s *BallanceStorageMemory) GetTokenBallance(token string, holder string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var key = tokenKey(token, holder)
+	return s.ballancePool[key] + s.txPool[key]
+}
+
+func (s *BallanceStorageMemory) GetTokenSupply(token string) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var key = supplyKey(token)
+	return s.ballancePool[key] + s.txPool[key]
+}
+
+// MintToken creates value new units of token owned by holder.
+func (s *BallanceStorageMemory) MintToken(token string, holder string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value <= 0 {
+		return fmt.Errorf("minted value must be positive, got %d", value)
+	}
+	s.addBallance(supplyKey(token), value)
+	s.addBallance(tokenKey(token, holder), value)
+	return nil
+}
+
+func (s *BallanceStorageMemory) TransferToken(token string, sender string, reciver string, value int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subBallance(tokenKey(token, sender), value)
+	s.addBallance(tokenKey(token, reciver), value)
+	return nil
+}
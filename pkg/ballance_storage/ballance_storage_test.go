@@ -1,6 +1,10 @@
 package ballance_storage
 
 import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 )
 
@@ -71,3 +75,370 @@ func TestConfirmAndReject(t *testing.T) {
 		t.Errorf("Expected balance 100 after reject, got %d", storage.GetBallance(address))
 	}
 }
+
+func TestFileStorage_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("NewFileStorage failed: %v", err)
+	}
+	storage.AddBallance("sender", 200)
+	storage.Confirm()
+	storage.Transfer("sender", "receiver", 70)
+	storage.Confirm()
+	storage.AddBallance("sender", 1000)
+	storage.Close()
+
+	storage, err = NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer storage.Close()
+	if storage.GetBallance("sender") != 130 {
+		t.Errorf("Expected sender balance 130, got %d", storage.GetBallance("sender"))
+	}
+	if storage.GetBallance("receiver") != 70 {
+		t.Errorf("Expected receiver balance 70, got %d", storage.GetBallance("receiver"))
+	}
+}
+
+func TestFileStorage_TornWalRecord(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewFileStorage(dir)
+	storage.AddBallance("address", 100)
+	storage.Confirm()
+	storage.Close()
+
+	wal, _ := os.OpenFile(filepath.Join(dir, walFile), os.O_WRONLY|os.O_APPEND, 0644)
+	wal.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, '{', '"'})
+	wal.Close()
+
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	defer storage.Close()
+	if storage.GetBallance("address") != 100 {
+		t.Errorf("Expected balance 100, got %d", storage.GetBallance("address"))
+	}
+}
+
+// TestFileStorage_CrashHelper runs in a child process started by
+// TestFileStorage_CrashRecovery and exits in the middle of Confirm, or right after it
+// for the applied stage.
+func TestFileStorage_CrashHelper(t *testing.T) {
+	dir := os.Getenv("BALLANCE_CRASH_DIR")
+	stage := os.Getenv("BALLANCE_CRASH_STAGE")
+	if dir == "" {
+		t.Skip("helper process")
+	}
+	crashPoint = func(s string) {
+		if s == stage {
+			os.Exit(3)
+		}
+	}
+	if stage == "snapshot" {
+		checkpointInterval = 1
+	}
+	storage, err := NewFileStorage(dir)
+	if err != nil {
+		os.Exit(1)
+	}
+	storage.Transfer("sender", "receiver", 30)
+	storage.Confirm()
+	if stage == "applied" {
+		os.Exit(3)
+	}
+	os.Exit(0)
+}
+
+func TestFileStorage_CrashRecovery(t *testing.T) {
+	for _, stage := range []string{"wal", "applied", "snapshot"} {
+		t.Run(stage, func(t *testing.T) {
+			dir := t.TempDir()
+			storage, _ := NewFileStorage(dir)
+			storage.AddBallance("sender", 100)
+			storage.Confirm()
+			storage.Close()
+
+			cmd := exec.Command(os.Args[0], "-test.run=^TestFileStorage_CrashHelper$")
+			cmd.Env = append(os.Environ(), "BALLANCE_CRASH_DIR="+dir, "BALLANCE_CRASH_STAGE="+stage)
+			err := cmd.Run()
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok || exitErr.ExitCode() != 3 {
+				t.Fatalf("helper process did not crash at stage %s: %v", stage, err)
+			}
+
+			storage, err = NewFileStorage(dir)
+			if err != nil {
+				t.Fatalf("recovery failed: %v", err)
+			}
+			defer storage.Close()
+			if storage.GetBallance("sender") != 70 {
+				t.Errorf("Expected sender balance 70, got %d", storage.GetBallance("sender"))
+			}
+			if storage.GetBallance("receiver") != 30 {
+				t.Errorf("Expected receiver balance 30, got %d", storage.GetBallance("receiver"))
+			}
+		})
+	}
+}
+
+func TestFileStorage_Checkpoint(t *testing.T) {
+	defer func(interval int) { checkpointInterval = interval }(checkpointInterval)
+	checkpointInterval = 3
+	dir := t.TempDir()
+	storage, _ := NewFileStorage(dir)
+	defer func() { storage.Close() }()
+	walSize := func() int64 {
+		info, err := os.Stat(filepath.Join(dir, walFile))
+		if err != nil {
+			t.Fatalf("Stat failed: %v", err)
+		}
+		return info.Size()
+	}
+
+	// records stay in the log until a checkpoint
+	for i := 0; i < 2; i++ {
+		storage.AddBallance("address", 10)
+		storage.Confirm()
+	}
+	if walSize() == 0 {
+		t.Errorf("log is empty before the checkpoint")
+	}
+	if _, err := os.Stat(filepath.Join(dir, snapshotFile)); !os.IsNotExist(err) {
+		t.Errorf("snapshot written before the checkpoint: %v", err)
+	}
+	reopened, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if reopened.Height() != 2 || reopened.GetBallance("address") != 20 {
+		t.Errorf("Expected height 2 and balance 20, got %d and %d", reopened.Height(), reopened.GetBallance("address"))
+	}
+	storage.wal.Close()
+	storage = reopened
+
+	for i := 0; i < 3; i++ {
+		storage.AddBallance("address", 10)
+		storage.Confirm()
+	}
+	if walSize() != 0 {
+		t.Errorf("log was not truncated by the checkpoint")
+	}
+	storage.AddBallance("address", 10)
+	storage.Confirm()
+	storage.Close()
+	if walSize() != 0 {
+		t.Errorf("log was not truncated by Close")
+	}
+
+	storage, _ = NewFileStorage(dir)
+	if storage.Height() != 6 || storage.GetBallance("address") != 60 {
+		t.Errorf("Expected height 6 and balance 60, got %d and %d", storage.Height(), storage.GetBallance("address"))
+	}
+}
+
+func TestFileStorage_UndoPruned(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewFileStorage(dir)
+	for i := 0; i < MaxUndoDepth+5; i++ {
+		storage.AddBallance("address", 1)
+		storage.Confirm()
+	}
+	storage.Close()
+
+	storage, _ = NewFileStorage(dir)
+	defer storage.Close()
+	if len(storage.undo) != MaxUndoDepth {
+		t.Errorf("Expected %d undo records, got %d", MaxUndoDepth, len(storage.undo))
+	}
+	if err := storage.RevertTo(4); !errors.Is(err, ErrUndoPruned) {
+		t.Errorf("RevertTo(4) error = %v, want %v", err, ErrUndoPruned)
+	}
+	if storage.Height() != MaxUndoDepth+5 {
+		t.Errorf("failed revert changed the height to %d", storage.Height())
+	}
+	if err := storage.RevertTo(5); err != nil {
+		t.Fatalf("RevertTo(5) failed: %v", err)
+	}
+	if storage.GetBallance("address") != 5 {
+		t.Errorf("Expected balance 5, got %d", storage.GetBallance("address"))
+	}
+	if err := storage.RevertTo(0); err != nil {
+		t.Fatalf("RevertTo(0) failed: %v", err)
+	}
+	if storage.Height() != 0 || storage.GetBallance("address") != 0 {
+		t.Errorf("Expected the empty state, got height %d and balance %d", storage.Height(), storage.GetBallance("address"))
+	}
+}
+
+func TestRevertTo(t *testing.T) {
+	check := func(t *testing.T, storage BallanceStorage) {
+		storage.AddBallance("sender", 100)
+		storage.Confirm()
+		storage.Transfer("sender", "receiver", 30)
+		storage.Confirm()
+		storage.Transfer("receiver", "sender", 10)
+		storage.Confirm()
+		if storage.Height() != 3 {
+			t.Fatalf("Expected height 3, got %d", storage.Height())
+		}
+
+		storage.AddBallance("sender", 1000)
+		if err := storage.RevertTo(2); err != nil {
+			t.Fatalf("RevertTo failed: %v", err)
+		}
+		if storage.GetBallance("sender") != 70 || storage.GetBallance("receiver") != 30 {
+			t.Errorf("Expected balances 70/30 at height 2, got %d/%d", storage.GetBallance("sender"), storage.GetBallance("receiver"))
+		}
+		if err := storage.RevertTo(0); err != nil {
+			t.Fatalf("RevertTo failed: %v", err)
+		}
+		if storage.GetBallance("sender") != 0 || storage.GetBallance("receiver") != 0 {
+			t.Errorf("Expected empty balances at height 0, got %d/%d", storage.GetBallance("sender"), storage.GetBallance("receiver"))
+		}
+		if err := storage.RevertTo(1); err == nil {
+			t.Errorf("expected error for revert above current height")
+		}
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		check(t, NewMemoryStorage())
+	})
+	t.Run("file", func(t *testing.T) {
+		storage, err := NewFileStorage(t.TempDir())
+		if err != nil {
+			t.Fatalf("NewFileStorage failed: %v", err)
+		}
+		defer storage.Close()
+		check(t, storage)
+	})
+}
+
+func TestFileStorage_RevertSurvivesReopen(t *testing.T) {
+	dir := t.TempDir()
+	storage, _ := NewFileStorage(dir)
+	storage.AddBallance("address", 100)
+	storage.Confirm()
+	storage.AddBallance("address", 50)
+	storage.Confirm()
+	storage.Close()
+
+	storage, _ = NewFileStorage(dir)
+	if storage.Height() != 2 || storage.GetBallance("address") != 150 {
+		t.Fatalf("Expected height 2 and balance 150, got %d and %d", storage.Height(), storage.GetBallance("address"))
+	}
+	if err := storage.RevertTo(1); err != nil {
+		t.Fatalf("RevertTo failed: %v", err)
+	}
+	storage.Close()
+
+	storage, _ = NewFileStorage(dir)
+	defer storage.Close()
+	if storage.Height() != 1 || storage.GetBallance("address") != 100 {
+		t.Errorf("Expected height 1 and balance 100, got %d and %d", storage.Height(), storage.GetBallance("address"))
+	}
+}
+
+func TestNonce(t *testing.T) {
+	check := func(t *testing.T, storage BallanceStorage) {
+		if storage.GetNonce("sender") != 0 {
+			t.Fatalf("Expected nonce 0, got %d", storage.GetNonce("sender"))
+		}
+		if err := storage.UseNonce("sender", 1); err == nil {
+			t.Errorf("expected error for nonce gap")
+		}
+		if err := storage.UseNonce("sender", 0); err != nil {
+			t.Fatalf("UseNonce failed: %v", err)
+		}
+		if err := storage.UseNonce("sender", 0); err == nil {
+			t.Errorf("expected error for used nonce")
+		}
+		storage.Reject()
+		if storage.GetNonce("sender") != 0 {
+			t.Errorf("Expected nonce 0 after Reject, got %d", storage.GetNonce("sender"))
+		}
+
+		storage.UseNonce("sender", 0)
+		storage.UseNonce("sender", 1)
+		storage.Confirm()
+		storage.UseNonce("sender", 2)
+		storage.Confirm()
+		if storage.GetNonce("sender") != 3 || storage.GetNonce("receiver") != 0 || storage.GetBallance("sender") != 0 {
+			t.Errorf("Expected nonces 3/0 and empty balance, got %d/%d and %d", storage.GetNonce("sender"), storage.GetNonce("receiver"), storage.GetBallance("sender"))
+		}
+		storage.RevertTo(1)
+		if storage.GetNonce("sender") != 2 {
+			t.Errorf("Expected nonce 2 after revert, got %d", storage.GetNonce("sender"))
+		}
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		check(t, NewMemoryStorage())
+	})
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		storage, err := NewFileStorage(dir)
+		if err != nil {
+			t.Fatalf("NewFileStorage failed: %v", err)
+		}
+		check(t, storage)
+		storage.Close()
+
+		storage, _ = NewFileStorage(dir)
+		defer storage.Close()
+		if storage.GetNonce("sender") != 2 {
+			t.Errorf("Expected nonce 2 after reopen, got %d", storage.GetNonce("sender"))
+		}
+	})
+}
+
+func TestTokenLedger(t *testing.T) {
+	check := func(t *testing.T, storage BallanceStorage) {
+		if err := storage.MintToken("token", "owner", 0); err == nil {
+			t.Errorf("expected error for empty mint")
+		}
+		storage.MintToken("token", "owner", 1000)
+		storage.TransferToken("token", "owner", "holder", 300)
+		storage.Confirm()
+		if storage.GetTokenBallance("token", "owner") != 700 || storage.GetTokenBallance("token", "holder") != 300 {
+			t.Errorf("Expected token balances 700/300, got %d/%d", storage.GetTokenBallance("token", "owner"), storage.GetTokenBallance("token", "holder"))
+		}
+		if storage.GetTokenSupply("token") != 1000 || storage.GetTokenSupply("other") != 0 {
+			t.Errorf("Expected supplies 1000/0, got %d/%d", storage.GetTokenSupply("token"), storage.GetTokenSupply("other"))
+		}
+		// tokens are separate from coins and from other tokens
+		if storage.GetBallance("owner") != 0 || storage.GetTokenBallance("other", "owner") != 0 || storage.GetTokenBallance("tok", "enowner") != 0 {
+			t.Errorf("token units leaked into another ledger")
+		}
+
+		storage.TransferToken("token", "holder", "owner", 100)
+		storage.Reject()
+		storage.TransferToken("token", "owner", "holder", 200)
+		storage.Confirm()
+		storage.RevertTo(1)
+		if storage.GetTokenBallance("token", "holder") != 300 {
+			t.Errorf("Expected holder token balance 300 after revert, got %d", storage.GetTokenBallance("token", "holder"))
+		}
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		check(t, NewMemoryStorage())
+	})
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+		storage, err := NewFileStorage(dir)
+		if err != nil {
+			t.Fatalf("NewFileStorage failed: %v", err)
+		}
+		check(t, storage)
+		storage.Close()
+
+		storage, _ = NewFileStorage(dir)
+		defer storage.Close()
+		if storage.GetTokenBallance("token", "owner") != 700 || storage.GetTokenSupply("token") != 1000 {
+			t.Errorf("Expected token balance 700 and supply 1000 after reopen, got %d and %d", storage.GetTokenBallance("token", "owner"), storage.GetTokenSupply("token"))
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package ballance_storage
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "ballances.json"
+	walFile      = "ballances.wal"
+	// MaxUndoDepth is the number of heights the file storage keeps undo records for, a
+	// deeper revert fails with ErrUndoPruned.
+	MaxUndoDepth = 100
+)
+
+// crashPoint is called between the commit stages of Confirm and RevertTo, tests use it to
+// kill the process at a given stage.
+var crashPoint = func(stage string) {}
+
+// checkpointInterval is the number of log records after which the snapshot is rewritten
+// and the log truncated.
+var checkpointInterval = 64
+
+// walRecord is either a commit of Deltas as the next height or, when Height is below
+// the current height, a revert to Height.
+type walRecord struct {
+	Seq    uint64           `json:"seq"`
+	Height uint32           `json:"height"`
+	Deltas map[string]int64 `json:"deltas,omitempty"`
+}
+
+type snapshotUndo struct {
+	Height uint32           `json:"height"`
+	Deltas map[string]int64 `json:"deltas"`
+}
+
+type snapshot struct {
+	Seq       uint64           `json:"seq"`
+	Height    uint32           `json:"height"`
+	Ballances map[string]int64 `json:"ballances"`
+	Undo      []snapshotUndo   `json:"undo"`
+}
+
+// BallanceStorageFile keeps confirmed ballances and the undo journal in a snapshot
+// file. Confirm and RevertTo append one record to a write-ahead log and apply it, so a
+// crash at any point either loses the whole operation or recovers it. Every
+// checkpointInterval records the snapshot is rewritten and the log truncated.
+type BallanceStorageFile struct {
+	BallanceStorageMemory
+	dir     string
+	wal     *os.File
+	seq     uint64
+	records int
+}
+
+func NewFileStorage(dir string) (*BallanceStorageFile, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage dir: %v", err)
+	}
+	var storage = BallanceStorageFile{
+		BallanceStorageMemory: BallanceStorageMemory{
+			ballancePool: make(map[string]int64),
+			txPool:       make(map[string]int64),
+			undoDepth:    MaxUndoDepth,
+		},
+		dir: dir,
+	}
+	if err := storage.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	var wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open wal: %v", err)
+	}
+	storage.wal = wal
+	if err := storage.replayWal(); err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	return &storage, nil
+}
+
+func encodeKeys(values map[string]int64) map[string]int64 {
+	var encoded = make(map[string]int64, len(values))
+	for k, v := range values {
+		encoded[hex.EncodeToString([]byte(k))] = v
+	}
+	return encoded
+}
+
+func decodeKeys(values map[string]int64) (map[string]int64, error) {
+	var decoded = make(map[string]int64, len(values))
+	for k, v := range values {
+		key, err := hex.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address %s: %v", k, err)
+		}
+		decoded[string(key)] = v
+	}
+	return decoded, nil
+}
+
+func (s *BallanceStorageFile) loadSnapshot() error {
+	var data, err = os.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("failed to parse snapshot: %v", err)
+	}
+	ballances, err := decodeKeys(snap.Ballances)
+	if err != nil {
+		return err
+	}
+	s.ballancePool = ballances
+	s.seq = snap.Seq
+	s.height = snap.Height
+	for _, record := range snap.Undo {
+		deltas, err := decodeKeys(record.Deltas)
+		if err != nil {
+			return err
+		}
+		s.undo = append(s.undo, undoRecord{height: record.Height, deltas: deltas})
+	}
+	if pruned := len(s.undo) - int(s.undoDepth); pruned > 0 {
+		s.undo = s.undo[pruned:]
+	}
+	return nil
+}
+
+func (s *BallanceStorageFile) writeSnapshot() error {
+	var snap = snapshot{
+		Seq:       s.seq,
+		Height:    s.height,
+		Ballances: encodeKeys(s.ballancePool),
+		Undo:      make([]snapshotUndo, 0, len(s.undo)),
+	}
+	for _, record := range s.undo {
+		snap.Undo = append(snap.Undo, snapshotUndo{Height: record.height, Deltas: encodeKeys(record.deltas)})
+	}
+	var data, err = json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	var tmpPath = filepath.Join(s.dir, snapshotFile+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %v", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync snapshot: %v", err)
+	}
+	file.Close()
+	if err := os.Rename(tmpPath, filepath.Join(s.dir, snapshotFile)); err != nil {
+		return fmt.Errorf("failed to replace snapshot: %v", err)
+	}
+	if dir, err := os.Open(s.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (s *BallanceStorageFile) appendWal(record walRecord) error {
+	var payload, err = json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var header = make([]byte, 8)
+	binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(payload))
+	if _, err := s.wal.Seek(0, io.SeekEnd); err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(append(header, payload...)); err != nil {
+		return fmt.Errorf("failed to append wal: %v", err)
+	}
+	return s.wal.Sync()
+}
+
+func (s *BallanceStorageFile) truncateWal() error {
+	if err := s.wal.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate wal: %v", err)
+	}
+	return s.wal.Sync()
+}
+
+// replayWal applies every complete log record newer than the snapshot. A torn
+// record at the tail belongs to an operation that never returned and is dropped, so
+// the replayed records are checkpointed before new ones are appended.
+func (s *BallanceStorageFile) replayWal() error {
+	var data, err = io.ReadAll(s.wal)
+	if err != nil {
+		return fmt.Errorf("failed to read wal: %v", err)
+	}
+	var applied = false
+	for len(data) >= 8 {
+		var length = binary.BigEndian.Uint32(data[:4])
+		var checksum = binary.BigEndian.Uint32(data[4:8])
+		if uint64(len(data)-8) < uint64(length) || crc32.ChecksumIEEE(data[8:8+length]) != checksum {
+			break
+		}
+		var record walRecord
+		if err := json.Unmarshal(data[8:8+length], &record); err != nil {
+			return fmt.Errorf("failed to parse wal record: %v", err)
+		}
+		data = data[8+length:]
+		if record.Seq <= s.seq {
+			continue
+		}
+		if err := s.applyRecord(record); err != nil {
+			return err
+		}
+		applied = true
+	}
+	if applied {
+		return s.checkpoint()
+	}
+	return s.truncateWal()
+}
+
+func (s *BallanceStorageFile) applyRecord(record walRecord) error {
+	if record.Height > s.height {
+		deltas, err := decodeKeys(record.Deltas)
+		if err != nil {
+			return err
+		}
+		s.txPool = deltas
+		s.confirm()
+	} else if err := s.revertTo(record.Height); err != nil {
+		return err
+	}
+	s.seq = record.Seq
+	return nil
+}
+
+// checkpoint writes the applied records to the snapshot and drops them from the log.
+func (s *BallanceStorageFile) checkpoint() error {
+	if err := s.writeSnapshot(); err != nil {
+		return err
+	}
+	crashPoint("snapshot")
+	if err := s.truncateWal(); err != nil {
+		return err
+	}
+	s.records = 0
+	return nil
+}
+
+func (s *BallanceStorageFile) commit(record walRecord) error {
+	if err := s.appendWal(record); err != nil {
+		return err
+	}
+	crashPoint("wal")
+	if err := s.applyRecord(record); err != nil {
+		return err
+	}
+	s.records++
+	if s.records >= checkpointInterval {
+		return s.checkpoint()
+	}
+	return nil
+}
+
+func (s *BallanceStorageFile) Confirm() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(walRecord{Seq: s.seq + 1, Height: s.height + 1, Deltas: encodeKeys(s.txPool)})
+}
+
+func (s *BallanceStorageFile) RevertTo(height uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkRevert(height); err != nil {
+		return err
+	}
+	for k := range s.txPool {
+		delete(s.txPool, k)
+	}
+	if height == s.height {
+		return nil
+	}
+	return s.commit(walRecord{Seq: s.seq + 1, Height: height})
+}
+
+// Close checkpoints the log, so the next open does not replay it.
+func (s *BallanceStorageFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	if s.records > 0 {
+		err = s.checkpoint()
+	}
+	return errors.Join(err, s.wal.Close())
+}
@@ -6,19 +6,24 @@ import (
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/utils"
 	"context"
+	"encoding/json"
 	"fmt"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Block struct {
-	Index        uint32
-	Time         int64
-	Hash         [32]byte
-	Prev         [32]byte
-	Nonce        uint64
-	Difficulty   uint64
-	MerkleRoot   [32]byte
+	Index      uint32
+	Time       int64
+	Hash       [32]byte
+	Prev       [32]byte
+	Nonce      uint64
+	Difficulty uint64
+	MerkleRoot [32]byte
+	// StateRoot commits to the contract state after the block, zero without contracts.
+	StateRoot    [32]byte
 	Transactions []transaction.Transaction
 }
 
@@ -44,7 +49,12 @@ func NewBlock(prevBlock *Block, difficulty uint64) (*Block, error) {
 }
 
 func (block *Block) CalcHash(nonce uint64) ([]byte, error) {
-	var hash, err = utils.GetHash(block.Index, block.Time, block.Prev[:], nonce, block.MerkleRoot[:])
+	var values = []any{block.Index, block.Time, block.Prev[:], nonce, block.MerkleRoot[:]}
+	// a zero state root is not hashed, so blocks of chains without contracts keep their hashes
+	if block.StateRoot != ([32]byte{}) {
+		values = append(values, block.StateRoot[:])
+	}
+	var hash, err = utils.GetHash(values...)
 	if err != nil {
 		return nil, err
 	}
@@ -52,32 +62,54 @@ func (block *Block) CalcHash(nonce uint64) ([]byte, error) {
 	return hash, nil
 }
 
-func miner(block *Block, from uint64, count uint64, ch chan uint64, ctx context.Context) {
-
-	var bytes uint64 = block.Difficulty / 8
-	var bits uint64 = block.Difficulty % 8
+// targetMask returns the bytes a hash is ANDed with, a hash meets the difficulty when
+// every result byte is zero.
+func targetMask(difficulty uint64) []byte {
+	var bytes uint64 = difficulty / 8
+	var bits uint64 = difficulty % 8
 	var buf = make([]byte, bytes)
 	for n := uint64(0); n < bytes; n++ {
 		buf[n] = 255
 	}
 	if bits > 0 {
-		buf = append(buf, (255 << bits))
+		buf = append(buf, (255 << (8 - bits)))
 	}
+	return buf
+}
 
-nonceSearch:
-	for nonce := from; nonce < from+count && ctx.Err() == nil; nonce++ {
+func meetsTarget(hash []byte, mask []byte) bool {
+	if len(mask) > len(hash) {
+		return false
+	}
+	for n, v := range mask {
+		if hash[n]&v != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// MeetsTarget reports whether the block hash has at least Difficulty leading zero bits.
+func (block *Block) MeetsTarget() bool {
+	return meetsTarget(block.Hash[:], targetMask(block.Difficulty))
+}
+
+func miner(block *Block, from uint64, count uint64, ch chan uint64, attempts *atomic.Uint64, ctx context.Context) {
+	var mask = targetMask(block.Difficulty)
+	for nonce := from; nonce-from < count && ctx.Err() == nil; nonce++ {
 		var hash, _ = block.CalcHash(nonce)
-		for n, v := range buf {
-			if hash[n]&v != 0 {
-				continue nonceSearch
+		attempts.Add(1)
+		if meetsTarget(hash, mask) {
+			select {
+			case ch <- nonce:
+			default:
 			}
+			return
 		}
-		ch <- nonce
-		break
 	}
 }
 
-func (block *Block) calcMerkleRoot() (*transaction.Hash, error) {
+func (block *Block) CalcMerkleRoot() (*transaction.Hash, error) {
 	var txHashes []transaction.Hash
 	for _, tx := range block.Transactions {
 		var txHash = tx.GetTxId()
@@ -91,31 +123,130 @@ func (block *Block) calcMerkleRoot() (*transaction.Hash, error) {
 	return &root, nil
 }
 
+// MineProgress is reported periodically while a block is mined.
+type MineProgress struct {
+	Attempts uint64
+	Elapsed  time.Duration
+	Hashrate float64
+	// Rounds is the number of times the nonce space was exhausted and the time bumped.
+	Rounds uint32
+}
+
+type MineOptions struct {
+	// Threads is the number of mining goroutines, zero uses every CPU.
+	Threads uint64
+	// Progress is called by MineContext every ProgressInterval, one second by default,
+	// and once more when the nonce is found.
+	Progress         func(progress MineProgress)
+	ProgressInterval time.Duration
+	// NonceSpace limits the nonces tried before the block time is bumped, zero searches
+	// the whole uint64 range.
+	NonceSpace uint64
+}
+
 func (block *Block) Mine(threads uint64) ([]byte, error) {
-	root, err := block.calcMerkleRoot()
+	return block.MineContext(context.Background(), MineOptions{Threads: threads})
+}
+
+// MineContext searches a nonce until the hash meets the difficulty or ctx is done. When
+// the nonce space is exhausted the block time is moved forward, which changes the hash
+// of every nonce, and the search starts over.
+func (block *Block) MineContext(ctx context.Context, opts MineOptions) ([]byte, error) {
+	root, err := block.CalcMerkleRoot()
 	if err != nil {
 		return nil, fmt.Errorf("failed to calculate Merkle root: %w", err)
 	}
 	block.MerkleRoot = *root
-	channel := make(chan uint64)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
 
+	var threads = opts.Threads
 	if threads == 0 {
 		threads = uint64(runtime.NumCPU())
 	}
-	for th := uint64(0); th < threads; th++ {
-		var count = ^uint64(0) / threads
-		go miner(block, count*th, count, channel, ctx)
+	var space = opts.NonceSpace
+	if space == 0 {
+		space = ^uint64(0)
 	}
-	var nonce = <-channel
-	var hash, errHash = block.CalcHash(nonce)
-	if errHash != nil {
-		return nil, errHash
+	if threads > space {
+		threads = space
+	}
+	var interval = opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var attempts atomic.Uint64
+	var start = time.Now()
+	var progress = func(rounds uint32) MineProgress {
+		var elapsed = time.Since(start)
+		var done = attempts.Load()
+		return MineProgress{Attempts: done, Elapsed: elapsed, Hashrate: float64(done) / elapsed.Seconds(), Rounds: rounds}
+	}
+
+	for rounds := uint32(0); ; rounds++ {
+		var channel = make(chan uint64, 1)
+		var exhausted = make(chan struct{})
+		var roundCtx, cancel = context.WithCancel(ctx)
+		var wg sync.WaitGroup
+		var count = space / threads
+		for th := uint64(0); th < threads; th++ {
+			var size = count
+			if th == threads-1 {
+				size = space - count*th
+			}
+			wg.Add(1)
+			go func(from uint64) {
+				defer wg.Done()
+				miner(block, from, size, channel, &attempts, roundCtx)
+			}(count * th)
+		}
+		go func() {
+			wg.Wait()
+			close(exhausted)
+		}()
+
+		var nonce uint64
+		var found = false
+	wait:
+		for {
+			select {
+			case nonce = <-channel:
+				found = true
+				break wait
+			case <-exhausted:
+				select {
+				case nonce = <-channel:
+					found = true
+				default:
+				}
+				break wait
+			case <-ticker.C:
+				if opts.Progress != nil {
+					opts.Progress(progress(rounds))
+				}
+			}
+		}
+		cancel()
+		<-exhausted
+
+		if found {
+			var hash, errHash = block.CalcHash(nonce)
+			if errHash != nil {
+				return nil, errHash
+			}
+			block.Nonce = nonce
+			block.Hash = [32]byte(hash)
+			if opts.Progress != nil {
+				opts.Progress(progress(rounds))
+			}
+			return hash, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		block.Time = max(block.Time+1, time.Now().UnixNano())
 	}
-	block.Nonce = nonce
-	block.Hash = [32]byte(hash)
-	return hash, nil
 }
 
 func (block *Block) Verify(signer sign.Signer) error {
@@ -132,7 +263,7 @@ func (block *Block) Verify(signer sign.Signer) error {
 			return fmt.Errorf("%s", err.Error())
 		}
 	}
-	root, err := block.calcMerkleRoot()
+	root, err := block.CalcMerkleRoot()
 	if err != nil {
 		return err
 	}
@@ -148,6 +279,68 @@ func (block *Block) AddTransaction(tx *transaction.Transaction) error {
 	return nil
 }
 
+type blockJSON struct {
+	Index        uint32            `json:"index"`
+	Time         int64             `json:"time"`
+	Hash         transaction.Hash  `json:"hash"`
+	Prev         transaction.Hash  `json:"prev"`
+	Nonce        uint64            `json:"nonce"`
+	Difficulty   uint64            `json:"difficulty"`
+	MerkleRoot   transaction.Hash  `json:"merkleRoot"`
+	StateRoot    transaction.Hash  `json:"stateRoot"`
+	Transactions []json.RawMessage `json:"transactions"`
+}
+
+func (block *Block) Serialize() ([]byte, error) {
+	var data = blockJSON{
+		Index:        block.Index,
+		Time:         block.Time,
+		Hash:         block.Hash,
+		Prev:         block.Prev,
+		Nonce:        block.Nonce,
+		Difficulty:   block.Difficulty,
+		MerkleRoot:   block.MerkleRoot,
+		StateRoot:    block.StateRoot,
+		Transactions: make([]json.RawMessage, 0, len(block.Transactions)),
+	}
+	for _, tx := range block.Transactions {
+		var txData, err = tx.Stringify()
+		if err != nil {
+			return nil, err
+		}
+		data.Transactions = append(data.Transactions, txData)
+	}
+
+	return json.Marshal(data)
+}
+
+func ParseBlock(data []byte) (*Block, error) {
+	var parsed blockJSON
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse block: %v", err)
+	}
+	var block = Block{
+		Index:        parsed.Index,
+		Time:         parsed.Time,
+		Hash:         parsed.Hash,
+		Prev:         parsed.Prev,
+		Nonce:        parsed.Nonce,
+		Difficulty:   parsed.Difficulty,
+		MerkleRoot:   parsed.MerkleRoot,
+		StateRoot:    parsed.StateRoot,
+		Transactions: make([]transaction.Transaction, 0, len(parsed.Transactions)),
+	}
+	for _, txData := range parsed.Transactions {
+		var tx, err = transaction.ParseTransaction(txData)
+		if err != nil {
+			return nil, err
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+
+	return &block, nil
+}
+
 func (b *Block) String() string {
 	return fmt.Sprintf("Block{Index: %d, Time: %d, Hash: %x, Merkle root %x,  Prev: %x, Nonce: %d, Difficulty: %d, TxCount: %d}",
 		b.Index, b.Time, b.Hash, b.MerkleRoot, b.Prev, b.Nonce, b.Difficulty, len(b.Transactions))
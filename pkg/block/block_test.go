@@ -3,7 +3,10 @@ package block
 import (
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/coin_transfer"
+	"context"
+	"errors"
 	"testing"
+	"time"
 )
 
 func TestNewBlock_NoPrev(t *testing.T) {
@@ -74,6 +77,69 @@ func TestMineHalfByteDifficult(t *testing.T) {
 	}
 }
 
+func TestMeetsTarget(t *testing.T) {
+	block, _ := NewBlock(nil, 12)
+	block.Hash = [32]byte{0x00, 0x0f, 0xff}
+	if !block.MeetsTarget() {
+		t.Errorf("hash %x should meet 12 bits", block.Hash[:3])
+	}
+	block.Hash = [32]byte{0x00, 0x10}
+	if block.MeetsTarget() {
+		t.Errorf("hash %x should not meet 12 bits", block.Hash[:3])
+	}
+	block.Mine(0)
+	if !block.MeetsTarget() {
+		t.Errorf("mined hash %x does not meet target", block.Hash)
+	}
+}
+
+func TestMineContext_Cancel(t *testing.T) {
+	block, _ := NewBlock(nil, 200)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var reports []MineProgress
+	_, err := block.MineContext(ctx, MineOptions{
+		Threads:          2,
+		ProgressInterval: 10 * time.Millisecond,
+		Progress:         func(p MineProgress) { reports = append(reports, p) },
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("MineContext() error = %v, want deadline exceeded", err)
+	}
+	if block.Hash != [32]byte{} {
+		t.Errorf("Hash set by cancelled mining")
+	}
+	if len(reports) == 0 || reports[len(reports)-1].Attempts == 0 || reports[len(reports)-1].Hashrate <= 0 {
+		t.Errorf("no progress reported: %v", reports)
+	}
+}
+
+func TestMineContext_NonceSpaceExhausted(t *testing.T) {
+	block, _ := NewBlock(nil, 8)
+	startTime := block.Time
+	var last MineProgress
+	_, err := block.MineContext(context.Background(), MineOptions{
+		Threads:    2,
+		NonceSpace: 4,
+		Progress:   func(p MineProgress) { last = p },
+	})
+	if err != nil {
+		t.Fatalf("MineContext failed: %v", err)
+	}
+	if !block.MeetsTarget() || block.Nonce >= 4 {
+		t.Errorf("mined nonce %d hash %x", block.Nonce, block.Hash)
+	}
+	if hash, _ := block.CalcHash(block.Nonce); [32]byte(hash) != block.Hash {
+		t.Errorf("hash does not match bumped block time")
+	}
+	if last.Rounds > 0 && block.Time <= startTime {
+		t.Errorf("time was not bumped after %d exhausted rounds", last.Rounds)
+	}
+	if last.Attempts == 0 {
+		t.Errorf("final progress not reported")
+	}
+}
+
 func TestBlockWithTransactions(t *testing.T) {
 	block, _ := NewBlock(nil, 8)
 	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, "00112233445566778899aabbccddeeff00112233", 10, 1, map[string]any{
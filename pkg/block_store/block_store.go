@@ -0,0 +1,112 @@
+package block_store
+
+import (
+	"blockchain_demo/pkg/block"
+	"fmt"
+	"sync"
+)
+
+// BlockStore keeps every block known to the node in the order they were appended.
+// When several stored blocks share the same index (competing branches) GetByIndex
+// returns the one appended last. Invalidate records the hash of a block invalidated by
+// the user, Invalidated lists the recorded hashes in the order they were added.
+type BlockStore interface {
+	Append(block *block.Block) error
+	Invalidate(hash [32]byte) error
+	Invalidated() [][32]byte
+	GetByIndex(index uint32) (*block.Block, error)
+	GetByHash(hash [32]byte) (*block.Block, error)
+	Iterate(fn func(block *block.Block) error) error
+	Count() int
+	Close() error
+}
+
+type BlockStoreMemory struct {
+	blocks      []*block.Block
+	byHash      map[[32]byte]int
+	byIndex     map[uint32]int
+	invalidated [][32]byte
+	mu          sync.Mutex
+}
+
+func NewMemoryStore() BlockStore {
+	var store = BlockStoreMemory{
+		blocks:  []*block.Block{},
+		byHash:  make(map[[32]byte]int),
+		byIndex: make(map[uint32]int),
+	}
+
+	return &store
+}
+
+func (s *BlockStoreMemory) Append(blk *block.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byHash[blk.Hash]; ok {
+		return fmt.Errorf("block %x already stored", blk.Hash)
+	}
+	var stored = *blk
+	s.blocks = append(s.blocks, &stored)
+	s.byHash[blk.Hash] = len(s.blocks) - 1
+	s.byIndex[blk.Index] = len(s.blocks) - 1
+	return nil
+}
+
+func (s *BlockStoreMemory) Invalidate(hash [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidated = append(s.invalidated, hash)
+	return nil
+}
+
+func (s *BlockStoreMemory) Invalidated() [][32]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes = make([][32]byte, len(s.invalidated))
+	copy(hashes, s.invalidated)
+	return hashes
+}
+
+func (s *BlockStoreMemory) GetByIndex(index uint32) (*block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.byIndex[index]
+	if !ok {
+		return nil, fmt.Errorf("block with index %d not found", index)
+	}
+	return s.blocks[pos], nil
+}
+
+func (s *BlockStoreMemory) GetByHash(hash [32]byte) (*block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.byHash[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return s.blocks[pos], nil
+}
+
+func (s *BlockStoreMemory) Iterate(fn func(block *block.Block) error) error {
+	s.mu.Lock()
+	var blocks = make([]*block.Block, len(s.blocks))
+	copy(blocks, s.blocks)
+	s.mu.Unlock()
+
+	for _, blk := range blocks {
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlockStoreMemory) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.blocks)
+}
+
+func (s *BlockStoreMemory) Close() error {
+	return nil
+}
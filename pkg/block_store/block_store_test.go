@@ -0,0 +1,245 @@
+package block_store
+
+import (
+	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction/coin_transfer"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func mineTestChain(t *testing.T, count int) []*block.Block {
+	var blocks = []*block.Block{}
+	var prev *block.Block = nil
+	for i := 0; i < count; i++ {
+		blk, _ := block.NewBlock(prev, 4)
+		tx, err := transaction.CreateTransaction(coin_transfer.CoinTransfer, "00112233445566778899aabbccddeeff00112233", int64(i+1), 1, map[string]any{
+			"recipient": "ffeeddccbbaa99887766554433221100ffeeddcc",
+		})
+		if err != nil {
+			t.Fatalf("failed to create transaction: %v", err)
+		}
+		blk.AddTransaction(&tx)
+		if _, err := blk.Mine(1); err != nil {
+			t.Fatalf("failed to mine block: %v", err)
+		}
+		blocks = append(blocks, blk)
+		prev = blk
+	}
+	return blocks
+}
+
+func checkStore(t *testing.T, store BlockStore, blocks []*block.Block) {
+	if store.Count() != len(blocks) {
+		t.Fatalf("Count = %d, want %d", store.Count(), len(blocks))
+	}
+	for _, want := range blocks {
+		got, err := store.GetByHash(want.Hash)
+		if err != nil {
+			t.Fatalf("GetByHash failed: %v", err)
+		}
+		if got.Hash != want.Hash || got.Index != want.Index || len(got.Transactions) != len(want.Transactions) {
+			t.Errorf("GetByHash returned %v, want %v", got, want)
+		}
+		got, err = store.GetByIndex(want.Index)
+		if err != nil {
+			t.Fatalf("GetByIndex failed: %v", err)
+		}
+		if got.Hash != want.Hash {
+			t.Errorf("GetByIndex(%d) returned %x, want %x", want.Index, got.Hash, want.Hash)
+		}
+	}
+	var pos = 0
+	err := store.Iterate(func(blk *block.Block) error {
+		if blk.Hash != blocks[pos].Hash {
+			t.Errorf("Iterate position %d returned %x, want %x", pos, blk.Hash, blocks[pos].Hash)
+		}
+		pos++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Iterate failed: %v", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	blocks := mineTestChain(t, 3)
+	store := NewMemoryStore()
+	for _, blk := range blocks {
+		if err := store.Append(blk); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	checkStore(t, store, blocks)
+	if err := store.Append(blocks[0]); err == nil {
+		t.Errorf("expected error for duplicated block")
+	}
+	if _, err := store.GetByIndex(100); err == nil {
+		t.Errorf("expected error for unknown index")
+	}
+}
+
+func TestFileStore_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	blocks := mineTestChain(t, 3)
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	for _, blk := range blocks {
+		if err := store.Append(blk); err != nil {
+			t.Fatalf("Append failed: %v", err)
+		}
+	}
+	checkStore(t, store, blocks)
+	store.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	checkStore(t, store, blocks)
+	for _, blk := range blocks {
+		got, _ := store.GetByHash(blk.Hash)
+		if got.Transactions[0].GetTxId() != blk.Transactions[0].GetTxId() {
+			t.Errorf("block %d transactions changed after reopen", blk.Index)
+		}
+		if hash, _ := got.CalcHash(got.Nonce); [32]byte(hash) != blk.Hash {
+			t.Errorf("block %d hash changed after reopen", blk.Index)
+		}
+	}
+}
+
+func TestFileStore_TornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	blocks := mineTestChain(t, 3)
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	for _, blk := range blocks[:2] {
+		store.Append(blk)
+	}
+	store.Close()
+	info, _ := os.Stat(path)
+	goodSize := info.Size()
+
+	// emulate a crash in the middle of writing the third record
+	payload, _ := blocks[2].Serialize()
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0, 0, byte(len(payload) >> 8), byte(len(payload)), 1, 2, 3, 4})
+	file.Write(payload[:len(payload)/2])
+	file.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	defer store.Close()
+	checkStore(t, store, blocks[:2])
+	info, _ = os.Stat(path)
+	if info.Size() != goodSize {
+		t.Errorf("file size = %d, want %d after truncation", info.Size(), goodSize)
+	}
+
+	if err := store.Append(blocks[2]); err != nil {
+		t.Fatalf("Append after recovery failed: %v", err)
+	}
+	checkStore(t, store, blocks)
+}
+
+func TestFileStore_Invalidated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	hashes := [][32]byte{{1}, {2}}
+	for _, hash := range hashes {
+		if err := store.Invalidate(hash); err != nil {
+			t.Fatalf("Invalidate failed: %v", err)
+		}
+	}
+	store.Close()
+
+	// emulate a crash in the middle of writing a third hash
+	file, _ := os.OpenFile(path+invalidSuffix, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{3, 3, 3})
+	file.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	defer store.Close()
+	if got := store.Invalidated(); !reflect.DeepEqual(got, hashes) {
+		t.Errorf("Invalidated() = %x, want %x", got, hashes)
+	}
+	store.Invalidate([32]byte{3})
+	if got := store.Invalidated(); len(got) != 3 || got[2] != [32]byte{3} {
+		t.Errorf("Invalidated() = %x after recovery", got)
+	}
+}
+
+func TestFileStore_CorruptedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	blocks := mineTestChain(t, 3)
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	for _, blk := range blocks {
+		store.Append(blk)
+	}
+	store.Close()
+	info, _ := os.Stat(path)
+	size := info.Size()
+
+	// a bit flipped in the payload of the second record is not a torn write
+	first, _ := blocks[0].Serialize()
+	file, _ := os.OpenFile(path, os.O_RDWR, 0644)
+	offset := int64(2*recordHeaderSize + len(first) + 1)
+	var b = make([]byte, 1)
+	file.ReadAt(b, offset)
+	file.WriteAt([]byte{b[0] ^ 0x01}, offset)
+	file.Close()
+
+	if _, err := NewFileStore(path); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("NewFileStore error = %v, want %v", err, ErrCorrupted)
+	}
+	info, _ = os.Stat(path)
+	if info.Size() != size {
+		t.Errorf("file size = %d, want %d, a corrupted store must not be truncated", info.Size(), size)
+	}
+}
+
+func TestFileStore_OversizedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	blocks := mineTestChain(t, 1)
+
+	store, err := NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	store.Append(blocks[0])
+	store.Close()
+
+	// the length of a torn header is bounded by the file before it is allocated
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write([]byte{0xff, 0xff, 0xff, 0xff, 1, 2, 3, 4, 5})
+	file.Close()
+
+	store, err = NewFileStore(path)
+	if err != nil {
+		t.Fatalf("recovery failed: %v", err)
+	}
+	defer store.Close()
+	checkStore(t, store, blocks)
+}
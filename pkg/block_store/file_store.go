@@ -0,0 +1,261 @@
+package block_store
+
+import (
+	"blockchain_demo/pkg/block"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// Every record in the file is: 4 bytes payload length | 4 bytes CRC32 of payload | payload.
+// The payload is a block serialized with block.Serialize.
+const recordHeaderSize = 8
+
+// The invalidated hashes are kept next to the block file, 32 bytes each.
+const invalidSuffix = ".invalid"
+
+var ErrCorrupted = errors.New("block store is corrupted")
+
+type BlockStoreFile struct {
+	file        *os.File
+	invalidFile *os.File
+	offsets     []int64
+	byHash      map[[32]byte]int
+	byIndex     map[uint32]int
+	invalidated [][32]byte
+	size        int64
+	mu          sync.Mutex
+}
+
+// NewFileStore opens (or creates) an append-only block file at path.
+// A torn record left at the end of the file by a crash is truncated away, any other
+// damaged record fails with ErrCorrupted.
+func NewFileStore(path string) (BlockStore, error) {
+	var file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open block store: %v", err)
+	}
+	invalidFile, err := os.OpenFile(path+invalidSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open invalidated blocks: %v", err)
+	}
+	var store = BlockStoreFile{
+		file:        file,
+		invalidFile: invalidFile,
+		offsets:     []int64{},
+		byHash:      make(map[[32]byte]int),
+		byIndex:     make(map[uint32]int),
+	}
+	if err := store.recover(); err != nil {
+		file.Close()
+		invalidFile.Close()
+		return nil, err
+	}
+	if err := store.loadInvalidated(); err != nil {
+		file.Close()
+		invalidFile.Close()
+		return nil, err
+	}
+
+	return &store, nil
+}
+
+// readRecord reads the record at offset of a file of size bytes. A record running past
+// the end of the file fails with io.ErrUnexpectedEOF, one with a wrong checksum with
+// ErrCorrupted.
+func (s *BlockStoreFile) readRecord(offset int64, size int64) ([]byte, error) {
+	if offset+recordHeaderSize > size {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var header = make([]byte, recordHeaderSize)
+	if _, err := s.file.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	var length = binary.BigEndian.Uint32(header[:4])
+	var checksum = binary.BigEndian.Uint32(header[4:])
+	if int64(length) > size-offset-recordHeaderSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var payload = make([]byte, length)
+	if _, err := s.file.ReadAt(payload, offset+recordHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, fmt.Errorf("%w: record at offset %d has invalid checksum", ErrCorrupted, offset)
+	}
+	return payload, nil
+}
+
+func (s *BlockStoreFile) recover() error {
+	info, err := s.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat block store: %v", err)
+	}
+	var fileSize = info.Size()
+	var offset int64 = 0
+	for offset < fileSize {
+		payload, err := s.readRecord(offset, fileSize)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			// only the last record may be incomplete, it was never acknowledged
+			break
+		}
+		if err != nil {
+			return err
+		}
+		blk, err := block.ParseBlock(payload)
+		if err != nil {
+			return fmt.Errorf("%w at offset %d: %v", ErrCorrupted, offset, err)
+		}
+		s.index(blk, offset)
+		offset += recordHeaderSize + int64(len(payload))
+	}
+	if offset < fileSize {
+		if err := s.file.Truncate(offset); err != nil {
+			return fmt.Errorf("failed to truncate torn record: %v", err)
+		}
+		if err := s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.size = offset
+	return nil
+}
+
+// loadInvalidated reads the invalidated hashes, a torn hash at the end was never
+// acknowledged and is truncated away.
+func (s *BlockStoreFile) loadInvalidated() error {
+	var data, err = io.ReadAll(s.invalidFile)
+	if err != nil {
+		return fmt.Errorf("failed to read invalidated blocks: %v", err)
+	}
+	for len(data) >= 32 {
+		s.invalidated = append(s.invalidated, [32]byte(data[:32]))
+		data = data[32:]
+	}
+	if len(data) > 0 {
+		if err := s.invalidFile.Truncate(int64(len(s.invalidated) * 32)); err != nil {
+			return fmt.Errorf("failed to truncate torn hash: %v", err)
+		}
+		return s.invalidFile.Sync()
+	}
+	return nil
+}
+
+func (s *BlockStoreFile) index(blk *block.Block, offset int64) {
+	s.offsets = append(s.offsets, offset)
+	s.byHash[blk.Hash] = len(s.offsets) - 1
+	s.byIndex[blk.Index] = len(s.offsets) - 1
+}
+
+func (s *BlockStoreFile) Append(blk *block.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.byHash[blk.Hash]; ok {
+		return fmt.Errorf("block %x already stored", blk.Hash)
+	}
+	payload, err := blk.Serialize()
+	if err != nil {
+		return err
+	}
+	var record = make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	if _, err := s.file.WriteAt(record, s.size); err != nil {
+		return fmt.Errorf("failed to write block: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync block store: %v", err)
+	}
+	s.index(blk, s.size)
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *BlockStoreFile) Invalidate(hash [32]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.invalidFile.WriteAt(hash[:], int64(len(s.invalidated)*32)); err != nil {
+		return fmt.Errorf("failed to write invalidated block: %v", err)
+	}
+	if err := s.invalidFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync invalidated blocks: %v", err)
+	}
+	s.invalidated = append(s.invalidated, hash)
+	return nil
+}
+
+func (s *BlockStoreFile) Invalidated() [][32]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hashes = make([][32]byte, len(s.invalidated))
+	copy(hashes, s.invalidated)
+	return hashes
+}
+
+func (s *BlockStoreFile) get(pos int) (*block.Block, error) {
+	payload, err := s.readRecord(s.offsets[pos], s.size)
+	if err != nil {
+		return nil, err
+	}
+	return block.ParseBlock(payload)
+}
+
+func (s *BlockStoreFile) GetByIndex(index uint32) (*block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.byIndex[index]
+	if !ok {
+		return nil, fmt.Errorf("block with index %d not found", index)
+	}
+	return s.get(pos)
+}
+
+func (s *BlockStoreFile) GetByHash(hash [32]byte) (*block.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pos, ok := s.byHash[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	return s.get(pos)
+}
+
+func (s *BlockStoreFile) Iterate(fn func(block *block.Block) error) error {
+	s.mu.Lock()
+	var count = len(s.offsets)
+	s.mu.Unlock()
+
+	for pos := 0; pos < count; pos++ {
+		s.mu.Lock()
+		blk, err := s.get(pos)
+		s.mu.Unlock()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return fmt.Errorf("block store is truncated at record %d", pos)
+			}
+			return err
+		}
+		if err := fn(blk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BlockStoreFile) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.offsets)
+}
+
+func (s *BlockStoreFile) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return errors.Join(s.file.Close(), s.invalidFile.Close())
+}
@@ -3,38 +3,136 @@ package blockchain
 import (
 	"blockchain_demo/pkg/ballance_storage"
 	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/block_store"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/difficulty"
+	"blockchain_demo/pkg/mempool"
+	"blockchain_demo/pkg/rewards"
 	"blockchain_demo/pkg/sign"
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/coin_transfer"
 	"blockchain_demo/pkg/transaction_processor"
+	"blockchain_demo/pkg/utxo_storage"
+	"context"
+	"errors"
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 )
 
 const EmptyAddress = "0000000000000000000000000000000000000000"
 
+// DefaultMaxBlockSize is the default limit of the serialized transactions of a block.
+const DefaultMaxBlockSize = 1 << 20
+
+const maxInt64Digits = 19
+
+var (
+	ErrNonceTooLow  = errors.New("transaction nonce is already used")
+	ErrNonceTooHigh = errors.New("transaction nonce leaves a gap")
+	ErrDoubleSpend  = errors.New("transaction spends an output spent by a pooled transaction")
+)
+
 type Blockchain struct {
 	CurrentDifficulty uint64
 	CurrentRewards    uint64
-	txPool            []transaction.Transaction
+	mempool           mempool.Mempool
+	maxBlockSize      int
 	blocks            []block.Block
+	tree              map[[32]byte]*chainNode
+	invalid           map[[32]byte]bool
 	signature         *sign.SignatureKeys
 	signer            sign.Signer
 	txProcessor       transaction_processor.TransactionProcessor
 	storage           ballance_storage.BallanceStorage
+	contracts         contract_storage.ContractStorage
+	utxos             utxo_storage.UtxoStorage
+	store             block_store.BlockStore
+	initialDifficulty uint64
+	retarget          difficulty.Retarget
+	schedule          *rewards.Schedule
+	templates         map[uint64]*block.Block
+	templateSeq       uint64
 	mu                sync.Mutex
 }
 
-func NewBlockchain(rewards uint64, difficulty uint64, creator string, signer sign.Signer, storage ballance_storage.BallanceStorage, txTypes map[transaction.TransactionType]transaction_processor.TransactionProcessor) (*Blockchain, error) {
+// Option changes consensus parameters of the blockchain before the genesis block is
+// mined or the stored chain is loaded.
+type Option func(blockchain *Blockchain)
+
+// WithRetarget replaces the fixed difficulty with a retarget algorithm. The difficulty
+// passed to the constructor is used for the genesis block.
+func WithRetarget(retarget difficulty.Retarget) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.retarget = retarget
+	}
+}
+
+// WithMempool replaces the default limits of the transaction pool.
+func WithMempool(config mempool.Config) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.mempool = mempool.NewMempool(config)
+	}
+}
+
+// WithMaxBlockSize changes the limit of the serialized transactions of a block.
+func WithMaxBlockSize(size int) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.maxBlockSize = size
+	}
+}
+
+// WithContractStorage sets the storage of deployed contracts. It is confirmed and
+// reverted together with the ballance storage.
+func WithContractStorage(contracts contract_storage.ContractStorage) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.contracts = contracts
+	}
+}
+
+// WithUtxoStorage sets the set of unspent transaction outputs. It is confirmed and
+// reverted together with the ballance storage.
+func WithUtxoStorage(utxos utxo_storage.UtxoStorage) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.utxos = utxos
+	}
+}
+
+// WithRewardSchedule replaces the constant block reward with a schedule.
+func WithRewardSchedule(schedule *rewards.Schedule) Option {
+	return func(blockchain *Blockchain) {
+		blockchain.schedule = schedule
+		blockchain.CurrentRewards = schedule.Reward(1)
+	}
+}
+
+func NewBlockchain(reward uint64, difficulty uint64, creator string, signer sign.Signer, storage ballance_storage.BallanceStorage, txTypes map[transaction.TransactionType]transaction_processor.TransactionProcessor, options ...Option) (*Blockchain, error) {
+	return NewBlockchainWithStore(reward, difficulty, creator, signer, storage, block_store.NewMemoryStore(), txTypes, options...)
+}
+
+// NewBlockchainWithStore reopens the chain kept in store, replaying its blocks into the
+// ballance storage. The genesis block is mined only when the store is empty.
+func NewBlockchainWithStore(reward uint64, initialDifficulty uint64, creator string, signer sign.Signer, storage ballance_storage.BallanceStorage, store block_store.BlockStore, txTypes map[transaction.TransactionType]transaction_processor.TransactionProcessor, options ...Option) (*Blockchain, error) {
 	var blockchain = Blockchain{
-		CurrentDifficulty: difficulty,
-		CurrentRewards:    rewards,
-		txPool:            []transaction.Transaction{},
+		CurrentDifficulty: initialDifficulty,
+		CurrentRewards:    reward,
+		mempool:           mempool.NewMempool(mempool.DefaultConfig()),
+		maxBlockSize:      DefaultMaxBlockSize,
 		blocks:            []block.Block{},
+		tree:              make(map[[32]byte]*chainNode),
+		invalid:           make(map[[32]byte]bool),
 		signer:            signer,
 		storage:           storage,
+		store:             store,
 		txProcessor:       transaction_processor.BaseProcessor{},
+		initialDifficulty: initialDifficulty,
+		retarget:          difficulty.NewFixed(initialDifficulty),
+		schedule:          rewards.NewConstant(reward),
+		templates:         make(map[uint64]*block.Block),
+	}
+	for _, option := range options {
+		option(&blockchain)
 	}
 
 	for txType, processor := range txTypes {
@@ -48,6 +146,14 @@ func NewBlockchain(rewards uint64, difficulty uint64, creator string, signer sig
 
 	blockchain.signature = signature
 
+	if store.Count() > 0 {
+		var err = blockchain.loadFromStore()
+		if err != nil {
+			return nil, err
+		}
+		return &blockchain, nil
+	}
+
 	_, err := blockchain.MineBlockFromPool(creator)
 	if err != nil {
 		return nil, err
@@ -56,8 +162,9 @@ func NewBlockchain(rewards uint64, difficulty uint64, creator string, signer sig
 	return &blockchain, nil
 }
 
-func (blockchain *Blockchain) createBaseTx(recipient string, fee int64) (transaction.Transaction, error) {
-	var coinbaseTx, txErr = transaction.CreateTransaction(coin_transfer.CoinTransfer, EmptyAddress, int64(blockchain.CurrentRewards)+fee, 0, map[string]any{
+func (blockchain *Blockchain) createBaseTx(recipient string, height uint32, fee int64) (transaction.Transaction, error) {
+	var reward = int64(blockchain.schedule.Reward(height))
+	var coinbaseTx, txErr = transaction.CreateTransaction(coin_transfer.CoinTransfer, EmptyAddress, reward+fee, 0, map[string]any{
 		"recipient": recipient,
 	})
 	if txErr != nil {
@@ -76,42 +183,181 @@ func (blockchain *Blockchain) createBaseTx(recipient string, fee int64) (transac
 	return coinbaseTx, nil
 }
 
-func (blockchain *Blockchain) addBlockUnsafe(block *block.Block) error {
-	if blockchain.CurrentDifficulty > block.Difficulty {
-		return fmt.Errorf("block difficulty is too low")
+// loadFromStore rebuilds the block tree from every stored block. Blocks of side
+// branches that failed to connect during a reorg are stored too, they are skipped here
+// the same way they were rejected before the restart, together with the invalidated
+// blocks and their descendants. Any other block that fails means the store is damaged
+// and fails the load. A persistent ballance storage is rewound first, so replaying the
+// blocks does not apply them twice.
+func (blockchain *Blockchain) loadFromStore() error {
+	var err = blockchain.revertStateUnsafe(0)
+	if err != nil {
+		return err
+	}
+	for _, hash := range blockchain.store.Invalidated() {
+		blockchain.invalid[hash] = true
+	}
+	return blockchain.store.Iterate(func(blk *block.Block) error {
+		var err = blockchain.acceptBlockUnsafe(blk, false)
+		if err == nil {
+			return nil
+		}
+		if blockchain.invalid[blk.Hash] || blockchain.invalid[blk.Prev] {
+			blockchain.invalid[blk.Hash] = true
+			return nil
+		}
+		return fmt.Errorf("block %d: %w", blk.Index, err)
+	})
+}
+
+// confirmStateUnsafe commits the pending changes of every storage as the height of blk.
+// A failure wraps ErrStateRestore, the storages confirmed before it keep the height of
+// blk.
+func (blockchain *Blockchain) confirmStateUnsafe(blk *block.Block) error {
+	if err := blockchain.storage.Confirm(); err != nil {
+		return fmt.Errorf("%w: confirming block %d: %v", ErrStateRestore, blk.Index, err)
+	}
+	if blockchain.contracts != nil {
+		if err := blockchain.contracts.Confirm(); err != nil {
+			return fmt.Errorf("%w: confirming contracts of block %d: %v", ErrStateRestore, blk.Index, err)
+		}
+	}
+	if blockchain.utxos != nil {
+		if err := blockchain.utxos.Confirm(blk.Time); err != nil {
+			return fmt.Errorf("%w: confirming outputs of block %d: %v", ErrStateRestore, blk.Index, err)
+		}
+	}
+	return nil
+}
+
+// stateRootUnsafe returns the root of the contract state including pending changes.
+func (blockchain *Blockchain) stateRootUnsafe() [32]byte {
+	if blockchain.contracts == nil {
+		return [32]byte{}
+	}
+	return blockchain.contracts.Root()
+}
+
+// rejectStateUnsafe drops the pending changes of every storage, a failure wraps
+// ErrStateRestore.
+func (blockchain *Blockchain) rejectStateUnsafe() error {
+	var err = blockchain.storage.Reject()
+	if blockchain.contracts != nil {
+		err = errors.Join(err, blockchain.contracts.Reject())
+	}
+	if blockchain.utxos != nil {
+		err = errors.Join(err, blockchain.utxos.Reject())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: rejecting pending changes: %v", ErrStateRestore, err)
+	}
+	return nil
+}
+
+// abortStateUnsafe drops the pending changes after err and returns err, joined with the
+// failure to drop them.
+func (blockchain *Blockchain) abortStateUnsafe(err error) error {
+	if rejectErr := blockchain.rejectStateUnsafe(); rejectErr != nil {
+		return errors.Join(err, rejectErr)
 	}
-	var err = block.Verify(blockchain.signer)
+	return err
+}
+
+func (blockchain *Blockchain) revertStateUnsafe(height uint32) error {
+	var err = blockchain.storage.RevertTo(height)
 	if err != nil {
 		return err
 	}
-	for _, tx := range block.Transactions {
-		err := blockchain.txProcessor.Process(tx)
+	if blockchain.contracts != nil {
+		err = blockchain.contracts.RevertTo(height)
 		if err != nil {
-			blockchain.storage.Reject()
 			return err
 		}
 	}
-	blockchain.storage.Confirm()
-	blockchain.deleteExecutedTxFromPoolUnsafe(block)
-	blockchain.blocks = append(blockchain.blocks, *block)
+	if blockchain.utxos != nil {
+		return blockchain.utxos.RevertTo(height)
+	}
 	return nil
 }
 
-func (blockchain *Blockchain) deleteExecutedTxFromPoolUnsafe(block *block.Block) {
-	var newPool = []transaction.Transaction{}
-	for _, tx := range blockchain.txPool {
-		var checkTx = &tx
-		for _, addedTx := range block.Transactions {
-			if tx.GetTxId() == addedTx.GetTxId() {
-				checkTx = nil
-				break
+// processTransactionsUnsafe applies the transactions of the block to the pending state
+// and returns the fees charged by them, which may be less than their fees.
+func (blockchain *Blockchain) processTransactionsUnsafe(block *block.Block) (int64, error) {
+	var fees int64 = 0
+	for _, tx := range block.Transactions {
+		if isCoinbase(tx) {
+			if err := blockchain.txProcessor.Process(tx); err != nil {
+				return 0, blockchain.abortStateUnsafe(err)
 			}
+			continue
+		}
+		err := blockchain.storage.UseNonce(string(tx.GetSender()), tx.GetNonce())
+		if err != nil {
+			return 0, blockchain.abortStateUnsafe(fmt.Errorf("transaction %x: %w", tx.GetTxId(), err))
+		}
+		fee, err := transaction_processor.ProcessFee(blockchain.txProcessor, tx)
+		if err != nil {
+			return 0, blockchain.abortStateUnsafe(err)
+		}
+		fees += fee
+	}
+	return fees, nil
+}
+
+func (blockchain *Blockchain) addBlockUnsafe(block *block.Block) error {
+	return blockchain.acceptBlockUnsafe(block, true)
+}
+
+// deleteExecutedTxFromPoolUnsafe drops the transactions of the block from the pool,
+// together with pooled transactions whose nonce was used by another transaction or
+// which spend an output spent by the block.
+func (blockchain *Blockchain) deleteExecutedTxFromPoolUnsafe(block *block.Block) {
+	for _, tx := range block.Transactions {
+		blockchain.mempool.Remove(tx.GetTxId())
+	}
+	for _, tx := range blockchain.mempool.Transactions() {
+		if tx.GetNonce() < blockchain.storage.GetNonce(string(tx.GetSender())) || !blockchain.unspentUnsafe(tx) {
+			blockchain.mempool.Remove(tx.GetTxId())
 		}
-		if checkTx != nil {
-			newPool = append(newPool, *checkTx)
+	}
+}
+
+// unspentUnsafe reports whether every output spent by tx is still unspent.
+func (blockchain *Blockchain) unspentUnsafe(tx transaction.Transaction) bool {
+	spender, ok := tx.(transaction.Spender)
+	if !ok || blockchain.utxos == nil {
+		return true
+	}
+	for _, outpoint := range spender.SpentOutPoints() {
+		if blockchain.utxos.Get(outpoint) == nil {
+			return false
 		}
 	}
-	blockchain.txPool = newPool
+	return true
+}
+
+// conflictUnsafe fails when tx spends an output that a pooled transaction spends too.
+func (blockchain *Blockchain) conflictUnsafe(tx transaction.Transaction) error {
+	spender, ok := tx.(transaction.Spender)
+	if !ok {
+		return nil
+	}
+	var spent = make(map[transaction.OutPoint]bool)
+	for _, outpoint := range spender.SpentOutPoints() {
+		spent[outpoint] = true
+	}
+	for _, pooled := range blockchain.mempool.Transactions() {
+		other, ok := pooled.(transaction.Spender)
+		if !ok {
+			continue
+		}
+		for _, outpoint := range other.SpentOutPoints() {
+			if spent[outpoint] {
+				return fmt.Errorf("%w %x: %x:%d", ErrDoubleSpend, pooled.GetTxId(), outpoint.TxId, outpoint.Index)
+			}
+		}
+	}
+	return nil
 }
 
 func (blockchain *Blockchain) AddBlock(block *block.Block) error {
@@ -121,61 +367,145 @@ func (blockchain *Blockchain) AddBlock(block *block.Block) error {
 }
 
 func (blockchain *Blockchain) MineBlockFromPool(creator string) (*block.Block, error) {
+	return blockchain.MineBlockFromPoolContext(context.Background(), creator, block.MineOptions{})
+}
+
+// MineBlockFromPoolContext mines a block of the pooled transactions, it gives up with
+// the context error when ctx is done before a nonce is found.
+func (blockchain *Blockchain) MineBlockFromPoolContext(ctx context.Context, creator string, opts block.MineOptions) (*block.Block, error) {
 	blockchain.mu.Lock()
 	defer blockchain.mu.Unlock()
 
+	var block, err = blockchain.assembleBlockUnsafe(creator)
+	if err != nil {
+		return nil, err
+	}
+	var blockHash, errMine = block.MineContext(ctx, opts)
+	if errMine != nil {
+		return nil, errMine
+	}
+	if [32]byte(blockHash) == [32]byte{} {
+		return nil, fmt.Errorf("error while creating a block")
+	}
+
+	var errBlock = blockchain.addBlockUnsafe(block)
+	if errBlock != nil {
+		return nil, errBlock
+	}
+
+	return block, nil
+}
+
+// assembleBlockUnsafe creates a block on top of the tip with the most profitable pooled
+// transactions fitting into the block size limit and a coinbase collecting their fees.
+func (blockchain *Blockchain) assembleBlockUnsafe(creator string) (*block.Block, error) {
 	var prevBlock *block.Block = nil
 	if len(blockchain.blocks) > 0 {
 		prevBlock = &blockchain.blocks[len(blockchain.blocks)-1]
 	}
-	var block, err = block.NewBlock(prevBlock, blockchain.CurrentDifficulty)
+	var blk, err = block.NewBlock(prevBlock, blockchain.CurrentDifficulty)
 	if err != nil {
 		return nil, err
 	}
+	blockchain.mempool.Expire(time.Now())
 
+	// the coinbase value grows with the fees by at most maxInt64Digits bytes
+	coinbaseTx, err := blockchain.createBaseTx(creator, blk.Index, 0)
+	if err != nil {
+		return nil, err
+	}
+	var txs = blockchain.mempool.Select(blockchain.maxBlockSize-txSize(coinbaseTx)-maxInt64Digits, func(sender []byte) uint64 {
+		return blockchain.storage.GetNonce(string(sender))
+	})
 	var fee int64 = 0
-	for _, tx := range blockchain.txPool {
+	for _, tx := range txs {
 		fee += tx.GetFee()
 	}
-
-	var coinbaseTx, txErr = blockchain.createBaseTx(creator, fee)
-	if txErr != nil {
-		return nil, txErr
+	coinbaseTx, err = blockchain.createBaseTx(creator, blk.Index, fee)
+	if err != nil {
+		return nil, err
 	}
 
-	block.AddTransaction(&coinbaseTx)
-	for _, tx := range blockchain.txPool {
-		block.AddTransaction(&tx)
-	}
-	var blockHash, errMine = block.Mine(0)
-	if errMine != nil || [32]byte(blockHash) == [32]byte{} {
-		return nil, fmt.Errorf("error while creating a block")
+	blk.AddTransaction(&coinbaseTx)
+	for _, tx := range txs {
+		blk.AddTransaction(&tx)
 	}
 
-	var errBlock = blockchain.addBlockUnsafe(block)
-	if errBlock != nil {
-		return nil, errBlock
+	// the state root and the fees charged by contract calls are known only after the
+	// transactions are executed, a coinbase claiming less is executed again
+	if blockchain.contracts != nil {
+		charged, err := blockchain.processTransactionsUnsafe(blk)
+		if err != nil {
+			return nil, err
+		}
+		if charged != fee {
+			if err := blockchain.rejectStateUnsafe(); err != nil {
+				return nil, err
+			}
+			coinbaseTx, err = blockchain.createBaseTx(creator, blk.Index, charged)
+			if err != nil {
+				return nil, err
+			}
+			blk.Transactions[0] = coinbaseTx
+			if fee, err = blockchain.processTransactionsUnsafe(blk); err != nil {
+				return nil, err
+			}
+			if fee != charged {
+				return nil, blockchain.abortStateUnsafe(fmt.Errorf("charged fees changed from %d to %d with the coinbase", charged, fee))
+			}
+		}
+		blk.StateRoot = blockchain.stateRootUnsafe()
+		if err := blockchain.rejectStateUnsafe(); err != nil {
+			return nil, err
+		}
 	}
+	return blk, nil
+}
 
-	return block, nil
+// nextNonceUnsafe returns the nonce of the next transaction of sender, counting the
+// transactions of sender waiting in the pool.
+func (blockchain *Blockchain) nextNonceUnsafe(sender []byte) uint64 {
+	var nonce = blockchain.storage.GetNonce(string(sender))
+	if last, ok := blockchain.mempool.LastNonce(sender); ok && last >= nonce {
+		nonce = last + 1
+	}
+	return nonce
 }
 
+// AddTransactionToPool accepts a transaction whose nonce directly follows the last
+// nonce of its sender, so a replayed transaction or one leaving a gap is rejected.
 func (blockchain *Blockchain) AddTransactionToPool(tx transaction.Transaction) error {
 	blockchain.mu.Lock()
 	defer blockchain.mu.Unlock()
 
+	if isCoinbase(tx) {
+		return fmt.Errorf("coinbase transaction can not be added to the pool")
+	}
 	var err = tx.Verify(blockchain.signer)
 	if err != nil {
 		return err
 	}
+	var expected = blockchain.nextNonceUnsafe(tx.GetSender())
+	if blockchain.mempool.Contains(tx.GetTxId()) {
+		return mempool.ErrAlreadyExists
+	}
+	if tx.GetNonce() < expected {
+		return fmt.Errorf("%w: %d, expected %d", ErrNonceTooLow, tx.GetNonce(), expected)
+	}
+	if tx.GetNonce() > expected {
+		return fmt.Errorf("%w: %d, expected %d", ErrNonceTooHigh, tx.GetNonce(), expected)
+	}
 	err = blockchain.txProcessor.Validate(tx)
 	if err != nil {
 		return err
 	}
+	err = blockchain.conflictUnsafe(tx)
+	if err != nil {
+		return err
+	}
 
-	blockchain.txPool = append(blockchain.txPool, tx)
-
-	return nil
+	blockchain.mempool.Expire(time.Now())
+	return blockchain.mempool.Add(tx)
 }
 
 func (blockchain *Blockchain) Verify(depth int) error {
@@ -197,13 +527,34 @@ func (blockchain *Blockchain) Verify(depth int) error {
 	return nil
 }
 
+// IssuedSupply returns the total amount of coins minted by blocks up to height
+// according to the reward schedule.
+func (blockchain *Blockchain) IssuedSupply(height uint32) uint64 {
+	return blockchain.schedule.IssuedSupply(height)
+}
+
+// GetTokenBallance returns the confirmed ballance of holder in token.
+func (blockchain *Blockchain) GetTokenBallance(token []byte, holder []byte) int64 {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	return blockchain.storage.GetTokenBallance(string(token), string(holder))
+}
+
+// GetTokenSupply returns the total minted units of token.
+func (blockchain *Blockchain) GetTokenSupply(token []byte) int64 {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	return blockchain.storage.GetTokenSupply(string(token))
+}
+
 func (bc *Blockchain) String() string {
 	var sb strings.Builder
 	sb.WriteString("Blockchain{\n")
 	sb.WriteString(fmt.Sprintf("  CurrentDifficult: %d bits\n", bc.CurrentDifficulty))
 	sb.WriteString(fmt.Sprintf("  CurrentRewards: %d\n", bc.CurrentRewards))
-	sb.WriteString(fmt.Sprintf("  TxPool: %d transactions\n", len(bc.txPool)))
+	sb.WriteString(fmt.Sprintf("  TxPool: %d transactions\n", bc.mempool.Count()))
 	sb.WriteString(fmt.Sprintf("  Blocks: %d blocks\n", len(bc.blocks)))
+	sb.WriteString(fmt.Sprintf("  Known blocks: %d blocks\n", len(bc.tree)))
 	for i, blk := range bc.blocks {
 		sb.WriteString(fmt.Sprintf("    Block[%d]: Index=%d, TxCount=%d\n", i, blk.Index, len(blk.Transactions)))
 	}
@@ -3,14 +3,39 @@ package blockchain
 import (
 	"blockchain_demo/pkg/ballance_storage"
 	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/block_store"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/difficulty"
+	"blockchain_demo/pkg/mempool"
+	"blockchain_demo/pkg/rewards"
+	"blockchain_demo/pkg/script_vm"
 	"blockchain_demo/pkg/sign"
 	"blockchain_demo/pkg/sign/sign_ecdsa"
+	"blockchain_demo/pkg/sign/sign_ed25519"
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/coin_transfer"
+	"blockchain_demo/pkg/transaction/contract_call"
+	"blockchain_demo/pkg/transaction/contract_deploy"
+	"blockchain_demo/pkg/transaction/token_transfer"
+	"blockchain_demo/pkg/transaction/utxo_transfer"
 	"blockchain_demo/pkg/transaction_processor"
 	"blockchain_demo/pkg/transaction_processor/coin_transfer_processor"
+	"blockchain_demo/pkg/transaction_processor/contract_call_processor"
+	"blockchain_demo/pkg/transaction_processor/contract_deploy_processor"
+	"blockchain_demo/pkg/transaction_processor/token_transfer_processor"
+	"blockchain_demo/pkg/transaction_processor/utxo_transfer_processor"
+	"blockchain_demo/pkg/utils"
+	"blockchain_demo/pkg/utils/stack"
+	"blockchain_demo/pkg/utxo_storage"
+	"crypto/rand"
+	"bytes"
+	"context"
 	"encoding/hex"
+	"errors"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func generateTestKeys(t *testing.T, signer sign.Signer) *sign.SignatureKeys {
@@ -21,6 +46,12 @@ func generateTestKeys(t *testing.T, signer sign.Signer) *sign.SignatureKeys {
 	return signature
 }
 
+// testAccount returns new keys with the address they own.
+func testAccount(t *testing.T, signer sign.Signer) (*sign.SignatureKeys, string) {
+	signature := generateTestKeys(t, signer)
+	return signature, hex.EncodeToString(sign.PublicKeyHash(signature.PublicKey))
+}
+
 func randomAddress() string {
 	return hex.EncodeToString(make([]byte, 20))
 }
@@ -50,10 +81,9 @@ func TestNewBlockchain(t *testing.T) {
 }
 
 func TestAddTransactionToPool(t *testing.T) {
-	creator := randomAddress()
+	signature, creator := testAccount(t, sign_ecdsa.EcdsaSigner{})
 	storage := ballance_storage.NewMemoryStorage()
 	bc, _ := NewBlockchain(50, 8, creator, sign_ecdsa.EcdsaSigner{}, storage, transactionTypes(storage))
-	signature := generateTestKeys(t, bc.signer)
 	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer,creator, 10, 1, map[string]any{
 		"recipient": randomAddress(),
 	})
@@ -62,16 +92,29 @@ func TestAddTransactionToPool(t *testing.T) {
 	if err != nil {
 		t.Fatalf("AddTransactionToPool failed: %v", err)
 	}
-	if len(bc.txPool) != 1 {
+	if bc.mempool.Count() != 1 {
 		t.Errorf("TxPool should have 1 transaction")
 	}
+
+	stranger, _ := testAccount(t, bc.signer)
+	tx, _ = transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": randomAddress(),
+		"nonce":     1,
+	})
+	tx.AddSing(bc.signer, stranger)
+	if err := bc.AddTransactionToPool(tx); err == nil {
+		t.Errorf("expected error for transaction signed by a key not owning the sender")
+	}
+	coinbase, _ := bc.createBaseTx(creator, 2, 0)
+	if err := bc.AddTransactionToPool(coinbase); err == nil {
+		t.Errorf("expected error for coinbase transaction")
+	}
 }
 
 func TestMineBlockFromPool(t *testing.T) {
-	creator := randomAddress()
+	signature, creator := testAccount(t, sign_ecdsa.EcdsaSigner{})
 	storage := ballance_storage.NewMemoryStorage()
 	bc, _ := NewBlockchain(50, 8, creator, sign_ecdsa.EcdsaSigner{}, storage, transactionTypes(storage))
-	signature := generateTestKeys(t, bc.signer)
 	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer,creator, 10, 1, map[string]any{
 		"recipient": randomAddress(),
 	})
@@ -84,7 +127,7 @@ func TestMineBlockFromPool(t *testing.T) {
 	if len(bc.blocks) != 2 {
 		t.Errorf("Expected 2 blocks after mining, got %d", len(bc.blocks))
 	}
-	if len(bc.txPool) != 0 {
+	if bc.mempool.Count() != 0 {
 		t.Errorf("TxPool should be empty after mining")
 	}
 }
@@ -102,10 +145,9 @@ func TestAddBlock_InvalidBlock(t *testing.T) {
 }
 
 func TestVerifyBlockchain(t *testing.T) {
-	creator := randomAddress()
+	signature, creator := testAccount(t, sign_ecdsa.EcdsaSigner{})
 	storage := ballance_storage.NewMemoryStorage()
 	bc, _ := NewBlockchain(50, 8, creator, sign_ecdsa.EcdsaSigner{}, storage, transactionTypes(storage))
-	signature := generateTestKeys(t, bc.signer)
 	for i := 0; i < 3; i++ {
 		tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer,creator, int64(i+1), 1, map[string]any{
 			"recipient": randomAddress(),
@@ -120,6 +162,1388 @@ func TestVerifyBlockchain(t *testing.T) {
 	}
 }
 
+func TestReopenBlockchainFromStore(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	store, err := block_store.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchainWithStore failed: %v", err)
+	}
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": recipient,
+	})
+	tx.AddSing(bc.signer, signature)
+	bc.AddTransactionToPool(tx)
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	lastHash := bc.blocks[len(bc.blocks)-1].Hash
+	store.Close()
+
+	store, err = block_store.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen store failed: %v", err)
+	}
+	defer store.Close()
+	storage = ballance_storage.NewMemoryStorage()
+	reopened, err := NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("reopen blockchain failed: %v", err)
+	}
+	if len(reopened.blocks) != 2 {
+		t.Fatalf("Expected 2 blocks after reopen, got %d", len(reopened.blocks))
+	}
+	if reopened.blocks[1].Hash != lastHash {
+		t.Errorf("tip hash = %x, want %x", reopened.blocks[1].Hash, lastHash)
+	}
+	if storage.GetBallance(string(tx.(*coin_transfer.CoinTransferTransaction).Recipient)) != 10 {
+		t.Errorf("recipient ballance was not restored")
+	}
+	if err := reopened.Verify(2); err != nil {
+		t.Errorf("Blockchain verification failed: %v", err)
+	}
+}
+
+func TestReopenBlockchainFromStore_InvalidBlock(t *testing.T) {
+	_, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	store, err := block_store.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("NewFileStore failed: %v", err)
+	}
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchainWithStore failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	// a main chain record that does not pass validation, its coinbase claims fees
+	tip := bc.GetTip()
+	b, _ := block.NewBlock(tip, bc.CurrentDifficulty)
+	coinbase, _ := bc.createBaseTx(creator, tip.Index+1, 5)
+	b.AddTransaction(&coinbase)
+	if _, err := b.Mine(0); err != nil {
+		t.Fatalf("Mine failed: %v", err)
+	}
+	if err := store.Append(b); err != nil {
+		t.Fatalf("Append failed: %v", err)
+	}
+	store.Close()
+
+	store, err = block_store.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("reopen store failed: %v", err)
+	}
+	defer store.Close()
+	storage = ballance_storage.NewMemoryStorage()
+	_, err = NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+	if !errors.Is(err, ErrBadCoinbaseValue) {
+		t.Errorf("reopen error = %v, want %v", err, ErrBadCoinbaseValue)
+	}
+}
+
+func mineSideBlock(t *testing.T, bc *Blockchain, prev *block.Block, miner string) *block.Block {
+	b, _ := block.NewBlock(prev, bc.CurrentDifficulty)
+	coinbase, err := bc.createBaseTx(miner, prev.Index+1, 0)
+	if err != nil {
+		t.Fatalf("createBaseTx failed: %v", err)
+	}
+	b.AddTransaction(&coinbase)
+	if _, err := b.Mine(0); err != nil {
+		t.Fatalf("Mine failed: %v", err)
+	}
+	return b
+}
+
+func TestForkReorganization(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	minerB := "2222222222222222222222222222222222222222"
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	genesis := bc.GetTip()
+
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": recipient,
+	})
+	tx.AddSing(bc.signer, signature)
+	if err := bc.AddTransactionToPool(tx); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+	a1, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	recipientKey, _ := hex.DecodeString(recipient)
+	minerKey, _ := hex.DecodeString(minerB)
+	if storage.GetBallance(string(recipientKey)) != 10 {
+		t.Fatalf("recipient ballance = %d, want 10", storage.GetBallance(string(recipientKey)))
+	}
+
+	// competing branch with the same work does not replace the main chain
+	b1 := mineSideBlock(t, bc, genesis, minerB)
+	if err := bc.AddBlock(b1); err != nil {
+		t.Fatalf("AddBlock(b1) failed: %v", err)
+	}
+	if bc.GetTip().Hash != a1.Hash {
+		t.Fatalf("tip switched to a branch with equal work")
+	}
+
+	// the heavier branch wins
+	b2 := mineSideBlock(t, bc, b1, minerB)
+	if err := bc.AddBlock(b2); err != nil {
+		t.Fatalf("AddBlock(b2) failed: %v", err)
+	}
+	if bc.GetTip().Hash != b2.Hash {
+		t.Fatalf("tip = %x, want %x", bc.GetTip().Hash, b2.Hash)
+	}
+	if len(bc.blocks) != 3 || bc.blocks[1].Hash != b1.Hash {
+		t.Errorf("main chain was not switched to the heavier branch")
+	}
+	if storage.GetBallance(string(recipientKey)) != 0 {
+		t.Errorf("recipient ballance = %d, want 0 after reorg", storage.GetBallance(string(recipientKey)))
+	}
+	if storage.GetBallance(string(creatorKey)) != 50 {
+		t.Errorf("creator ballance = %d, want 50 after reorg", storage.GetBallance(string(creatorKey)))
+	}
+	if storage.GetBallance(string(minerKey)) != 100 {
+		t.Errorf("miner ballance = %d, want 100 after reorg", storage.GetBallance(string(minerKey)))
+	}
+	if bc.mempool.Count() != 1 || !bc.mempool.Contains(tx.GetTxId()) {
+		t.Errorf("orphaned transaction was not returned to the pool")
+	}
+
+	// the returned transaction is mined on top of the new branch
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if storage.GetBallance(string(recipientKey)) != 10 {
+		t.Errorf("recipient ballance = %d, want 10", storage.GetBallance(string(recipientKey)))
+	}
+}
+
+// failingRevertStorage fails RevertTo once fail is set.
+type failingRevertStorage struct {
+	ballance_storage.BallanceStorage
+	fail bool
+}
+
+func (s *failingRevertStorage) RevertTo(height uint32) error {
+	if s.fail {
+		return errors.New("revert failed")
+	}
+	return s.BallanceStorage.RevertTo(height)
+}
+
+func TestForkReorganization_RevertFails(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	minerB := "2222222222222222222222222222222222222222"
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	storage := &failingRevertStorage{BallanceStorage: ballance_storage.NewMemoryStorage()}
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage.BallanceStorage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	genesis := bc.GetTip()
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": recipient,
+	})
+	tx.AddSing(bc.signer, signature)
+	bc.AddTransactionToPool(tx)
+	a1, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	b1 := mineSideBlock(t, bc, genesis, minerB)
+	if err := bc.AddBlock(b1); err != nil {
+		t.Fatalf("AddBlock(b1) failed: %v", err)
+	}
+
+	// the heavier branch can not replace a main chain whose state does not revert
+	storage.fail = true
+	b2 := mineSideBlock(t, bc, b1, minerB)
+	if err := bc.AddBlock(b2); !errors.Is(err, ErrStateRestore) {
+		t.Fatalf("AddBlock(b2) error = %v, want %v", err, ErrStateRestore)
+	}
+	if bc.GetTip().Hash != a1.Hash || len(bc.blocks) != 2 {
+		t.Errorf("tip = %x, want %x", bc.GetTip().Hash, a1.Hash)
+	}
+	recipientKey, _ := hex.DecodeString(recipient)
+	if storage.GetBallance(string(recipientKey)) != 10 {
+		t.Errorf("recipient ballance = %d, want 10", storage.GetBallance(string(recipientKey)))
+	}
+	if err := bc.InvalidateBlock(a1.Hash); !errors.Is(err, ErrStateRestore) {
+		t.Errorf("InvalidateBlock error = %v, want %v", err, ErrStateRestore)
+	}
+	if bc.GetTip().Hash != a1.Hash {
+		t.Errorf("tip changed by a failed invalidation")
+	}
+}
+
+// failingConfirmStorage fails the next Confirm once fail is set.
+type failingConfirmStorage struct {
+	ballance_storage.BallanceStorage
+	fail bool
+}
+
+func (s *failingConfirmStorage) Confirm() error {
+	if s.fail {
+		s.fail = false
+		return errors.New("confirm failed")
+	}
+	return s.BallanceStorage.Confirm()
+}
+
+func TestConnectBlock_ConfirmFails(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	minerB := "2222222222222222222222222222222222222222"
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	storage := &failingConfirmStorage{BallanceStorage: ballance_storage.NewMemoryStorage()}
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage.BallanceStorage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	genesis := bc.GetTip()
+	creatorBallance := storage.GetBallance(string(creator))
+
+	// a block whose state can not be confirmed is not connected
+	storage.fail = true
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": recipient,
+	})
+	tx.AddSing(bc.signer, signature)
+	bc.AddTransactionToPool(tx)
+	if _, err := bc.MineBlockFromPool(creator); !errors.Is(err, ErrStateRestore) {
+		t.Fatalf("MineBlockFromPool error = %v, want %v", err, ErrStateRestore)
+	}
+	if bc.GetTip().Hash != genesis.Hash || len(bc.blocks) != 1 {
+		t.Errorf("tip = %x, want %x", bc.GetTip().Hash, genesis.Hash)
+	}
+	recipientKey, _ := hex.DecodeString(recipient)
+	if storage.GetBallance(string(recipientKey)) != 0 || storage.GetBallance(string(creator)) != creatorBallance {
+		t.Errorf("ballances changed by a block that was not connected")
+	}
+
+	a1, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if storage.GetBallance(string(recipientKey)) != 10 {
+		t.Errorf("recipient ballance = %d, want 10", storage.GetBallance(string(recipientKey)))
+	}
+
+	// a reorganization that can not confirm the branch restores the main chain and
+	// keeps the branch
+	b1 := mineSideBlock(t, bc, genesis, minerB)
+	if err := bc.AddBlock(b1); err != nil {
+		t.Fatalf("AddBlock(b1) failed: %v", err)
+	}
+	storage.fail = true
+	b2 := mineSideBlock(t, bc, b1, minerB)
+	if err := bc.AddBlock(b2); !errors.Is(err, ErrStateRestore) {
+		t.Fatalf("AddBlock(b2) error = %v, want %v", err, ErrStateRestore)
+	}
+	if bc.GetTip().Hash != a1.Hash || len(bc.blocks) != 2 {
+		t.Errorf("tip = %x, want %x", bc.GetTip().Hash, a1.Hash)
+	}
+	if storage.GetBallance(string(recipientKey)) != 10 {
+		t.Errorf("recipient ballance = %d, want 10", storage.GetBallance(string(recipientKey)))
+	}
+	if bc.tree[b1.Hash] == nil || bc.tree[b2.Hash] == nil {
+		t.Errorf("branch dropped after a confirm failure")
+	}
+}
+
+func TestAddBlock_UnknownParent(t *testing.T) {
+	creator := randomAddress()
+	storage := ballance_storage.NewMemoryStorage()
+	bc, _ := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	orphan, _ := block.NewBlock(bc.GetTip(), bc.CurrentDifficulty)
+	orphan.Prev = [32]byte{1}
+	coinbase, _ := bc.createBaseTx(creator, orphan.Index, 0)
+	orphan.AddTransaction(&coinbase)
+	orphan.Mine(0)
+	if err := bc.AddBlock(orphan); err == nil {
+		t.Error("Expected error for block with unknown parent")
+	}
+}
+
+func TestInvalidateBlock(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	genesis := bc.GetTip()
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 1, map[string]any{
+		"recipient": recipient,
+	})
+	tx.AddSing(bc.signer, signature)
+	bc.AddTransactionToPool(tx)
+	b2, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	side := mineSideBlock(t, bc, genesis, recipient)
+	if err := bc.AddBlock(side); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+
+	if err := bc.InvalidateBlock(genesis.Hash); err == nil {
+		t.Errorf("expected error for genesis invalidation")
+	}
+	if err := bc.InvalidateBlock(b2.Hash); err != nil {
+		t.Fatalf("InvalidateBlock failed: %v", err)
+	}
+	if bc.GetTip().Hash != side.Hash {
+		t.Errorf("tip = %x, want remaining side branch %x", bc.GetTip().Hash, side.Hash)
+	}
+	if storage.Height() != 2 {
+		t.Errorf("storage height = %d, want 2", storage.Height())
+	}
+	recipientKey, _ := hex.DecodeString(recipient)
+	creatorKey, _ := hex.DecodeString(creator)
+	if storage.GetBallance(string(recipientKey)) != 50 {
+		t.Errorf("recipient ballance = %d, want 50", storage.GetBallance(string(recipientKey)))
+	}
+	if storage.GetBallance(string(creatorKey)) != 50 {
+		t.Errorf("creator ballance = %d, want 50", storage.GetBallance(string(creatorKey)))
+	}
+	if bc.mempool.Count() != 1 {
+		t.Errorf("transaction of invalidated block was not returned to the pool")
+	}
+	if err := bc.AddBlock(b2); err == nil {
+		t.Errorf("expected error when adding invalidated block again")
+	}
+}
+
+func TestInvalidateBlock_Reopen(t *testing.T) {
+	_, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	recipient := "ffeeddccbbaa99887766554433221100ffeeddcc"
+	path := filepath.Join(t.TempDir(), "blocks.dat")
+	open := func() (*Blockchain, block_store.BlockStore, ballance_storage.BallanceStorage) {
+		store, err := block_store.NewFileStore(path)
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		storage := ballance_storage.NewMemoryStorage()
+		bc, err := NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+		if err != nil {
+			t.Fatalf("NewBlockchainWithStore failed: %v", err)
+		}
+		return bc, store, storage
+	}
+
+	bc, store, _ := open()
+	genesis := bc.GetTip()
+	b2, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	b3, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	side := mineSideBlock(t, bc, genesis, recipient)
+	if err := bc.AddBlock(side); err != nil {
+		t.Fatalf("AddBlock failed: %v", err)
+	}
+	if err := bc.InvalidateBlock(b2.Hash); err != nil {
+		t.Fatalf("InvalidateBlock failed: %v", err)
+	}
+	store.Close()
+
+	// the invalidated branch has more work, but stays invalid after a restart
+	bc, store, storage := open()
+	defer store.Close()
+	if bc.GetTip().Hash != side.Hash {
+		t.Errorf("tip = %x, want %x", bc.GetTip().Hash, side.Hash)
+	}
+	if bc.tree[b2.Hash] != nil || bc.tree[b3.Hash] != nil {
+		t.Errorf("invalidated blocks were loaded")
+	}
+	recipientKey, _ := hex.DecodeString(recipient)
+	if storage.GetBallance(string(recipientKey)) != 50 {
+		t.Errorf("recipient ballance = %d, want 50", storage.GetBallance(string(recipientKey)))
+	}
+	if err := bc.AddBlock(b2); err == nil {
+		t.Errorf("expected error when adding invalidated block again")
+	}
+}
+
+func TestReopenWithPersistentStorage(t *testing.T) {
+	creator := "1111111111111111111111111111111111111111"
+	dir := t.TempDir()
+	open := func() (*Blockchain, block_store.BlockStore, *ballance_storage.BallanceStorageFile) {
+		store, err := block_store.NewFileStore(filepath.Join(dir, "blocks.dat"))
+		if err != nil {
+			t.Fatalf("NewFileStore failed: %v", err)
+		}
+		storage, err := ballance_storage.NewFileStorage(filepath.Join(dir, "state"))
+		if err != nil {
+			t.Fatalf("NewFileStorage failed: %v", err)
+		}
+		bc, err := NewBlockchainWithStore(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, store, transactionTypes(storage))
+		if err != nil {
+			t.Fatalf("NewBlockchainWithStore failed: %v", err)
+		}
+		return bc, store, storage
+	}
+
+	bc, store, storage := open()
+	bc.MineBlockFromPool(creator)
+	store.Close()
+	storage.Close()
+
+	_, store, storage = open()
+	defer store.Close()
+	defer storage.Close()
+	creatorKey, _ := hex.DecodeString(creator)
+	if storage.GetBallance(string(creatorKey)) != 100 {
+		t.Errorf("creator ballance = %d, want 100 after reopen", storage.GetBallance(string(creatorKey)))
+	}
+	if storage.Height() != 2 {
+		t.Errorf("storage height = %d, want 2", storage.Height())
+	}
+}
+
+func TestDifficultyRetarget(t *testing.T) {
+	creator := randomAddress()
+	storage := ballance_storage.NewMemoryStorage()
+	retarget, err := difficulty.NewInterval(2, time.Hour, 4, 10)
+	if err != nil {
+		t.Fatalf("NewInterval failed: %v", err)
+	}
+	bc, err := NewBlockchain(50, 4, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage), WithRetarget(retarget))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		if _, err := bc.MineBlockFromPool(creator); err != nil {
+			t.Fatalf("MineBlockFromPool failed: %v", err)
+		}
+	}
+	// blocks come much faster than one per hour, so every retarget adds 2 bits
+	want := []uint64{4, 4, 4, 4, 6}
+	for i, blk := range bc.blocks {
+		if blk.Difficulty != want[i] {
+			t.Errorf("block %d difficulty = %d, want %d", blk.Index, blk.Difficulty, want[i])
+		}
+	}
+	if bc.CurrentDifficulty != 6 {
+		t.Errorf("CurrentDifficulty = %d, want 6", bc.CurrentDifficulty)
+	}
+
+	wrong := mineSideBlock(t, bc, bc.GetTip(), creator)
+	wrong.Difficulty = 8
+	wrong.Mine(0)
+	if err := bc.AddBlock(wrong); err == nil {
+		t.Errorf("expected error for block with unexpected difficulty")
+	}
+}
+
+func TestRewardSchedule(t *testing.T) {
+	creator := randomAddress()
+	creatorKey, _ := hex.DecodeString(creator)
+	storage := ballance_storage.NewMemoryStorage()
+	schedule := rewards.NewSchedule(100, 2, 10, 0)
+	bc, err := NewBlockchain(100, 4, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage), WithRewardSchedule(schedule))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := bc.MineBlockFromPool(creator); err != nil {
+			t.Fatalf("MineBlockFromPool failed: %v", err)
+		}
+	}
+	if storage.GetBallance(string(creatorKey)) != 300 {
+		t.Errorf("creator ballance = %d, want 300", storage.GetBallance(string(creatorKey)))
+	}
+	if bc.IssuedSupply(4) != 300 {
+		t.Errorf("IssuedSupply(4) = %d, want 300", bc.IssuedSupply(4))
+	}
+	if bc.CurrentRewards != 25 {
+		t.Errorf("CurrentRewards = %d, want 25", bc.CurrentRewards)
+	}
+
+	greedy, _ := block.NewBlock(bc.GetTip(), bc.CurrentDifficulty)
+	coinbase, _ := bc.createBaseTx(creator, greedy.Index, 1)
+	greedy.AddTransaction(&coinbase)
+	greedy.Mine(0)
+	if err := bc.AddBlock(greedy); err == nil {
+		t.Errorf("expected error for block minting more than the scheduled reward")
+	}
+}
+
+// findNonce mines the block keeping its merkle root as it is.
+func findNonce(b *block.Block, meets bool) {
+	for nonce := uint64(0); ; nonce++ {
+		hash, _ := b.CalcHash(nonce)
+		b.Nonce = nonce
+		b.Hash = [32]byte(hash)
+		if b.MeetsTarget() == meets {
+			return
+		}
+	}
+}
+
+func TestValidateBlock(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	transfer := func(sign bool) transaction.Transaction {
+		tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 1, 1, map[string]any{
+			"recipient": randomAddress(),
+		})
+		if sign {
+			tx.AddSing(bc.signer, signature)
+		}
+		return tx
+	}
+	coinbase := func(fee int64) transaction.Transaction {
+		tx, err := bc.createBaseTx(creator, 2, fee)
+		if err != nil {
+			t.Fatalf("createBaseTx failed: %v", err)
+		}
+		return tx
+	}
+
+	tests := []struct {
+		name   string
+		modify func(b *block.Block)
+		want   error
+	}{
+		{"valid", func(b *block.Block) {}, nil},
+		{"bad hash", func(b *block.Block) { b.Hash[31] ^= 1 }, ErrBadHash},
+		{"high hash", func(b *block.Block) { findNonce(b, false) }, ErrHighHash},
+		{"unknown parent", func(b *block.Block) { b.Prev = [32]byte{1}; b.Mine(0) }, ErrUnknownParent},
+		{"bad index", func(b *block.Block) { b.Index = 5; b.Mine(0) }, ErrBadIndex},
+		{"bad difficulty", func(b *block.Block) { b.Difficulty = 9; b.Mine(0) }, ErrBadDifficulty},
+		{"time too old", func(b *block.Block) { b.Time = bc.GetTip().Time; b.Mine(0) }, ErrTimeTooOld},
+		{"time too new", func(b *block.Block) { b.Time = time.Now().Add(3 * time.Hour).UnixNano(); b.Mine(0) }, ErrTimeTooNew},
+		{"no coinbase", func(b *block.Block) {
+			b.Transactions = []transaction.Transaction{transfer(true)}
+			b.Mine(0)
+		}, ErrNoCoinbase},
+		{"extra coinbase", func(b *block.Block) {
+			b.Transactions = append(b.Transactions, coinbase(0))
+			b.Mine(0)
+		}, ErrExtraCoinbase},
+		{"unsigned transaction", func(b *block.Block) {
+			b.Transactions = []transaction.Transaction{coinbase(1), transfer(false)}
+			b.Mine(0)
+		}, ErrBadTransaction},
+		{"bad merkle root", func(b *block.Block) { b.MerkleRoot = [32]byte{1}; findNonce(b, true) }, ErrBadMerkleRoot},
+		{"greedy coinbase", func(b *block.Block) {
+			b.Transactions = []transaction.Transaction{coinbase(1)}
+			b.Mine(0)
+		}, ErrBadCoinbaseValue},
+		{"fees not claimed", func(b *block.Block) {
+			b.Transactions = []transaction.Transaction{coinbase(0), transfer(true)}
+			b.Mine(0)
+		}, ErrBadCoinbaseValue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := mineSideBlock(t, bc, bc.GetTip(), creator)
+			tt.modify(b)
+			err := bc.ValidateBlock(b)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("ValidateBlock() = %v, want %v", err, tt.want)
+			}
+			var validationErr *BlockValidationError
+			if err != nil && (!errors.As(err, &validationErr) || validationErr.Hash != b.Hash) {
+				t.Errorf("error %v is not a BlockValidationError for the block", err)
+			}
+		})
+	}
+
+	if err := bc.AddBlock(mineSideBlock(t, bc, bc.GetTip(), creator)); err != nil {
+		t.Fatalf("AddBlock of valid block failed: %v", err)
+	}
+	bad := mineSideBlock(t, bc, bc.GetTip(), creator)
+	bad.Time = time.Now().Add(3 * time.Hour).UnixNano()
+	bad.Mine(0)
+	if err := bc.AddBlock(bad); !errors.Is(err, ErrTimeTooNew) {
+		t.Errorf("AddBlock() = %v, want %v", err, ErrTimeTooNew)
+	}
+}
+
+func TestMineBlockFromPoolContext_Cancel(t *testing.T) {
+	creator := randomAddress()
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 4, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bc.MineBlockFromPoolContext(ctx, creator, block.MineOptions{NonceSpace: 1}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("MineBlockFromPoolContext() error = %v, want context canceled", err)
+	}
+	if len(bc.blocks) != 1 {
+		t.Errorf("blocks = %d after cancelled mining, want 1", len(bc.blocks))
+	}
+	if _, err := bc.MineBlockFromPoolContext(context.Background(), creator, block.MineOptions{Threads: 1}); err != nil {
+		t.Fatalf("MineBlockFromPoolContext failed: %v", err)
+	}
+}
+
+// solveTemplate mines the template the way an external miner does, from its fields only.
+func solveTemplate(tmpl *BlockTemplate) uint64 {
+	for nonce := uint64(0); ; nonce++ {
+		hash, _ := utils.GetHash(tmpl.Index, tmpl.Time, []byte(tmpl.Prev), nonce, []byte(tmpl.MerkleRoot))
+		if bytes.Compare(hash, tmpl.Target) <= 0 {
+			return nonce
+		}
+	}
+}
+
+// uniqueAddress returns a random address, for tests that need several distinct
+// accounts.
+func uniqueAddress() string {
+	address := make([]byte, 20)
+	rand.Read(address)
+	return hex.EncodeToString(address)
+}
+
+func TestBlockTemplate(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 10, 2, map[string]any{
+		"recipient": uniqueAddress(),
+	})
+	tx.AddSing(bc.signer, signature)
+	if err := bc.AddTransactionToPool(tx); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+
+	miner := uniqueAddress()
+	tmpl, err := bc.GetBlockTemplate(miner)
+	if err != nil {
+		t.Fatalf("GetBlockTemplate failed: %v", err)
+	}
+	stale, _ := bc.GetBlockTemplate(miner)
+	if tmpl.Index != 2 || tmpl.Transactions != 2 || tmpl.Difficulty != 8 {
+		t.Errorf("unexpected template %+v", tmpl)
+	}
+	if hex.EncodeToString(tmpl.Target) != "00"+strings.Repeat("ff", 31) {
+		t.Errorf("Target = %x", tmpl.Target)
+	}
+
+	if _, err := bc.SubmitWork(tmpl.ID+100, 0); !errors.Is(err, ErrUnknownTemplate) {
+		t.Errorf("SubmitWork(unknown) error = %v, want %v", err, ErrUnknownTemplate)
+	}
+	bad := uint64(0)
+	for ; ; bad++ {
+		hash, _ := utils.GetHash(tmpl.Index, tmpl.Time, []byte(tmpl.Prev), bad, []byte(tmpl.MerkleRoot))
+		if hash[0] != 0 {
+			break
+		}
+	}
+	if _, err := bc.SubmitWork(tmpl.ID, bad); !errors.Is(err, ErrHighHash) {
+		t.Errorf("SubmitWork(bad nonce) error = %v, want %v", err, ErrHighHash)
+	}
+
+	blk, err := bc.SubmitWork(tmpl.ID, solveTemplate(tmpl))
+	if err != nil {
+		t.Fatalf("SubmitWork failed: %v", err)
+	}
+	if bc.GetTip().Hash != blk.Hash || bc.mempool.Count() != 0 {
+		t.Errorf("submitted block is not the tip or pool was not cleared")
+	}
+	minerKey, _ := hex.DecodeString(miner)
+	if storage.GetBallance(string(minerKey)) != 52 {
+		t.Errorf("miner ballance = %d, want 52", storage.GetBallance(string(minerKey)))
+	}
+	if _, err := bc.SubmitWork(stale.ID, solveTemplate(stale)); !errors.Is(err, ErrStaleTemplate) {
+		t.Errorf("SubmitWork(stale) error = %v, want %v", err, ErrStaleTemplate)
+	}
+}
+
+func TestTransactionNonce(t *testing.T) {
+	signature, creator := testAccount(t, sign_ed25519.Ed25519Signer{})
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, sign_ed25519.Ed25519Signer{}, storage, transactionTypes(storage))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	transfer := func(nonce int) transaction.Transaction {
+		tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 1, 1, map[string]any{
+			"recipient": uniqueAddress(),
+			"nonce":     nonce,
+		})
+		tx.AddSing(bc.signer, signature)
+		return tx
+	}
+
+	first := transfer(0)
+	if err := bc.AddTransactionToPool(transfer(1)); !errors.Is(err, ErrNonceTooHigh) {
+		t.Errorf("AddTransactionToPool(gap) error = %v, want %v", err, ErrNonceTooHigh)
+	}
+	if err := bc.AddTransactionToPool(first); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+	if err := bc.AddTransactionToPool(first); !errors.Is(err, mempool.ErrAlreadyExists) {
+		t.Errorf("AddTransactionToPool(duplicate) error = %v, want %v", err, mempool.ErrAlreadyExists)
+	}
+	if err := bc.AddTransactionToPool(transfer(0)); !errors.Is(err, ErrNonceTooLow) {
+		t.Errorf("AddTransactionToPool(same nonce) error = %v, want %v", err, ErrNonceTooLow)
+	}
+	if err := bc.AddTransactionToPool(transfer(1)); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	if storage.GetNonce(string(creatorKey)) != 2 {
+		t.Errorf("nonce = %d, want 2", storage.GetNonce(string(creatorKey)))
+	}
+
+	if err := bc.AddTransactionToPool(first); !errors.Is(err, ErrNonceTooLow) {
+		t.Errorf("AddTransactionToPool(replay) error = %v, want %v", err, ErrNonceTooLow)
+	}
+	replay := mineSideBlock(t, bc, bc.GetTip(), creator)
+	coinbase, _ := bc.createBaseTx(creator, replay.Index, first.GetFee())
+	replay.Transactions = []transaction.Transaction{coinbase, first}
+	replay.Mine(0)
+	if err := bc.AddBlock(replay); err == nil {
+		t.Errorf("expected error for block replaying a transaction")
+	}
+	if storage.GetNonce(string(creatorKey)) != 2 {
+		t.Errorf("nonce = %d after rejected block, want 2", storage.GetNonce(string(creatorKey)))
+	}
+}
+
+func TestMaxBlockSize(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, transactionTypes(storage), WithMaxBlockSize(2000))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	var txs []transaction.Transaction
+	for i := 0; i < 5; i++ {
+		tx, _ := transaction.CreateTransaction(coin_transfer.CoinTransfer, creator, 1, int64(i+1), map[string]any{
+			"recipient": uniqueAddress(),
+			"nonce":     i,
+		})
+		tx.AddSing(signer, signature)
+		if err := bc.AddTransactionToPool(tx); err != nil {
+			t.Fatalf("AddTransactionToPool failed: %v", err)
+		}
+		txs = append(txs, tx)
+	}
+
+	blk, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	size := 0
+	for _, tx := range blk.Transactions {
+		size += txSize(tx)
+	}
+	if size > 2000 || len(blk.Transactions) < 2 || len(blk.Transactions) > 5 {
+		t.Errorf("block has %d transactions of %d bytes", len(blk.Transactions), size)
+	}
+	if bc.mempool.Count() != 6-len(blk.Transactions) {
+		t.Errorf("mempool has %d transactions, want %d", bc.mempool.Count(), 6-len(blk.Transactions))
+	}
+
+	// ValidateBlock does not look at nonces, so the mined transactions can be reused
+	large := mineSideBlock(t, bc, bc.GetTip(), creator)
+	var fees int64 = 0
+	for _, tx := range txs {
+		large.Transactions = append(large.Transactions, tx)
+		fees += tx.GetFee()
+	}
+	coinbase, _ := bc.createBaseTx(creator, large.Index, fees)
+	large.Transactions[0] = coinbase
+	large.Mine(0)
+	if err := bc.ValidateBlock(large); !errors.Is(err, ErrBlockTooLarge) {
+		t.Errorf("ValidateBlock() = %v, want %v", err, ErrBlockTooLarge)
+	}
+}
+
+func TestTokenTransfer(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[contract_deploy.ContractDeploy] = contract_deploy_processor.NewProcessor(storage, contract_storage.NewMemoryStorage())
+	types[token_transfer.TokenTransfer] = token_transfer_processor.NewProcessor(storage)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types)
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	token := hex.EncodeToString(contract_deploy.ContractAddress(creatorKey, 0))
+	recipient := uniqueAddress()
+	transfer := func(value int64, nonce int) transaction.Transaction {
+		tx, _ := transaction.CreateTransaction(token_transfer.TokenTransfer, creator, value, 2, map[string]any{
+			"recipient": recipient,
+			"token":     token,
+			"nonce":     nonce,
+		})
+		tx.AddSing(signer, signature)
+		return tx
+	}
+
+	if err := bc.AddTransactionToPool(transfer(10, 0)); err == nil {
+		t.Errorf("expected error for a transfer of an unknown token")
+	}
+	deploy, _ := transaction.CreateTransaction(contract_deploy.ContractDeploy, creator, 0, 3, map[string]any{
+		"code":            "00",
+		"owner":           creator,
+		"initialSupplay":  100,
+	})
+	deploy.AddSing(signer, signature)
+	if err := bc.AddTransactionToPool(deploy); err != nil {
+		t.Fatalf("AddTransactionToPool(deploy) failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	if err := bc.AddTransactionToPool(transfer(101, 1)); err == nil {
+		t.Errorf("expected error for a transfer above the token balance")
+	}
+	if err := bc.AddTransactionToPool(transfer(40, 1)); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+	// the miner collects the fees, so the coin balance is checked on a third party
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	tokenKey, _ := hex.DecodeString(token)
+	recipientKey, _ := hex.DecodeString(recipient)
+	if bc.GetTokenBallance(tokenKey, creatorKey) != 60 || bc.GetTokenBallance(tokenKey, recipientKey) != 40 {
+		t.Errorf("token balances = %d/%d, want 60/40", bc.GetTokenBallance(tokenKey, creatorKey), bc.GetTokenBallance(tokenKey, recipientKey))
+	}
+	if bc.GetTokenSupply(tokenKey) != 100 {
+		t.Errorf("token supply = %d, want 100", bc.GetTokenSupply(tokenKey))
+	}
+	if storage.GetBallance(string(recipientKey)) != 0 {
+		t.Errorf("recipient coin balance = %d, want 0", storage.GetBallance(string(recipientKey)))
+	}
+	if storage.GetBallance(string(creatorKey)) != 50+50+3-3-2 {
+		t.Errorf("creator coin balance = %d, want %d", storage.GetBallance(string(creatorKey)), 50+50+3-3-2)
+	}
+}
+
+func TestContractCall(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[contract_deploy.ContractDeploy] = contract_deploy_processor.NewProcessor(storage, contracts)
+	types[contract_call.ContractCall] = contract_call_processor.NewProcessor(storage, contracts, signer)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithContractStorage(contracts))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	// the contract keeps the coins sent to it and pays the amount param to the caller
+	code, err := script_vm.New(signer).ParseString("OP_CALLER\nOP_1\nOP_ARG\nOP_TRANSFER\nOP_1")
+	if err != nil {
+		t.Fatalf("ParseString failed: %v", err)
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	contract := hex.EncodeToString(contract_deploy.ContractAddress(creatorKey, 0))
+	deploy, _ := transaction.CreateTransaction(contract_deploy.ContractDeploy, creator, 0, 1, map[string]any{
+		"code":            hex.EncodeToString(code),
+		"owner":           creator,
+		"initialSupplay":  0,
+	})
+	deploy.AddSing(signer, signature)
+	if err := bc.AddTransactionToPool(deploy); err != nil {
+		t.Fatalf("AddTransactionToPool(deploy) failed: %v", err)
+	}
+	call := func(value int64, amount int, nonce int) transaction.Transaction {
+		tx, _ := transaction.CreateTransaction(contract_call.ContractCall, creator, value, 2, map[string]any{
+			"contractAddress": contract,
+			"method":          "withdraw",
+			"to":              creator,
+			"amount":          amount,
+			"nonce":           nonce,
+		})
+		tx.AddSing(signer, signature)
+		return tx
+	}
+	if err := bc.AddTransactionToPool(call(0, 0, 1)); err == nil {
+		t.Errorf("expected error for a call of a contract that is not deployed yet")
+	}
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	contractKey, _ := hex.DecodeString(contract)
+	if !bytes.Equal(contracts.GetCode(string(contractKey)), code) {
+		t.Fatalf("contract code was not stored")
+	}
+
+	if err := bc.AddTransactionToPool(call(30, 0, 1)); err != nil {
+		t.Fatalf("AddTransactionToPool(deposit) failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if err := bc.AddTransactionToPool(call(0, 31, 2)); err == nil {
+		t.Errorf("expected error for a call failing against the current state")
+	}
+
+	// both withdrawals pass the pool, the second one fails in the block after the first
+	before := storage.GetBallance(string(creatorKey))
+	for nonce := 2; nonce <= 3; nonce++ {
+		if err := bc.AddTransactionToPool(call(0, 20, nonce)); err != nil {
+			t.Fatalf("AddTransactionToPool(withdraw) failed: %v", err)
+		}
+	}
+	reward := bc.CurrentRewards
+	blk, err := bc.MineBlockFromPool(uniqueAddress())
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if storage.GetBallance(string(contractKey)) != 10 {
+		t.Errorf("contract balance = %d, want 10", storage.GetBallance(string(contractKey)))
+	}
+	// a call uses less than the 1000 gas of one coin, the rest of its fee of 2 is refunded
+	if got := storage.GetBallance(string(creatorKey)); got != before+20-1-1 {
+		t.Errorf("caller balance = %d, want %d", got, before+20-1-1)
+	}
+	if got := blk.Transactions[0].GetValue(); got != int64(reward)+1+1 {
+		t.Errorf("coinbase value = %d, want %d", got, int64(reward)+1+1)
+	}
+	if storage.GetNonce(string(creatorKey)) != 4 {
+		t.Errorf("nonce = %d, want 4", storage.GetNonce(string(creatorKey)))
+	}
+}
+
+func TestContractCall_Reverted(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[contract_deploy.ContractDeploy] = contract_deploy_processor.NewProcessor(storage, contracts)
+	types[contract_call.ContractCall] = contract_call_processor.NewProcessor(storage, contracts, signer)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithContractStorage(contracts))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	// the contract stores its first extra argument under key 01 and then pays the amount
+	// param to the caller
+	code, _ := script_vm.New(signer).ParseString("OP_1\nOP_2\nOP_ARG\nOP_SSTORE\nOP_CALLER\nOP_1\nOP_ARG\nOP_TRANSFER\nOP_1")
+	creatorKey, _ := hex.DecodeString(creator)
+	contract := hex.EncodeToString(contract_deploy.ContractAddress(creatorKey, 0))
+	deploy, _ := transaction.CreateTransaction(contract_deploy.ContractDeploy, creator, 0, 1, map[string]any{
+		"code":           hex.EncodeToString(code),
+		"owner":          creator,
+		"initialSupplay": 0,
+	})
+	deploy.AddSing(signer, signature)
+	bc.AddTransactionToPool(deploy)
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	call := func(value int64, amount int, arg string, nonce int) transaction.Transaction {
+		tx, _ := transaction.CreateTransaction(contract_call.ContractCall, creator, value, 2, map[string]any{
+			"contractAddress": contract,
+			"method":          "withdraw",
+			"to":              creator,
+			"amount":          amount,
+			"args":            []string{arg},
+			"nonce":           nonce,
+		})
+		tx.AddSing(signer, signature)
+		return tx
+	}
+	if err := bc.AddTransactionToPool(call(30, 0, "01", 1)); err != nil {
+		t.Fatalf("AddTransactionToPool(deposit) failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	// the second withdrawal passes the pool but fails in the block after the first one,
+	// it pays its gas and neither sends its value nor keeps its store. Both calls use less
+	// than the 1000 gas of one coin of their fee of 2.
+	before := storage.GetBallance(string(creatorKey))
+	if err := bc.AddTransactionToPool(call(0, 20, "02", 2)); err != nil {
+		t.Fatalf("AddTransactionToPool(withdraw) failed: %v", err)
+	}
+	if err := bc.AddTransactionToPool(call(5, 20, "03", 3)); err != nil {
+		t.Fatalf("AddTransactionToPool(withdraw) failed: %v", err)
+	}
+	miner := uniqueAddress()
+	reward := bc.CurrentRewards
+	blk, err := bc.MineBlockFromPool(miner)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	if len(blk.Transactions) != 3 {
+		t.Fatalf("block has %d transactions, want 3", len(blk.Transactions))
+	}
+	contractKey, _ := hex.DecodeString(contract)
+	if value := contracts.Get(string(contractKey), []byte{1}); !bytes.Equal(value, []byte{2}) {
+		t.Errorf("contract value = %x, want 02", value)
+	}
+	if storage.GetBallance(string(contractKey)) != 10 {
+		t.Errorf("contract balance = %d, want 10", storage.GetBallance(string(contractKey)))
+	}
+	if got := storage.GetBallance(string(creatorKey)); got != before+20-1-1 {
+		t.Errorf("caller balance = %d, want %d", got, before+20-1-1)
+	}
+	minerKey, _ := hex.DecodeString(miner)
+	if got := storage.GetBallance(string(minerKey)); got != int64(reward)+1+1 {
+		t.Errorf("miner balance = %d, want %d", got, int64(reward)+1+1)
+	}
+	if storage.GetNonce(string(creatorKey)) != 4 {
+		t.Errorf("nonce = %d, want 4", storage.GetNonce(string(creatorKey)))
+	}
+
+	// a coinbase claiming the whole fee instead of the charged gas is rejected
+	tip := bc.GetTip()
+	greedy, _ := block.NewBlock(tip, bc.CurrentDifficulty)
+	coinbase, _ := bc.createBaseTx(miner, greedy.Index, 2)
+	deposit := call(1, 0, "04", 4)
+	greedy.AddTransaction(&coinbase)
+	greedy.AddTransaction(&deposit)
+	greedy.Mine(0)
+	if err := bc.AddBlock(greedy); !errors.Is(err, ErrBadCoinbaseValue) {
+		t.Errorf("AddBlock(greedy coinbase) error = %v, want %v", err, ErrBadCoinbaseValue)
+	}
+	if bc.GetTip().Hash != tip.Hash || storage.GetBallance(string(minerKey)) != int64(reward)+1+1 {
+		t.Errorf("the rejected block changed the chain")
+	}
+}
+
+func TestContractDeployAddress(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	_, creator := testAccount(t, signer)
+	attackerSignature, attacker := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[contract_deploy.ContractDeploy] = contract_deploy_processor.NewProcessor(storage, contracts)
+	types[contract_call.ContractCall] = contract_call_processor.NewProcessor(storage, contracts, signer)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithContractStorage(contracts))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(attacker); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	// the code would pay the amount param of a call out of the funded creator account
+	code, _ := script_vm.New(signer).ParseString("OP_CALLER\nOP_1\nOP_ARG\nOP_TRANSFER\nOP_1")
+	params := map[string]any{
+		"contractAddress": creator,
+		"code":            hex.EncodeToString(code),
+		"owner":           attacker,
+		"initialSupplay":  0,
+	}
+	if _, err := transaction.CreateTransaction(contract_deploy.ContractDeploy, attacker, 0, 1, params); !errors.Is(err, contract_deploy.ErrContractAddress) {
+		t.Errorf("CreateTransaction(deploy) error = %v, want %v", err, contract_deploy.ErrContractAddress)
+	}
+	// a deploy built by hand to the creator address
+	delete(params, "contractAddress")
+	forged, _ := contract_deploy.NewTransaction(attacker, 0, 1, params)
+	forged.ContractAddress, _ = hex.DecodeString(creator)
+	txId, _ := forged.CalcHash()
+	forged.TxId = [32]byte(txId)
+	forged.AddSing(signer, attackerSignature)
+	var deploy transaction.Transaction = forged
+	if err := bc.AddTransactionToPool(deploy); !errors.Is(err, contract_deploy.ErrContractAddress) {
+		t.Errorf("AddTransactionToPool(deploy) error = %v, want %v", err, contract_deploy.ErrContractAddress)
+	}
+	tip := bc.GetTip()
+	blk, _ := block.NewBlock(tip, bc.CurrentDifficulty)
+	coinbase, _ := bc.createBaseTx(attacker, blk.Index, 1)
+	blk.AddTransaction(&coinbase)
+	blk.AddTransaction(&deploy)
+	blk.Mine(0)
+	if err := bc.AddBlock(blk); !errors.Is(err, contract_deploy.ErrContractAddress) {
+		t.Errorf("AddBlock(deploy) error = %v, want %v", err, contract_deploy.ErrContractAddress)
+	}
+
+	withdraw, _ := transaction.CreateTransaction(contract_call.ContractCall, attacker, 0, 1, map[string]any{
+		"contractAddress": creator,
+		"method":          "withdraw",
+		"to":              attacker,
+		"amount":          50,
+		"nonce":           0,
+	})
+	withdraw.AddSing(signer, attackerSignature)
+	if err := bc.AddTransactionToPool(withdraw); err == nil {
+		t.Errorf("expected error for a call of an account without code")
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	if bc.GetTip().Hash != tip.Hash || contracts.GetCode(string(creatorKey)) != nil || storage.GetBallance(string(creatorKey)) != 50 {
+		t.Errorf("the deploy took over the creator account, balance %d", storage.GetBallance(string(creatorKey)))
+	}
+}
+
+func TestContractStateRoot(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	contracts := contract_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[contract_deploy.ContractDeploy] = contract_deploy_processor.NewProcessor(storage, contracts)
+	types[contract_call.ContractCall] = contract_call_processor.NewProcessor(storage, contracts, signer)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithContractStorage(contracts))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	if bc.GetTip().StateRoot != ([32]byte{}) {
+		t.Errorf("genesis state root is not zero")
+	}
+	// the contract stores its first extra argument under key 01
+	code, _ := script_vm.New(signer).ParseString("OP_1\nOP_2\nOP_ARG\nOP_SSTORE\nOP_1")
+	creatorKey, _ := hex.DecodeString(creator)
+	contract := hex.EncodeToString(contract_deploy.ContractAddress(creatorKey, 0))
+	deploy, _ := transaction.CreateTransaction(contract_deploy.ContractDeploy, creator, 0, 1, map[string]any{
+		"code":            hex.EncodeToString(code),
+		"owner":           creator,
+		"initialSupplay":  0,
+	})
+	deploy.AddSing(signer, signature)
+	bc.AddTransactionToPool(deploy)
+	deployed, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	call, _ := transaction.CreateTransaction(contract_call.ContractCall, creator, 0, 1, map[string]any{
+		"contractAddress": contract,
+		"method":          "set",
+		"to":              creator,
+		"amount":          0,
+		"args":            []string{"2a"},
+		"nonce":           1,
+	})
+	call.AddSing(signer, signature)
+	if err := bc.AddTransactionToPool(call); err != nil {
+		t.Fatalf("AddTransactionToPool failed: %v", err)
+	}
+	blk, err := bc.MineBlockFromPool(creator)
+	if err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	contractKey, _ := hex.DecodeString(contract)
+	if !bytes.Equal(contracts.Get(string(contractKey), []byte{1}), []byte{0x2a}) {
+		t.Errorf("contract value = %x, want 2a", contracts.Get(string(contractKey), []byte{1}))
+	}
+	if blk.StateRoot != contracts.Root() || blk.StateRoot == deployed.StateRoot || deployed.StateRoot == ([32]byte{}) {
+		t.Errorf("state roots %x and %x do not follow the contract state", deployed.StateRoot, blk.StateRoot)
+	}
+
+	forged := mineSideBlock(t, bc, bc.GetTip(), creator)
+	forged.StateRoot = [32]byte{1}
+	forged.Mine(0)
+	if err := bc.AddBlock(forged); !errors.Is(err, ErrBadStateRoot) {
+		t.Errorf("AddBlock(forged state root) = %v, want %v", err, ErrBadStateRoot)
+	}
+}
+
+// payToPubKey locks an output to the signature of keys.
+func payToPubKey(keys *sign.SignatureKeys) []byte {
+	script, _ := script_vm.Compile(script_vm.OP_PUSHDATA, keys.PublicKey)
+	return append(script, script_vm.OP_CHECKSIG)
+}
+
+func TestUtxoTransfer(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	owner := generateTestKeys(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	utxos := utxo_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[utxo_transfer.UtxoTransfer] = utxo_transfer_processor.NewProcessor(storage, utxos, signer, script_vm.DefaultFlags)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithUtxoStorage(utxos))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	// spend creates a transaction of the creator spending inputs, each signed by keys
+	// for the output at the same index of spent
+	spend := func(value int64, fee int64, nonce int, inputs []utxo_transfer.Input, outputs []utxo_transfer.Output, keys *sign.SignatureKeys, spent [][]byte) transaction.Transaction {
+		params := map[string]any{"inputs": inputs, "outputs": outputs, "nonce": nonce}
+		unsigned, _ := utxo_transfer.NewTransaction(creator, value, fee, params)
+		for i := range inputs {
+			sig, err := script_vm.SignInput(signer, keys.PrivateKey, unsigned.SigningTx(), i, spent[i], script_vm.SigHashAll)
+			if err != nil {
+				t.Fatalf("SignInput failed: %v", err)
+			}
+			inputs[i].ScriptSig, _ = script_vm.Compile(script_vm.OP_PUSHDATA, sig)
+		}
+		tx, err := transaction.CreateTransaction(utxo_transfer.UtxoTransfer, creator, value, fee, params)
+		if err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+		tx.AddSing(signer, signature)
+		return tx
+	}
+
+	deposit := spend(30, 1, 0, nil, []utxo_transfer.Output{{Value: 30, ScriptPubKey: payToPubKey(owner)}}, nil, nil)
+	if err := bc.AddTransactionToPool(deposit); err == nil {
+		t.Errorf("expected error for outputs above the value")
+	}
+	deposit = spend(30, 1, 0, nil, []utxo_transfer.Output{{Value: 29, ScriptPubKey: payToPubKey(owner)}}, nil, nil)
+	if err := bc.AddTransactionToPool(deposit); err != nil {
+		t.Fatalf("AddTransactionToPool(deposit) failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	creatorKey, _ := hex.DecodeString(creator)
+	if storage.GetBallance(string(creatorKey)) != 20 {
+		t.Errorf("creator balance = %d, want 20", storage.GetBallance(string(creatorKey)))
+	}
+	deposited := transaction.OutPoint{TxId: deposit.GetTxId(), Index: 0}
+	if output := utxos.Get(deposited); output == nil || output.Value != 29 {
+		t.Fatalf("deposited output = %v, want value 29", output)
+	}
+
+	input := func(outpoint transaction.OutPoint, sequence uint32) []utxo_transfer.Input {
+		return []utxo_transfer.Input{{OutPoint: outpoint, Sequence: sequence}}
+	}
+	spent := [][]byte{payToPubKey(owner)}
+	toCreator := []utxo_transfer.Output{{Value: 25, ScriptPubKey: payToPubKey(signature)}}
+	if err := bc.AddTransactionToPool(spend(0, 4, 1, input(deposited, script_vm.SequenceFinal), toCreator, signature, spent)); err == nil {
+		t.Errorf("expected error for a spend signed by another key")
+	}
+	if err := bc.AddTransactionToPool(spend(0, 4, 1, input(deposited, 2), toCreator, owner, spent)); !errors.Is(err, utxo_transfer_processor.ErrRelativeLock) {
+		t.Errorf("AddTransactionToPool(relative lock) error = %v, want %v", err, utxo_transfer_processor.ErrRelativeLock)
+	}
+	first := spend(0, 4, 1, input(deposited, script_vm.SequenceFinal), toCreator, owner, spent)
+	if err := bc.AddTransactionToPool(first); err != nil {
+		t.Fatalf("AddTransactionToPool(spend) failed: %v", err)
+	}
+	second := spend(0, 9, 2, input(deposited, script_vm.SequenceFinal), []utxo_transfer.Output{{Value: 20, ScriptPubKey: payToPubKey(owner)}}, owner, spent)
+	if err := bc.AddTransactionToPool(second); !errors.Is(err, ErrDoubleSpend) {
+		t.Errorf("AddTransactionToPool(double spend) error = %v, want %v", err, ErrDoubleSpend)
+	}
+	if _, err := bc.MineBlockFromPool(uniqueAddress()); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+	received := transaction.OutPoint{TxId: first.GetTxId(), Index: 0}
+	if utxos.Get(deposited) != nil || utxos.Get(received) == nil {
+		t.Fatalf("the spend did not move the output")
+	}
+	if err := bc.AddTransactionToPool(second); !errors.Is(err, utxo_storage.ErrMissingOutput) {
+		t.Errorf("AddTransactionToPool(spent output) error = %v, want %v", err, utxo_storage.ErrMissingOutput)
+	}
+
+	// a block spending the same output twice is rejected as a whole
+	spent = [][]byte{payToPubKey(signature)}
+	tip := bc.GetTip()
+	blk, _ := block.NewBlock(tip, bc.CurrentDifficulty)
+	coinbase, _ := bc.createBaseTx(uniqueAddress(), blk.Index, 2)
+	blk.AddTransaction(&coinbase)
+	for nonce := 2; nonce <= 3; nonce++ {
+		tx := spend(0, 1, nonce, input(received, script_vm.SequenceFinal), []utxo_transfer.Output{{Value: 24, ScriptPubKey: payToPubKey(owner)}}, signature, spent)
+		blk.AddTransaction(&tx)
+	}
+	blk.Mine(0)
+	if err := bc.AddBlock(blk); !errors.Is(err, utxo_storage.ErrMissingOutput) {
+		t.Errorf("AddBlock(double spend) error = %v, want %v", err, utxo_storage.ErrMissingOutput)
+	}
+	if bc.GetTip().Hash != tip.Hash || utxos.Get(received) == nil {
+		t.Errorf("the rejected block changed the chain")
+	}
+}
+
+func TestUtxoTransfer_MalformedMultisig(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	signature, creator := testAccount(t, signer)
+	storage := ballance_storage.NewMemoryStorage()
+	utxos := utxo_storage.NewMemoryStorage()
+	types := transactionTypes(storage)
+	types[utxo_transfer.UtxoTransfer] = utxo_transfer_processor.NewProcessor(storage, utxos, signer, script_vm.DefaultFlags)
+	bc, err := NewBlockchain(50, 8, creator, signer, storage, types, WithUtxoStorage(utxos))
+	if err != nil {
+		t.Fatalf("NewBlockchain failed: %v", err)
+	}
+	create := func(fee int64, nonce int, inputs []utxo_transfer.Input, outputs []utxo_transfer.Output) transaction.Transaction {
+		tx, err := transaction.CreateTransaction(utxo_transfer.UtxoTransfer, creator, 0, fee, map[string]any{"inputs": inputs, "outputs": outputs, "nonce": nonce})
+		if err != nil {
+			t.Fatalf("CreateTransaction failed: %v", err)
+		}
+		tx.AddSing(signer, signature)
+		return tx
+	}
+
+	// OP_CHECKMULTISIG of an empty key count, as a P2SH redeem script and as the output script
+	redeemScript := []byte{script_vm.OP_CHECKMULTISIG}
+	p2sh, _ := script_vm.Compile(script_vm.OP_PUSHDATA, sign.PublicKeyHash(redeemScript))
+	p2sh = append([]byte{script_vm.OP_HASH160}, append(p2sh, script_vm.OP_EQUAL)...)
+	depth, _ := hex.DecodeString("74af519f878fae")
+	deposit, _ := utxo_transfer.NewTransaction(creator, 20, 1, map[string]any{
+		"outputs": []utxo_transfer.Output{{Value: 10, ScriptPubKey: p2sh}, {Value: 9, ScriptPubKey: depth}},
+	})
+	deposit.AddSing(signer, signature)
+	if err := bc.AddTransactionToPool(deposit); err != nil {
+		t.Fatalf("AddTransactionToPool(deposit) failed: %v", err)
+	}
+	if _, err := bc.MineBlockFromPool(creator); err != nil {
+		t.Fatalf("MineBlockFromPool failed: %v", err)
+	}
+
+	spends := []struct {
+		name  string
+		value int64
+		input utxo_transfer.Input
+	}{
+		{"p2sh", 10, utxo_transfer.Input{OutPoint: transaction.OutPoint{TxId: deposit.GetTxId(), Index: 0}, ScriptSig: []byte{0x4c, 0x00, 0x01, script_vm.OP_CHECKMULTISIG}, Sequence: script_vm.SequenceFinal}},
+		{"depth", 9, utxo_transfer.Input{OutPoint: transaction.OutPoint{TxId: deposit.GetTxId(), Index: 1}, ScriptSig: []byte{}, Sequence: script_vm.SequenceFinal}},
+	}
+	for _, spend := range spends {
+		tx := create(1, 1, []utxo_transfer.Input{spend.input}, []utxo_transfer.Output{{Value: spend.value - 1, ScriptPubKey: payToPubKey(signature)}})
+		if err := bc.AddTransactionToPool(tx); !errors.Is(err, stack.ErrEmpty) {
+			t.Errorf("AddTransactionToPool(%s) error = %v, want %v", spend.name, err, stack.ErrEmpty)
+		}
+		tip := bc.GetTip()
+		blk, _ := block.NewBlock(tip, bc.CurrentDifficulty)
+		coinbase, _ := bc.createBaseTx(creator, blk.Index, 1)
+		blk.AddTransaction(&coinbase)
+		blk.AddTransaction(&tx)
+		blk.Mine(0)
+		if err := bc.AddBlock(blk); !errors.Is(err, stack.ErrEmpty) {
+			t.Errorf("AddBlock(%s) error = %v, want %v", spend.name, err, stack.ErrEmpty)
+		}
+		if bc.GetTip().Hash != tip.Hash || utxos.Get(spend.input.OutPoint) == nil {
+			t.Errorf("the %s spend changed the chain", spend.name)
+		}
+	}
+}
+
 func init() {
 	
 }
\ No newline at end of file
@@ -0,0 +1,331 @@
+package blockchain
+
+import (
+	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction/coin_transfer"
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// ErrStateRestore fails a change of the main chain whose state could not be confirmed,
+// reverted or restored. Unlike an invalid branch it is not retried with another branch.
+var ErrStateRestore = errors.New("failed to restore chain state")
+
+// chainNode is a block of the block tree. The ballance storage height of a main chain
+// block equals its index, so disconnecting the tip reverts the storage one height back.
+type chainNode struct {
+	block *block.Block
+	work  *big.Int
+}
+
+// blockWork is the expected number of hashes to find a block with the given
+// number of leading zero bits.
+func blockWork(difficulty uint64) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), uint(difficulty))
+}
+
+func isCoinbase(tx transaction.Transaction) bool {
+	return bytes.Equal(tx.GetSender(), coin_transfer.EmptyAddress[:])
+}
+
+func (blockchain *Blockchain) tipNode() *chainNode {
+	if len(blockchain.blocks) == 0 {
+		return nil
+	}
+	return blockchain.tree[blockchain.blocks[len(blockchain.blocks)-1].Hash]
+}
+
+func (blockchain *Blockchain) isOnMainChain(node *chainNode) bool {
+	var height = int(node.block.Index) - 1
+	return height >= 0 && height < len(blockchain.blocks) && blockchain.blocks[height].Hash == node.block.Hash
+}
+
+// acceptBlockUnsafe validates a block and inserts it into the block tree. A block extending the
+// tip is connected at once, a block of a side branch is only kept until its branch
+// collects more work than the main chain.
+func (blockchain *Blockchain) acceptBlockUnsafe(blk *block.Block, persist bool) error {
+	if _, ok := blockchain.tree[blk.Hash]; ok {
+		return fmt.Errorf("block %x already exists", blk.Hash)
+	}
+	if blockchain.invalid[blk.Hash] || blockchain.invalid[blk.Prev] {
+		return fmt.Errorf("block %x is invalid", blk.Hash)
+	}
+	var err = blockchain.validateBlockUnsafe(blk)
+	if err != nil {
+		return err
+	}
+	var stored = *blk
+	var node = &chainNode{block: &stored, work: blockWork(blk.Difficulty)}
+	var parent = blockchain.tree[blk.Prev]
+	if parent != nil {
+		node.work.Add(node.work, parent.work)
+	}
+
+	var tip = blockchain.tipNode()
+	if tip == nil || tip.block.Hash == blk.Prev {
+		blockchain.tree[blk.Hash] = node
+		err = blockchain.connectBlockUnsafe(node, persist)
+		if err != nil {
+			delete(blockchain.tree, blk.Hash)
+			return err
+		}
+		blockchain.deleteExecutedTxFromPoolUnsafe(node.block)
+		return nil
+	}
+
+	if persist {
+		err = blockchain.store.Append(node.block)
+		if err != nil {
+			return err
+		}
+	}
+	blockchain.tree[blk.Hash] = node
+	if node.work.Cmp(tip.work) > 0 {
+		return blockchain.reorganizeUnsafe(node)
+	}
+	return nil
+}
+
+func (blockchain *Blockchain) connectBlockUnsafe(node *chainNode, persist bool) error {
+	fees, err := blockchain.processTransactionsUnsafe(node.block)
+	if err != nil {
+		return err
+	}
+	var reward = int64(blockchain.schedule.Reward(node.block.Index)) + fees
+	if value := node.block.Transactions[0].GetValue(); value != reward {
+		return blockchain.abortStateUnsafe(invalidBlock(node.block, ErrBadCoinbaseValue, "got %d, expected %d", value, reward))
+	}
+	if root := blockchain.stateRootUnsafe(); root != node.block.StateRoot {
+		return blockchain.abortStateUnsafe(invalidBlock(node.block, ErrBadStateRoot, "%x, want %x", node.block.StateRoot, root))
+	}
+	if persist {
+		err = blockchain.store.Append(node.block)
+		if err != nil {
+			return blockchain.abortStateUnsafe(err)
+		}
+	}
+	if err = blockchain.confirmStateUnsafe(node.block); err != nil {
+		// the chain stays at the parent, a stored block is connected again when the store
+		// is loaded
+		if revertErr := blockchain.revertStateUnsafe(node.block.Index - 1); revertErr != nil {
+			return errors.Join(err, revertErr)
+		}
+		return err
+	}
+	blockchain.blocks = append(blockchain.blocks, *node.block)
+	blockchain.CurrentDifficulty = blockchain.expectedDifficultyUnsafe(node)
+	blockchain.CurrentRewards = blockchain.schedule.Reward(node.block.Index + 1)
+	return nil
+}
+
+// disconnectTipUnsafe removes the tip from the main chain and reverts its state. The
+// chain is left unchanged if the state can not be reverted.
+func (blockchain *Blockchain) disconnectTipUnsafe() (*chainNode, error) {
+	var node = blockchain.tipNode()
+	if err := blockchain.revertStateUnsafe(node.block.Index - 1); err != nil {
+		return nil, fmt.Errorf("%w: disconnecting block %d: %v", ErrStateRestore, node.block.Index, err)
+	}
+	blockchain.blocks = blockchain.blocks[:len(blockchain.blocks)-1]
+	blockchain.CurrentDifficulty = blockchain.expectedDifficultyUnsafe(blockchain.tipNode())
+	blockchain.CurrentRewards = blockchain.schedule.Reward(node.block.Index)
+	return node, nil
+}
+
+// reconnectUnsafe connects the previously disconnected main chain blocks again, the
+// last disconnected block first.
+func (blockchain *Blockchain) reconnectUnsafe(disconnected []*chainNode) error {
+	for j := len(disconnected) - 1; j >= 0; j-- {
+		if err := blockchain.connectBlockUnsafe(disconnected[j], false); err != nil {
+			return fmt.Errorf("%w: reconnecting block %d: %v", ErrStateRestore, disconnected[j].block.Index, err)
+		}
+	}
+	return nil
+}
+
+// expectedDifficultyUnsafe returns the difficulty required for a child of parent,
+// parent is nil for the genesis block.
+func (blockchain *Blockchain) expectedDifficultyUnsafe(parent *chainNode) uint64 {
+	if parent == nil {
+		return blockchain.initialDifficulty
+	}
+	var last = []*block.Block{}
+	for node := parent; node != nil && len(last) < blockchain.retarget.Window(); node = blockchain.tree[node.block.Prev] {
+		last = append([]*block.Block{node.block}, last...)
+	}
+	return blockchain.retarget.NextDifficulty(last)
+}
+
+// reorganizeUnsafe switches the main chain to the branch ending with newTip. If a
+// block of the new branch can not be connected the old main chain is restored and the
+// failed block is dropped together with its descendants. An error wrapping
+// ErrStateRestore means the state could not be confirmed, reverted or restored, the
+// failed block is kept then.
+func (blockchain *Blockchain) reorganizeUnsafe(newTip *chainNode) error {
+	var branch = []*chainNode{}
+	var fork = newTip
+	for !blockchain.isOnMainChain(fork) {
+		branch = append([]*chainNode{fork}, branch...)
+		fork = blockchain.tree[fork.block.Prev]
+	}
+
+	var disconnected = []*chainNode{}
+	for blockchain.tipNode() != fork {
+		node, err := blockchain.disconnectTipUnsafe()
+		if err != nil {
+			if restoreErr := blockchain.reconnectUnsafe(disconnected); restoreErr != nil {
+				return errors.Join(err, restoreErr)
+			}
+			return err
+		}
+		disconnected = append(disconnected, node)
+	}
+
+	for i, node := range branch {
+		var err = blockchain.connectBlockUnsafe(node, false)
+		if err != nil {
+			for j := i - 1; j >= 0; j-- {
+				if _, revertErr := blockchain.disconnectTipUnsafe(); revertErr != nil {
+					return errors.Join(err, revertErr)
+				}
+			}
+			if restoreErr := blockchain.reconnectUnsafe(disconnected); restoreErr != nil {
+				return errors.Join(err, restoreErr)
+			}
+			// a block is invalid only if it failed on a working state
+			if !errors.Is(err, ErrStateRestore) {
+				blockchain.removeSubtreeUnsafe(node.block.Hash)
+			}
+			return fmt.Errorf("reorganization failed at block %d: %w", node.block.Index, err)
+		}
+	}
+
+	var included = make(map[[32]byte]bool)
+	for _, node := range branch {
+		for _, tx := range node.block.Transactions {
+			included[tx.GetTxId()] = true
+		}
+		blockchain.deleteExecutedTxFromPoolUnsafe(node.block)
+	}
+	for _, node := range disconnected {
+		for _, tx := range node.block.Transactions {
+			if isCoinbase(tx) || included[tx.GetTxId()] {
+				continue
+			}
+			blockchain.returnTxToPoolUnsafe(tx)
+		}
+	}
+	return nil
+}
+
+func (blockchain *Blockchain) returnTxToPoolUnsafe(tx transaction.Transaction) {
+	if tx.GetNonce() < blockchain.storage.GetNonce(string(tx.GetSender())) {
+		return
+	}
+	if blockchain.txProcessor.Validate(tx) != nil || blockchain.conflictUnsafe(tx) != nil {
+		return
+	}
+	blockchain.mempool.Add(tx)
+}
+
+// removeSubtreeUnsafe drops the block with its descendants from the tree and remembers
+// them as invalid, so they are rejected if they are received again.
+func (blockchain *Blockchain) removeSubtreeUnsafe(hash [32]byte) {
+	blockchain.invalid[hash] = true
+	delete(blockchain.tree, hash)
+	for found := true; found; {
+		found = false
+		for h, node := range blockchain.tree {
+			if blockchain.invalid[node.block.Prev] {
+				blockchain.invalid[h] = true
+				delete(blockchain.tree, h)
+				found = true
+			}
+		}
+	}
+}
+
+// InvalidateBlock marks the block and all its descendants as invalid. Main chain blocks
+// are disconnected from the tip down to the invalidated one, their transactions return
+// to the pool, and the heaviest remaining branch becomes the main chain. The hash is
+// recorded in the block store, so the blocks stay invalid after a restart.
+func (blockchain *Blockchain) InvalidateBlock(hash [32]byte) error {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+
+	node, ok := blockchain.tree[hash]
+	if !ok {
+		return fmt.Errorf("block %x not found", hash)
+	}
+	if node.block.Index == 1 {
+		return fmt.Errorf("genesis block can not be invalidated")
+	}
+	if blockchain.isOnMainChain(node) {
+		var disconnected = []*chainNode{}
+		for blockchain.tipNode() != blockchain.tree[node.block.Prev] {
+			tip, err := blockchain.disconnectTipUnsafe()
+			if err != nil {
+				if restoreErr := blockchain.reconnectUnsafe(disconnected); restoreErr != nil {
+					return errors.Join(err, restoreErr)
+				}
+				return err
+			}
+			disconnected = append(disconnected, tip)
+		}
+		for _, node := range disconnected {
+			for _, tx := range node.block.Transactions {
+				if !isCoinbase(tx) {
+					blockchain.returnTxToPoolUnsafe(tx)
+				}
+			}
+		}
+	}
+	blockchain.removeSubtreeUnsafe(hash)
+	var err = blockchain.store.Invalidate(hash)
+	return errors.Join(err, blockchain.activateBestChainUnsafe())
+}
+
+// activateBestChainUnsafe reorganizes to the known branch with the most work. Branches
+// that fail to connect are dropped, so the loop ends on a valid branch unless the state
+// can not be restored.
+func (blockchain *Blockchain) activateBestChainUnsafe() error {
+	for {
+		var tip = blockchain.tipNode()
+		var best = tip
+		for _, node := range blockchain.tree {
+			if node.work.Cmp(best.work) > 0 {
+				best = node
+			}
+		}
+		if best == tip {
+			return nil
+		}
+		var err = blockchain.reorganizeUnsafe(best)
+		if err == nil || errors.Is(err, ErrStateRestore) {
+			return err
+		}
+	}
+}
+
+func (blockchain *Blockchain) GetTip() *block.Block {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	if len(blockchain.blocks) == 0 {
+		return nil
+	}
+	var tip = blockchain.blocks[len(blockchain.blocks)-1]
+	return &tip
+}
+
+func (blockchain *Blockchain) GetBlockByHash(hash [32]byte) (*block.Block, error) {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	node, ok := blockchain.tree[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %x not found", hash)
+	}
+	var blk = *node.block
+	return &blk, nil
+}
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/transaction"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// maxTemplates bounds the number of templates waiting for work, the oldest is dropped
+// first.
+const maxTemplates = 64
+
+var (
+	ErrUnknownTemplate = errors.New("block template is unknown")
+	ErrStaleTemplate   = errors.New("block template does not extend the current tip")
+)
+
+// BlockTemplate is the work handed out to an external miner. The block hash is
+// sha256(index | time | prev | nonce | merkle_root | state_root) with the integers big
+// endian, index as 4 bytes, time and nonce as 8 bytes. A zero state root is left out.
+// The work is valid when the hash read as a big endian number is not above Target.
+type BlockTemplate struct {
+	ID           uint64               `json:"template_id"`
+	Index        uint32               `json:"index"`
+	Time         int64                `json:"time"`
+	Prev         transaction.HexBytes `json:"prev"`
+	MerkleRoot   transaction.HexBytes `json:"merkle_root"`
+	StateRoot    transaction.HexBytes `json:"state_root"`
+	Difficulty   uint64               `json:"difficulty"`
+	Target       transaction.HexBytes `json:"target"`
+	Transactions int                  `json:"transactions"`
+}
+
+// target returns the largest hash with difficulty leading zero bits.
+func target(difficulty uint64) []byte {
+	var limit = new(big.Int).Lsh(big.NewInt(1), 256-uint(min(difficulty, 256)))
+	return limit.Sub(limit, big.NewInt(1)).FillBytes(make([]byte, 32))
+}
+
+// GetBlockTemplate assembles a block of the pooled transactions on top of the tip,
+// paying the reward and fees to creator, and keeps it until work for it is submitted
+// or the tip changes.
+func (blockchain *Blockchain) GetBlockTemplate(creator string) (*BlockTemplate, error) {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+
+	var blk, err = blockchain.assembleBlockUnsafe(creator)
+	if err != nil {
+		return nil, err
+	}
+	root, err := blk.CalcMerkleRoot()
+	if err != nil {
+		return nil, err
+	}
+	blk.MerkleRoot = *root
+
+	blockchain.pruneTemplatesUnsafe()
+	blockchain.templateSeq++
+	blockchain.templates[blockchain.templateSeq] = blk
+	if len(blockchain.templates) > maxTemplates {
+		delete(blockchain.templates, blockchain.templateSeq-maxTemplates)
+	}
+
+	return &BlockTemplate{
+		ID:           blockchain.templateSeq,
+		Index:        blk.Index,
+		Time:         blk.Time,
+		Prev:         blk.Prev[:],
+		MerkleRoot:   blk.MerkleRoot[:],
+		StateRoot:    blk.StateRoot[:],
+		Difficulty:   blk.Difficulty,
+		Target:       target(blk.Difficulty),
+		Transactions: len(blk.Transactions),
+	}, nil
+}
+
+// SubmitWork completes the template with nonce and adds the block to the chain.
+func (blockchain *Blockchain) SubmitWork(templateID uint64, nonce uint64) (*block.Block, error) {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+
+	tmpl, ok := blockchain.templates[templateID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownTemplate, templateID)
+	}
+	if tmpl.Prev != blockchain.tipNode().block.Hash {
+		blockchain.pruneTemplatesUnsafe()
+		return nil, fmt.Errorf("%w: %d", ErrStaleTemplate, templateID)
+	}
+	var blk = *tmpl
+	var hash, err = blk.CalcHash(nonce)
+	if err != nil {
+		return nil, err
+	}
+	blk.Nonce = nonce
+	blk.Hash = [32]byte(hash)
+	err = blockchain.addBlockUnsafe(&blk)
+	if err != nil {
+		return nil, err
+	}
+	delete(blockchain.templates, templateID)
+	return &blk, nil
+}
+
+// pruneTemplatesUnsafe drops templates that no longer extend the tip.
+func (blockchain *Blockchain) pruneTemplatesUnsafe() {
+	var tip = blockchain.tipNode()
+	for id, tmpl := range blockchain.templates {
+		if tmpl.Prev != tip.block.Hash {
+			delete(blockchain.templates, id)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package blockchain
+
+import (
+	"blockchain_demo/pkg/block"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction_processor"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// Consensus rules checked by ValidateBlock. Every rejected block returns a
+// *BlockValidationError wrapping exactly one of them, so callers can score the peer
+// that sent the block with errors.Is.
+var (
+	ErrBadHash          = errors.New("block hash does not match block header")
+	ErrHighHash         = errors.New("block hash does not meet difficulty target")
+	ErrUnknownParent    = errors.New("previous block is unknown")
+	ErrBadGenesis       = errors.New("genesis block must not have previous block")
+	ErrBadIndex         = errors.New("block index does not follow previous block")
+	ErrBadDifficulty    = errors.New("block difficulty does not match expected difficulty")
+	ErrTimeTooOld       = errors.New("block time is not after median time of previous blocks")
+	ErrTimeTooNew       = errors.New("block time is too far in the future")
+	ErrNoCoinbase       = errors.New("first transaction is not a coinbase")
+	ErrExtraCoinbase    = errors.New("block has more than one coinbase")
+	ErrBadTransaction   = errors.New("block has invalid transaction")
+	ErrBadMerkleRoot    = errors.New("merkle root is invalid")
+	ErrBadStateRoot     = errors.New("state root does not match the contract state")
+	ErrBadCoinbaseValue = errors.New("coinbase value does not equal reward plus charged fees")
+	ErrBlockTooLarge    = errors.New("block transactions exceed the block size limit")
+)
+
+const (
+	// MedianTimeBlocks is the number of previous blocks whose median time a new
+	// block has to exceed.
+	MedianTimeBlocks = 11
+	// MaxFutureBlockTime is how far ahead of the local clock a block time may be.
+	MaxFutureBlockTime = 2 * time.Hour
+)
+
+type BlockValidationError struct {
+	Rule   error
+	Index  uint32
+	Hash   [32]byte
+	Detail string
+}
+
+func (e *BlockValidationError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("block %d: %s", e.Index, e.Rule.Error())
+	}
+	return fmt.Sprintf("block %d: %s: %s", e.Index, e.Rule.Error(), e.Detail)
+}
+
+func (e *BlockValidationError) Unwrap() error {
+	return e.Rule
+}
+
+func invalidBlock(blk *block.Block, rule error, format string, args ...any) error {
+	return &BlockValidationError{Rule: rule, Index: blk.Index, Hash: blk.Hash, Detail: fmt.Sprintf(format, args...)}
+}
+
+// ValidateBlock checks the block against every consensus rule that does not depend on
+// the ballance state. The previous block may be any known block, not only the tip.
+func (blockchain *Blockchain) ValidateBlock(blk *block.Block) error {
+	blockchain.mu.Lock()
+	defer blockchain.mu.Unlock()
+	return blockchain.validateBlockUnsafe(blk)
+}
+
+func (blockchain *Blockchain) validateBlockUnsafe(blk *block.Block) error {
+	var hash, err = blk.CalcHash(blk.Nonce)
+	if err != nil || [32]byte(hash) != blk.Hash {
+		return invalidBlock(blk, ErrBadHash, "%x", blk.Hash)
+	}
+	if !blk.MeetsTarget() {
+		return invalidBlock(blk, ErrHighHash, "%x needs %d zero bits", blk.Hash, blk.Difficulty)
+	}
+
+	var parent *chainNode = nil
+	if len(blockchain.tree) > 0 {
+		var ok bool
+		parent, ok = blockchain.tree[blk.Prev]
+		if !ok {
+			return invalidBlock(blk, ErrUnknownParent, "%x", blk.Prev)
+		}
+		if blk.Index != parent.block.Index+1 {
+			return invalidBlock(blk, ErrBadIndex, "previous block index is %d", parent.block.Index)
+		}
+	} else if blk.Prev != [32]byte{} || blk.Index != 1 {
+		return invalidBlock(blk, ErrBadGenesis, "")
+	}
+
+	var expected = blockchain.expectedDifficultyUnsafe(parent)
+	if blk.Difficulty != expected {
+		return invalidBlock(blk, ErrBadDifficulty, "got %d, expected %d", blk.Difficulty, expected)
+	}
+
+	if parent != nil {
+		var median = blockchain.medianTimeUnsafe(parent)
+		if blk.Time <= median {
+			return invalidBlock(blk, ErrTimeTooOld, "%d <= %d", blk.Time, median)
+		}
+	}
+	var maxTime = time.Now().Add(MaxFutureBlockTime).UnixNano()
+	if blk.Time > maxTime {
+		return invalidBlock(blk, ErrTimeTooNew, "%d > %d", blk.Time, maxTime)
+	}
+
+	if len(blk.Transactions) == 0 || !isCoinbase(blk.Transactions[0]) {
+		return invalidBlock(blk, ErrNoCoinbase, "")
+	}
+	var fees, minFees int64 = 0, 0
+	var size = 0
+	for i, tx := range blk.Transactions {
+		if i > 0 && isCoinbase(tx) {
+			return invalidBlock(blk, ErrExtraCoinbase, "transaction %d", i)
+		}
+		var err = tx.Verify(blockchain.signer)
+		if err != nil {
+			return invalidBlock(blk, ErrBadTransaction, "transaction %x: %s", tx.GetTxId(), err.Error())
+		}
+		if i > 0 {
+			fees += tx.GetFee()
+			if !transaction_processor.PartialFee(blockchain.txProcessor, tx) {
+				minFees += tx.GetFee()
+			}
+		}
+		size += txSize(tx)
+	}
+	if size > blockchain.maxBlockSize {
+		return invalidBlock(blk, ErrBlockTooLarge, "%d > %d bytes", size, blockchain.maxBlockSize)
+	}
+
+	root, err := blk.CalcMerkleRoot()
+	if err != nil || *root != blk.MerkleRoot {
+		return invalidBlock(blk, ErrBadMerkleRoot, "%x", blk.MerkleRoot)
+	}
+
+	// transactions charging a part of their fee are checked when the block is connected
+	var reward = int64(blockchain.schedule.Reward(blk.Index))
+	if value := blk.Transactions[0].GetValue(); value < reward+minFees || value > reward+fees {
+		return invalidBlock(blk, ErrBadCoinbaseValue, "got %d, expected %d to %d", value, reward+minFees, reward+fees)
+	}
+	return nil
+}
+
+// txSize returns the serialized size of tx, the unit of the block size limit.
+func txSize(tx transaction.Transaction) int {
+	var data, err = tx.Stringify()
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// medianTimeUnsafe returns the median time of the last MedianTimeBlocks blocks ending
+// with parent.
+func (blockchain *Blockchain) medianTimeUnsafe(parent *chainNode) int64 {
+	var times = []int64{}
+	for node := parent; node != nil && len(times) < MedianTimeBlocks; node = blockchain.tree[node.block.Prev] {
+		times = append(times, node.block.Time)
+	}
+	slices.Sort(times)
+	return times[len(times)/2]
+}
@@ -0,0 +1,212 @@
+package contract_storage
+
+import (
+	"blockchain_demo/pkg/merkle"
+	"blockchain_demo/pkg/transaction"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+const (
+	MaxKeySize   = 64
+	MaxValueSize = 520
+)
+
+// ContractStorage keeps the code and the key value state of deployed contracts. Changes
+// of a block are pending until Confirm commits them as the next height, RevertTo rewinds
+// committed heights the same way as ballance_storage.BallanceStorage does, so both are
+// kept in step.
+type ContractStorage interface {
+	GetCode(contract string) []byte
+	SetCode(contract string, code []byte) error
+	// Get returns the value of key in the state of contract, nil when it is not set.
+	Get(contract string, key []byte) []byte
+	// Set changes the value of key, an empty value deletes the key.
+	Set(contract string, key []byte, value []byte) error
+	// Root commits to the whole state including pending changes, the root of an empty
+	// state is the zero hash.
+	Root() transaction.Hash
+	Confirm() error
+	Reject() error
+	Height() uint32
+	RevertTo(height uint32) error
+}
+
+// codeKey is the state key holding the code of contract.
+func codeKey(contract string) string {
+	return "code:" + contract
+}
+
+// dataKey is the state key holding key of contract. The contract length is part of the
+// key, so different contract and key pairs never share a state key.
+func dataKey(contract string, key []byte) string {
+	return "data:" + string(rune(len(contract))) + contract + string(key)
+}
+
+// undoRecord keeps the values replaced at height, nil for keys that did not exist.
+type undoRecord struct {
+	height   uint32
+	previous map[string][]byte
+}
+
+type ContractStorageMemory struct {
+	state   map[string][]byte
+	pending map[string][]byte
+	height  uint32
+	undo    []undoRecord
+	mu      sync.Mutex
+}
+
+func NewMemoryStorage() ContractStorage {
+	var storage = ContractStorageMemory{
+		state:   make(map[string][]byte),
+		pending: make(map[string][]byte),
+	}
+
+	return &storage
+}
+
+func (s *ContractStorageMemory) get(key string) []byte {
+	if value, ok := s.pending[key]; ok {
+		return value
+	}
+	return s.state[key]
+}
+
+func (s *ContractStorageMemory) GetCode(contract string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(codeKey(contract))
+}
+
+// SetCode stores code of a new contract, the code of a deployed contract can not change.
+func (s *ContractStorageMemory) SetCode(contract string, code []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(code) == 0 {
+		return fmt.Errorf("contract %x has no code", contract)
+	}
+	if s.get(codeKey(contract)) != nil {
+		return fmt.Errorf("contract %x is already deployed", contract)
+	}
+	s.pending[codeKey(contract)] = append([]byte{}, code...)
+	return nil
+}
+
+func (s *ContractStorageMemory) Get(contract string, key []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(dataKey(contract, key))
+}
+
+func (s *ContractStorageMemory) Set(contract string, key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(key) == 0 || len(key) > MaxKeySize {
+		return fmt.Errorf("key size %d is out of range 1..%d", len(key), MaxKeySize)
+	}
+	if len(value) > MaxValueSize {
+		return fmt.Errorf("value size %d exceeds %d", len(value), MaxValueSize)
+	}
+	if s.get(codeKey(contract)) == nil {
+		return fmt.Errorf("contract %x is not deployed", contract)
+	}
+	if len(value) == 0 {
+		s.pending[dataKey(contract, key)] = nil
+	} else {
+		s.pending[dataKey(contract, key)] = append([]byte{}, value...)
+	}
+	return nil
+}
+
+// Root is the merkle root of sha256(key size | key | value) of every state key in key
+// order.
+func (s *ContractStorageMemory) Root() transaction.Hash {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys = []string{}
+	for k := range s.state {
+		if _, ok := s.pending[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range s.pending {
+		if v != nil {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return transaction.Hash{}
+	}
+	sort.Strings(keys)
+	var leaves = make([]transaction.Hash, 0, len(keys))
+	for _, k := range keys {
+		var hasher = sha256.New()
+		binary.Write(hasher, binary.BigEndian, uint32(len(k)))
+		hasher.Write([]byte(k))
+		hasher.Write(s.get(k))
+		leaves = append(leaves, transaction.Hash(hasher.Sum(nil)))
+	}
+	var tree, err = merkle.CreateMerkeTree(leaves)
+	if err != nil {
+		return transaction.Hash{}
+	}
+	return tree.Root()
+}
+
+func (s *ContractStorageMemory) Confirm() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var previous = make(map[string][]byte, len(s.pending))
+	for k, v := range s.pending {
+		previous[k] = s.state[k]
+		if v == nil {
+			delete(s.state, k)
+		} else {
+			s.state[k] = v
+		}
+	}
+	s.pending = make(map[string][]byte)
+	s.height++
+	s.undo = append(s.undo, undoRecord{height: s.height, previous: previous})
+	return nil
+}
+
+func (s *ContractStorageMemory) Reject() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = make(map[string][]byte)
+	return nil
+}
+
+func (s *ContractStorageMemory) Height() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.height
+}
+
+// RevertTo drops pending changes and undoes every confirmed height above height.
+func (s *ContractStorageMemory) RevertTo(height uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height > s.height {
+		return fmt.Errorf("can not revert to height %d, current height is %d", height, s.height)
+	}
+	s.pending = make(map[string][]byte)
+	for s.height > height {
+		var record = s.undo[len(s.undo)-1]
+		for k, v := range record.previous {
+			if v == nil {
+				delete(s.state, k)
+			} else {
+				s.state[k] = v
+			}
+		}
+		s.undo = s.undo[:len(s.undo)-1]
+		s.height--
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package contract_storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCode(t *testing.T) {
+	storage := NewMemoryStorage()
+	if err := storage.SetCode("contract", nil); err == nil {
+		t.Errorf("expected error for empty code")
+	}
+	storage.SetCode("contract", []byte{0x51})
+	if !bytes.Equal(storage.GetCode("contract"), []byte{0x51}) {
+		t.Errorf("pending code is not visible")
+	}
+	if err := storage.SetCode("contract", []byte{0x52}); err == nil {
+		t.Errorf("expected error for replacing code")
+	}
+	storage.Reject()
+	if storage.GetCode("contract") != nil {
+		t.Errorf("rejected code is still visible")
+	}
+
+	storage.SetCode("contract", []byte{0x51})
+	storage.Confirm()
+	storage.SetCode("other", []byte{0x52})
+	storage.Confirm()
+	if storage.Height() != 2 || storage.GetCode("other") == nil {
+		t.Fatalf("Expected height 2 with both contracts, got %d", storage.Height())
+	}
+	if err := storage.RevertTo(3); err == nil {
+		t.Errorf("expected error for reverting above the height")
+	}
+	storage.RevertTo(1)
+	if storage.GetCode("other") != nil || !bytes.Equal(storage.GetCode("contract"), []byte{0x51}) {
+		t.Errorf("RevertTo(1) did not undo the second height only")
+	}
+	storage.RevertTo(0)
+	if storage.GetCode("contract") != nil || storage.Height() != 0 {
+		t.Errorf("RevertTo(0) left the contract")
+	}
+}
+
+func TestState(t *testing.T) {
+	storage := NewMemoryStorage()
+	if storage.Root() != ([32]byte{}) {
+		t.Errorf("root of the empty state is not zero")
+	}
+	if err := storage.Set("contract", []byte("key"), []byte("value")); err == nil {
+		t.Errorf("expected error for the state of a contract that is not deployed")
+	}
+	storage.SetCode("contract", []byte{0x51})
+	storage.Confirm()
+	codeRoot := storage.Root()
+	if err := storage.Set("contract", nil, []byte("value")); err == nil {
+		t.Errorf("expected error for an empty key")
+	}
+	if err := storage.Set("contract", []byte("key"), make([]byte, MaxValueSize+1)); err == nil {
+		t.Errorf("expected error for a value above the size limit")
+	}
+
+	storage.Set("contract", []byte("a"), []byte("1"))
+	storage.Set("contract", []byte("b"), []byte("2"))
+	if !bytes.Equal(storage.Get("contract", []byte("a")), []byte("1")) || storage.Get("other", []byte("a")) != nil {
+		t.Errorf("pending value is not visible to its contract only")
+	}
+	pendingRoot := storage.Root()
+	if pendingRoot == codeRoot {
+		t.Errorf("root does not include pending changes")
+	}
+	storage.Reject()
+	if storage.Get("contract", []byte("a")) != nil || storage.Root() != codeRoot {
+		t.Errorf("Reject left pending changes")
+	}
+
+	// the root depends on the state only, not on the order of changes
+	storage.Set("contract", []byte("b"), []byte("2"))
+	storage.Set("contract", []byte("a"), []byte("1"))
+	storage.Confirm()
+	if storage.Root() != pendingRoot {
+		t.Errorf("root changed with the order of changes")
+	}
+	storage.Set("contract", []byte("a"), nil)
+	storage.Confirm()
+	if storage.Get("contract", []byte("a")) != nil || storage.Root() == pendingRoot {
+		t.Errorf("empty value did not delete the key")
+	}
+	storage.RevertTo(2)
+	if !bytes.Equal(storage.Get("contract", []byte("a")), []byte("1")) || storage.Root() != pendingRoot {
+		t.Errorf("RevertTo did not restore the deleted key")
+	}
+}
@@ -0,0 +1,120 @@
+package difficulty
+
+import (
+	"blockchain_demo/pkg/block"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+var ErrInvalidWindow = errors.New("retarget window must be positive")
+
+// Retarget calculates the difficulty (leading zero bits of the block hash) required for
+// the block following last. last holds up to Window latest blocks of the branch, oldest
+// first, and is never empty.
+type Retarget interface {
+	Window() int
+	NextDifficulty(last []*block.Block) uint64
+}
+
+type Fixed struct {
+	difficulty uint64
+}
+
+// NewFixed keeps the same difficulty for every block.
+func NewFixed(difficulty uint64) Retarget {
+	return &Fixed{difficulty: difficulty}
+}
+
+func (r *Fixed) Window() int {
+	return 1
+}
+
+func (r *Fixed) NextDifficulty(last []*block.Block) uint64 {
+	return r.difficulty
+}
+
+type Interval struct {
+	interval  uint32
+	blockTime time.Duration
+	min       uint64
+	max       uint64
+}
+
+// NewInterval retargets once every interval blocks from the time the last interval
+// took, like Bitcoin does. One retarget changes difficulty by at most 2 bits.
+func NewInterval(interval uint32, blockTime time.Duration, min uint64, max uint64) (Retarget, error) {
+	if interval == 0 {
+		return nil, fmt.Errorf("%w: interval %d", ErrInvalidWindow, interval)
+	}
+	return &Interval{interval: interval, blockTime: blockTime, min: min, max: max}, nil
+}
+
+func (r *Interval) Window() int {
+	return int(r.interval) + 1
+}
+
+func (r *Interval) NextDifficulty(last []*block.Block) uint64 {
+	var prev = last[len(last)-1]
+	if prev.Index%r.interval != 0 || len(last) < r.Window() {
+		return prev.Difficulty
+	}
+	var actual = float64(prev.Time - last[0].Time)
+	if actual < 1 {
+		actual = 1
+	}
+	var expected = float64(r.interval) * float64(r.blockTime)
+	var delta = math.Round(math.Log2(expected / actual))
+	delta = math.Max(-2, math.Min(2, delta))
+	return clamp(float64(prev.Difficulty)+delta, r.min, r.max)
+}
+
+type LWMA struct {
+	window    int
+	blockTime time.Duration
+	min       uint64
+	max       uint64
+}
+
+// NewLWMA retargets every block from the linearly weighted moving average of the
+// solve times of the last window blocks, recent blocks weigh more.
+func NewLWMA(window int, blockTime time.Duration, min uint64, max uint64) (Retarget, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("%w: window %d", ErrInvalidWindow, window)
+	}
+	return &LWMA{window: window, blockTime: blockTime, min: min, max: max}, nil
+}
+
+func (r *LWMA) Window() int {
+	return r.window + 1
+}
+
+func (r *LWMA) NextDifficulty(last []*block.Block) uint64 {
+	var prev = last[len(last)-1]
+	if len(last) < 3 {
+		return prev.Difficulty
+	}
+	var target = float64(r.blockTime)
+	var weighted, weights, work float64
+	for i := 1; i < len(last); i++ {
+		var solveTime = float64(last[i].Time - last[i-1].Time)
+		solveTime = math.Max(1, math.Min(6*target, solveTime))
+		weighted += float64(i) * solveTime
+		weights += float64(i)
+		work += math.Exp2(float64(last[i].Difficulty))
+	}
+	work /= float64(len(last) - 1)
+	var next = work * target * weights / weighted
+	return clamp(math.Round(math.Log2(next)), r.min, r.max)
+}
+
+func clamp(difficulty float64, min uint64, max uint64) uint64 {
+	if difficulty < float64(min) {
+		return min
+	}
+	if difficulty > float64(max) {
+		return max
+	}
+	return uint64(difficulty)
+}
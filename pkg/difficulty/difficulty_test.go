@@ -0,0 +1,100 @@
+package difficulty
+
+import (
+	"blockchain_demo/pkg/block"
+	"errors"
+	"testing"
+	"time"
+)
+
+func makeChain(count int, difficulty uint64, solveTime time.Duration) []*block.Block {
+	var blocks = []*block.Block{}
+	var start = time.Now().UnixNano()
+	for i := 0; i < count; i++ {
+		blocks = append(blocks, &block.Block{
+			Index:      uint32(i + 1),
+			Time:       start + int64(i)*int64(solveTime),
+			Difficulty: difficulty,
+		})
+	}
+	return blocks
+}
+
+func TestFixed(t *testing.T) {
+	r := NewFixed(12)
+	if got := r.NextDifficulty(makeChain(1, 8, time.Second)); got != 12 {
+		t.Errorf("NextDifficulty = %d, want 12", got)
+	}
+}
+
+func TestInterval(t *testing.T) {
+	r, err := NewInterval(4, 10*time.Second, 4, 32)
+	if err != nil {
+		t.Fatalf("NewInterval failed: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		count     int
+		solveTime time.Duration
+		want      uint64
+	}{
+		{"not a retarget height", 7, time.Second, 16},
+		{"on target", 8, 10 * time.Second, 16},
+		{"twice too fast", 8, 5 * time.Second, 17},
+		{"twice too slow", 8, 20 * time.Second, 15},
+		{"much too fast is limited", 8, time.Millisecond, 18},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := makeChain(tc.count, 16, tc.solveTime)
+			last := chain
+			if len(last) > r.Window() {
+				last = last[len(last)-r.Window():]
+			}
+			if got := r.NextDifficulty(last); got != tc.want {
+				t.Errorf("NextDifficulty = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLWMA(t *testing.T) {
+	r, err := NewLWMA(10, 10*time.Second, 4, 20)
+	if err != nil {
+		t.Fatalf("NewLWMA failed: %v", err)
+	}
+
+	cases := []struct {
+		name      string
+		solveTime time.Duration
+		want      uint64
+	}{
+		{"on target", 10 * time.Second, 16},
+		{"four times too fast", 2500 * time.Millisecond, 18},
+		{"four times too slow", 40 * time.Second, 14},
+		{"limited by max", time.Millisecond, 20},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := r.NextDifficulty(makeChain(r.Window(), 16, tc.solveTime)); got != tc.want {
+				t.Errorf("NextDifficulty = %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	if got := r.NextDifficulty(makeChain(2, 16, time.Millisecond)); got != 16 {
+		t.Errorf("NextDifficulty with short history = %d, want 16", got)
+	}
+}
+
+func TestInvalidWindow(t *testing.T) {
+	if _, err := NewInterval(0, 10*time.Second, 4, 32); !errors.Is(err, ErrInvalidWindow) {
+		t.Errorf("NewInterval(0) error = %v, want %v", err, ErrInvalidWindow)
+	}
+	for _, window := range []int{0, -1} {
+		if _, err := NewLWMA(window, 10*time.Second, 4, 20); !errors.Is(err, ErrInvalidWindow) {
+			t.Errorf("NewLWMA(%d) error = %v, want %v", window, err, ErrInvalidWindow)
+		}
+	}
+}
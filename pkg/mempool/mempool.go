@@ -0,0 +1,317 @@
+package mempool
+
+import (
+	"blockchain_demo/pkg/transaction"
+	"container/heap"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAlreadyExists = errors.New("transaction is already in the pool")
+	ErrPoolFull      = errors.New("pool is full and transaction fee rate is too low")
+	ErrSenderLimit   = errors.New("sender has too many transactions in the pool")
+	ErrTooLarge      = errors.New("transaction is larger than the pool")
+)
+
+type Config struct {
+	// MaxCount and MaxBytes bound the whole pool, the lowest fee rate transaction is
+	// evicted when a new one does not fit.
+	MaxCount int
+	MaxBytes int
+	// MaxPerSender bounds the number of pooled transactions of one sender.
+	MaxPerSender int
+	// Expiry is how long a transaction may wait in the pool, zero keeps it forever.
+	Expiry time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxCount:     5000,
+		MaxBytes:     5 << 20,
+		MaxPerSender: 64,
+		Expiry:       24 * time.Hour,
+	}
+}
+
+// Mempool keeps transactions waiting for a block. The transactions of a sender are
+// kept in nonce order, since a block can only include them in that order.
+type Mempool interface {
+	Add(tx transaction.Transaction) error
+	Remove(txId [32]byte) bool
+	Contains(txId [32]byte) bool
+	// LastNonce returns the highest pooled nonce of sender.
+	LastNonce(sender []byte) (uint64, bool)
+	Count() int
+	Size() int
+	Transactions() []transaction.Transaction
+	// Expire removes transactions added before now minus Expiry together with the
+	// later transactions of their senders.
+	Expire(now time.Time) []transaction.Transaction
+	// Select picks transactions with the highest fee rate fitting into maxBytes.
+	// nextNonce returns the nonce the first transaction of a sender must have.
+	Select(maxBytes int, nextNonce func(sender []byte) uint64) []transaction.Transaction
+}
+
+type entry struct {
+	tx     transaction.Transaction
+	sender string
+	size   int
+	added  time.Time
+	seq    uint64
+}
+
+// lowerFeeRate reports whether a pays less per byte than b, the later of two equal
+// entries counts as lower.
+func lowerFeeRate(a *entry, b *entry) bool {
+	var left = a.tx.GetFee() * int64(b.size)
+	var right = b.tx.GetFee() * int64(a.size)
+	if left != right {
+		return left < right
+	}
+	return a.seq > b.seq
+}
+
+type MempoolMemory struct {
+	config  Config
+	entries map[[32]byte]*entry
+	senders map[string][]*entry
+	bytes   int
+	seq     uint64
+	mu      sync.Mutex
+}
+
+func NewMempool(config Config) Mempool {
+	var pool = MempoolMemory{
+		config:  config,
+		entries: make(map[[32]byte]*entry),
+		senders: make(map[string][]*entry),
+	}
+
+	return &pool
+}
+
+func (p *MempoolMemory) Add(tx transaction.Transaction) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.entries[tx.GetTxId()]; ok {
+		return ErrAlreadyExists
+	}
+	var data, err = tx.Stringify()
+	if err != nil {
+		return err
+	}
+	if p.config.MaxBytes > 0 && len(data) > p.config.MaxBytes {
+		return ErrTooLarge
+	}
+	var sender = string(tx.GetSender())
+	if p.config.MaxPerSender > 0 && len(p.senders[sender]) >= p.config.MaxPerSender {
+		return fmt.Errorf("%w: %x", ErrSenderLimit, tx.GetSender())
+	}
+
+	p.seq++
+	var added = &entry{tx: tx, sender: sender, size: len(data), added: time.Now(), seq: p.seq}
+	p.insert(added)
+	var evicted = []*entry{}
+	for p.overLimits() {
+		var lowest = p.lowestTail()
+		p.remove(lowest)
+		if lowest == added {
+			// the pool is left as it was before the rejected transaction
+			for _, e := range evicted {
+				p.insert(e)
+			}
+			return ErrPoolFull
+		}
+		evicted = append(evicted, lowest)
+	}
+	return nil
+}
+
+func (p *MempoolMemory) overLimits() bool {
+	return (p.config.MaxCount > 0 && len(p.entries) > p.config.MaxCount) ||
+		(p.config.MaxBytes > 0 && p.bytes > p.config.MaxBytes)
+}
+
+// lowestTail returns the lowest fee rate entry among the last entries of every sender.
+// Only those can be evicted without leaving a nonce gap.
+func (p *MempoolMemory) lowestTail() *entry {
+	var lowest *entry = nil
+	for _, queue := range p.senders {
+		var tail = queue[len(queue)-1]
+		if lowest == nil || lowerFeeRate(tail, lowest) {
+			lowest = tail
+		}
+	}
+	return lowest
+}
+
+func (p *MempoolMemory) insert(e *entry) {
+	var queue = p.senders[e.sender]
+	var i = sort.Search(len(queue), func(i int) bool {
+		return queue[i].tx.GetNonce() > e.tx.GetNonce()
+	})
+	queue = append(queue, nil)
+	copy(queue[i+1:], queue[i:])
+	queue[i] = e
+	p.senders[e.sender] = queue
+	p.entries[e.tx.GetTxId()] = e
+	p.bytes += e.size
+}
+
+func (p *MempoolMemory) remove(e *entry) {
+	var queue = p.senders[e.sender]
+	for i, queued := range queue {
+		if queued == e {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(queue) == 0 {
+		delete(p.senders, e.sender)
+	} else {
+		p.senders[e.sender] = queue
+	}
+	delete(p.entries, e.tx.GetTxId())
+	p.bytes -= e.size
+}
+
+func (p *MempoolMemory) Remove(txId [32]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e, ok := p.entries[txId]
+	if ok {
+		p.remove(e)
+	}
+	return ok
+}
+
+func (p *MempoolMemory) Contains(txId [32]byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, ok := p.entries[txId]
+	return ok
+}
+
+func (p *MempoolMemory) LastNonce(sender []byte) (uint64, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var queue = p.senders[string(sender)]
+	if len(queue) == 0 {
+		return 0, false
+	}
+	return queue[len(queue)-1].tx.GetNonce(), true
+}
+
+func (p *MempoolMemory) Count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.entries)
+}
+
+func (p *MempoolMemory) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.bytes
+}
+
+// Transactions returns every pooled transaction in the order they were added.
+func (p *MempoolMemory) Transactions() []transaction.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var entries = make([]*entry, 0, len(p.entries))
+	for _, e := range p.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	var txs = make([]transaction.Transaction, 0, len(entries))
+	for _, e := range entries {
+		txs = append(txs, e.tx)
+	}
+	return txs
+}
+
+func (p *MempoolMemory) Expire(now time.Time) []transaction.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var expired = []transaction.Transaction{}
+	if p.config.Expiry <= 0 {
+		return expired
+	}
+	var deadline = now.Add(-p.config.Expiry)
+	for sender, queue := range p.senders {
+		var cut = len(queue)
+		for i, e := range queue {
+			if e.added.Before(deadline) {
+				cut = i
+				break
+			}
+		}
+		for _, e := range queue[cut:] {
+			expired = append(expired, e.tx)
+			delete(p.entries, e.tx.GetTxId())
+			p.bytes -= e.size
+		}
+		if cut == 0 {
+			delete(p.senders, sender)
+		} else {
+			p.senders[sender] = queue[:cut]
+		}
+	}
+	return expired
+}
+
+// heads is a max heap of the first not yet selected entry of every sender.
+type heads []*entry
+
+func (h heads) Len() int           { return len(h) }
+func (h heads) Less(i, j int) bool { return lowerFeeRate(h[j], h[i]) }
+func (h heads) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *heads) Push(x any)        { *h = append(*h, x.(*entry)) }
+func (h *heads) Pop() any {
+	var old = *h
+	var last = old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// Select fills the block greedily: the best paying first transaction of any sender is
+// taken next, then the following transaction of that sender becomes a candidate. A
+// sender is skipped from its first transaction that does not fit or leaves a nonce gap.
+func (p *MempoolMemory) Select(maxBytes int, nextNonce func(sender []byte) uint64) []transaction.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var next = make(map[string]int)
+	var candidates = heads{}
+	for sender, queue := range p.senders {
+		if queue[0].tx.GetNonce() == nextNonce([]byte(sender)) {
+			candidates = append(candidates, queue[0])
+		}
+	}
+	heap.Init(&candidates)
+
+	var selected = []transaction.Transaction{}
+	var size = 0
+	for candidates.Len() > 0 {
+		var best = heap.Pop(&candidates).(*entry)
+		if size+best.size > maxBytes {
+			continue
+		}
+		selected = append(selected, best.tx)
+		size += best.size
+
+		var queue = p.senders[best.sender]
+		next[best.sender]++
+		if i := next[best.sender]; i < len(queue) && queue[i].tx.GetNonce() == best.tx.GetNonce()+1 {
+			heap.Push(&candidates, queue[i])
+		}
+	}
+	return selected
+}
@@ -0,0 +1,210 @@
+package mempool
+
+import (
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction/coin_transfer"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testTx(t *testing.T, sender string, nonce int, fee int64) transaction.Transaction {
+	tx, err := transaction.CreateTransaction(coin_transfer.CoinTransfer, strings.Repeat(sender, 40), 10, fee, map[string]any{
+		"recipient": "ffeeddccbbaa99887766554433221100ffeeddcc",
+		"nonce":     nonce,
+	})
+	if err != nil {
+		t.Fatalf("failed to create transaction: %v", err)
+	}
+	return tx
+}
+
+func ids(txs []transaction.Transaction) [][32]byte {
+	var result = [][32]byte{}
+	for _, tx := range txs {
+		result = append(result, tx.GetTxId())
+	}
+	return result
+}
+
+func checkOrder(t *testing.T, got []transaction.Transaction, want ...transaction.Transaction) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d transactions, want %d", len(got), len(want))
+	}
+	for i, id := range ids(got) {
+		if id != want[i].GetTxId() {
+			t.Errorf("position %d: got %x, want %x", i, id, want[i].GetTxId())
+		}
+	}
+}
+
+func zeroNonce(sender []byte) uint64 {
+	return 0
+}
+
+func TestSelect(t *testing.T) {
+	pool := NewMempool(DefaultConfig())
+	a0 := testTx(t, "a", 0, 1)
+	a1 := testTx(t, "a", 1, 100)
+	b0 := testTx(t, "b", 0, 50)
+	c1 := testTx(t, "c", 1, 1000)
+	// the pool keeps sender transactions in nonce order whatever the arrival order
+	for _, tx := range []transaction.Transaction{a1, b0, a0, c1} {
+		if err := pool.Add(tx); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	if pool.Count() != 4 {
+		t.Fatalf("Count = %d, want 4", pool.Count())
+	}
+	if last, ok := pool.LastNonce(a0.GetSender()); !ok || last != 1 {
+		t.Errorf("LastNonce = %d, %v, want 1, true", last, ok)
+	}
+
+	// c1 waits for nonce 0 of its sender
+	checkOrder(t, pool.Select(1<<20, zeroNonce), b0, a0, a1)
+
+	size, _ := b0.Stringify()
+	checkOrder(t, pool.Select(len(size)+1, zeroNonce), b0)
+
+	checkOrder(t, pool.Select(1<<20, func(sender []byte) uint64 {
+		if sender[0] == 0xcc {
+			return 1
+		}
+		return 0
+	}), c1, b0, a0, a1)
+}
+
+func TestAddDuplicate(t *testing.T) {
+	pool := NewMempool(DefaultConfig())
+	tx := testTx(t, "a", 0, 1)
+	pool.Add(tx)
+	if err := pool.Add(tx); !errors.Is(err, ErrAlreadyExists) {
+		t.Errorf("Add(duplicate) error = %v, want %v", err, ErrAlreadyExists)
+	}
+	if !pool.Remove(tx.GetTxId()) || pool.Count() != 0 || pool.Size() != 0 {
+		t.Errorf("Remove did not empty the pool")
+	}
+}
+
+func TestEviction(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxCount = 2
+	pool := NewMempool(config)
+	low := testTx(t, "a", 0, 5)
+	high := testTx(t, "b", 0, 10)
+	pool.Add(low)
+	pool.Add(high)
+
+	if err := pool.Add(testTx(t, "c", 0, 1)); !errors.Is(err, ErrPoolFull) {
+		t.Errorf("Add(low fee) error = %v, want %v", err, ErrPoolFull)
+	}
+	better := testTx(t, "c", 0, 20)
+	if err := pool.Add(better); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if pool.Contains(low.GetTxId()) || !pool.Contains(high.GetTxId()) || !pool.Contains(better.GetTxId()) {
+		t.Errorf("lowest fee rate transaction was not evicted")
+	}
+
+	// evicting the first transaction of a sender would leave a nonce gap
+	config.MaxCount = 3
+	pool = NewMempool(config)
+	first := testTx(t, "a", 0, 1)
+	pool.Add(first)
+	pool.Add(testTx(t, "a", 1, 100))
+	pool.Add(testTx(t, "b", 0, 50))
+	pool.Add(testTx(t, "c", 0, 60))
+	if !pool.Contains(first.GetTxId()) || pool.Count() != 3 {
+		t.Errorf("evicted a transaction with pooled successors")
+	}
+}
+
+func TestEviction_RejectedKeepsPool(t *testing.T) {
+	low := testTx(t, "a", 0, 1)
+	high := testTx(t, "b", 0, 1_000_000_000_000)
+	// large enough to evict low and then itself, at a fee rate between the two
+	rejected := testTx(t, "c", 0, 1_000_000_000)
+	lowData, _ := low.Stringify()
+	highData, _ := high.Stringify()
+	rejectedData, _ := rejected.Stringify()
+	config := DefaultConfig()
+	config.MaxBytes = len(highData) + len(rejectedData) - 1
+	pool := NewMempool(config)
+	pool.Add(low)
+	pool.Add(high)
+	size := pool.Size()
+	if size != len(lowData)+len(highData) {
+		t.Fatalf("Size = %d, want %d", size, len(lowData)+len(highData))
+	}
+
+	if err := pool.Add(rejected); !errors.Is(err, ErrPoolFull) {
+		t.Fatalf("Add error = %v, want %v", err, ErrPoolFull)
+	}
+	if !pool.Contains(low.GetTxId()) || !pool.Contains(high.GetTxId()) || pool.Contains(rejected.GetTxId()) {
+		t.Errorf("a rejected transaction evicted pooled transactions")
+	}
+	if pool.Count() != 2 || pool.Size() != size {
+		t.Errorf("Count = %d, Size = %d, want 2, %d", pool.Count(), pool.Size(), size)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	tx := testTx(t, "a", 0, 1)
+	data, _ := tx.Stringify()
+	config := DefaultConfig()
+	config.MaxBytes = len(data) - 1
+	pool := NewMempool(config)
+	if err := pool.Add(tx); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Add error = %v, want %v", err, ErrTooLarge)
+	}
+
+	config.MaxBytes = len(data) * 3 / 2
+	pool = NewMempool(config)
+	pool.Add(tx)
+	better := testTx(t, "b", 0, 9)
+	if err := pool.Add(better); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if pool.Contains(tx.GetTxId()) || pool.Size() > config.MaxBytes {
+		t.Errorf("pool size %d exceeds %d", pool.Size(), config.MaxBytes)
+	}
+}
+
+func TestSenderLimit(t *testing.T) {
+	config := DefaultConfig()
+	config.MaxPerSender = 2
+	pool := NewMempool(config)
+	pool.Add(testTx(t, "a", 0, 1))
+	pool.Add(testTx(t, "a", 1, 1))
+	if err := pool.Add(testTx(t, "a", 2, 1)); !errors.Is(err, ErrSenderLimit) {
+		t.Errorf("Add error = %v, want %v", err, ErrSenderLimit)
+	}
+	if err := pool.Add(testTx(t, "b", 0, 1)); err != nil {
+		t.Errorf("Add of another sender failed: %v", err)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	config := DefaultConfig()
+	config.Expiry = time.Hour
+	pool := NewMempool(config)
+	a0 := testTx(t, "a", 0, 1)
+	a1 := testTx(t, "a", 1, 1)
+	a2 := testTx(t, "a", 2, 1)
+	b0 := testTx(t, "b", 0, 1)
+	for _, tx := range []transaction.Transaction{a0, a1, a2, b0} {
+		pool.Add(tx)
+	}
+	pool.(*MempoolMemory).entries[a1.GetTxId()].added = time.Now().Add(-2 * time.Hour)
+
+	expired := pool.Expire(time.Now())
+	if len(expired) != 2 || pool.Count() != 2 || !pool.Contains(a0.GetTxId()) || !pool.Contains(b0.GetTxId()) {
+		t.Errorf("Expire removed %d transactions, want a1 with its successor", len(expired))
+	}
+	if expired := pool.Expire(time.Now().Add(2 * time.Hour)); len(expired) != 2 || pool.Count() != 0 || pool.Size() != 0 {
+		t.Errorf("Expire left %d transactions", pool.Count())
+	}
+}
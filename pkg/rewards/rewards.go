@@ -0,0 +1,75 @@
+package rewards
+
+import (
+	"math"
+	"math/bits"
+)
+
+// Schedule defines the coinbase reward of every block height (the genesis block has
+// height 1). The reward halves every HalvingInterval blocks but never drops below
+// TailEmission, and the total issued supply never exceeds MaxSupply.
+// Zero HalvingInterval disables halving, zero MaxSupply disables the cap.
+type Schedule struct {
+	InitialReward   uint64
+	HalvingInterval uint32
+	TailEmission    uint64
+	MaxSupply       uint64
+}
+
+func NewSchedule(initialReward uint64, halvingInterval uint32, tailEmission uint64, maxSupply uint64) *Schedule {
+	return &Schedule{
+		InitialReward:   initialReward,
+		HalvingInterval: halvingInterval,
+		TailEmission:    tailEmission,
+		MaxSupply:       maxSupply,
+	}
+}
+
+// NewConstant mints the same reward for every block forever.
+func NewConstant(reward uint64) *Schedule {
+	return NewSchedule(reward, 0, 0, 0)
+}
+
+func (s *Schedule) Reward(height uint32) uint64 {
+	if height == 0 {
+		return 0
+	}
+	return s.IssuedSupply(height) - s.IssuedSupply(height-1)
+}
+
+// IssuedSupply returns the total amount minted by blocks 1..height.
+func (s *Schedule) IssuedSupply(height uint32) uint64 {
+	var supply uint64 = 0
+	var remaining = uint64(height)
+	var reward = s.InitialReward
+	for remaining > 0 {
+		if reward <= s.TailEmission || s.HalvingInterval == 0 {
+			supply = addSaturated(supply, mulSaturated(remaining, max(reward, s.TailEmission)))
+			break
+		}
+		var count = min(remaining, uint64(s.HalvingInterval))
+		supply = addSaturated(supply, mulSaturated(count, reward))
+		remaining -= count
+		reward >>= 1
+	}
+	if s.MaxSupply > 0 && supply > s.MaxSupply {
+		return s.MaxSupply
+	}
+	return supply
+}
+
+func addSaturated(a uint64, b uint64) uint64 {
+	var sum, carry = bits.Add64(a, b, 0)
+	if carry != 0 {
+		return math.MaxUint64
+	}
+	return sum
+}
+
+func mulSaturated(a uint64, b uint64) uint64 {
+	var hi, lo = bits.Mul64(a, b)
+	if hi != 0 {
+		return math.MaxUint64
+	}
+	return lo
+}
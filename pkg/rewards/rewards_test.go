@@ -0,0 +1,67 @@
+package rewards
+
+import "testing"
+
+func TestConstant(t *testing.T) {
+	s := NewConstant(50)
+	if s.Reward(1) != 50 || s.Reward(1000000) != 50 {
+		t.Errorf("constant reward changed: %d %d", s.Reward(1), s.Reward(1000000))
+	}
+	if s.IssuedSupply(10) != 500 {
+		t.Errorf("IssuedSupply(10) = %d, want 500", s.IssuedSupply(10))
+	}
+}
+
+func TestHalving(t *testing.T) {
+	s := NewSchedule(100, 10, 0, 0)
+	cases := []struct {
+		height uint32
+		reward uint64
+		supply uint64
+	}{
+		{0, 0, 0},
+		{1, 100, 100},
+		{10, 100, 1000},
+		{11, 50, 1050},
+		{20, 50, 1500},
+		{21, 25, 1525},
+		{80, 0, 1000 + 500 + 250 + 120 + 60 + 30 + 10 + 0},
+	}
+	for _, tc := range cases {
+		if got := s.Reward(tc.height); got != tc.reward {
+			t.Errorf("Reward(%d) = %d, want %d", tc.height, got, tc.reward)
+		}
+		if got := s.IssuedSupply(tc.height); got != tc.supply {
+			t.Errorf("IssuedSupply(%d) = %d, want %d", tc.height, got, tc.supply)
+		}
+	}
+}
+
+func TestTailEmission(t *testing.T) {
+	s := NewSchedule(100, 10, 30, 0)
+	if got := s.Reward(21); got != 30 {
+		t.Errorf("Reward(21) = %d, want tail emission 30", got)
+	}
+	if got := s.Reward(1000); got != 30 {
+		t.Errorf("Reward(1000) = %d, want tail emission 30", got)
+	}
+	if got := s.IssuedSupply(30); got != 1000+500+300 {
+		t.Errorf("IssuedSupply(30) = %d, want 1800", got)
+	}
+}
+
+func TestMaxSupply(t *testing.T) {
+	s := NewSchedule(100, 0, 0, 250)
+	if got := s.Reward(2); got != 100 {
+		t.Errorf("Reward(2) = %d, want 100", got)
+	}
+	if got := s.Reward(3); got != 50 {
+		t.Errorf("Reward(3) = %d, want the rest of supply 50", got)
+	}
+	if got := s.Reward(4); got != 0 {
+		t.Errorf("Reward(4) = %d, want 0 after cap", got)
+	}
+	if got := s.IssuedSupply(1 << 31); got != 250 {
+		t.Errorf("IssuedSupply = %d, want 250", got)
+	}
+}
@@ -0,0 +1,150 @@
+package script_templates
+
+import (
+	"blockchain_demo/pkg/script_vm"
+	"fmt"
+)
+
+// instruction is an opcode of a script, pushes keep the pushed data and other opcodes
+// have nil data.
+type instruction struct {
+	op   byte
+	data []byte
+}
+
+func (ins instruction) isPush() bool {
+	return ins.data != nil
+}
+
+// smallInt returns n of OP_1..OP_16.
+func (ins instruction) smallInt() (int, bool) {
+	if ins.op < script_vm.OP_1 || ins.op > script_vm.OP_16 {
+		return 0, false
+	}
+	return int(ins.op-script_vm.OP_1) + 1, true
+}
+
+// disassemble splits script into instructions the same way script_vm.VM.ParseScript
+// reads it.
+func disassemble(script []byte) ([]instruction, error) {
+	var result = []instruction{}
+	for pointer := 0; pointer < len(script); {
+		var op = script[pointer]
+		var size, offset = 0, 1
+		switch {
+		case op == script_vm.OP_0:
+			result = append(result, instruction{op: op, data: []byte{0}})
+			pointer++
+			continue
+		case op >= script_vm.OP_1 && op <= script_vm.OP_16:
+			result = append(result, instruction{op: op, data: []byte{op - script_vm.OP_1 + 1}})
+			pointer++
+			continue
+		case op >= script_vm.OP_PUSHDATA && op <= script_vm.OP_PUSHDATA_4B:
+			size = int(op)
+		case op == script_vm.OP_PUSHDATA1 || op == script_vm.OP_PUSHDATA2 || op == script_vm.OP_PUSHDATA4:
+			var sizeBytes = map[byte]int{script_vm.OP_PUSHDATA1: 1, script_vm.OP_PUSHDATA2: 2, script_vm.OP_PUSHDATA4: 4}[op]
+			if pointer+1+sizeBytes > len(script) {
+				return nil, fmt.Errorf("push at %d is truncated", pointer)
+			}
+			for i := 0; i < sizeBytes; i++ {
+				size |= int(script[pointer+1+i]) << (8 * i)
+			}
+			offset += sizeBytes
+		default:
+			result = append(result, instruction{op: op})
+			pointer++
+			continue
+		}
+		if size > len(script)-pointer-offset {
+			return nil, fmt.Errorf("push of %d bytes at %d exceeds the script", size, pointer)
+		}
+		var start = pointer + offset
+		result = append(result, instruction{op: op, data: script[start : start+size]})
+		pointer = start + size
+	}
+	return result, nil
+}
+
+// pattern matches one instruction of a template.
+type pattern func(ins instruction) bool
+
+func opcode(op byte) pattern {
+	return func(ins instruction) bool {
+		return ins.op == op && !ins.isPush()
+	}
+}
+
+func push(size int) pattern {
+	return func(ins instruction) bool {
+		return ins.isPush() && len(ins.data) == size
+	}
+}
+
+func anyPush(ins instruction) bool {
+	return ins.isPush()
+}
+
+func match(instructions []instruction, patterns ...pattern) bool {
+	if len(instructions) != len(patterns) {
+		return false
+	}
+	for i, p := range patterns {
+		if !p(instructions[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func isMultiSig(instructions []instruction) bool {
+	if len(instructions) < 4 || !opcode(script_vm.OP_CHECKMULTISIG)(instructions[len(instructions)-1]) {
+		return false
+	}
+	m, ok := instructions[0].smallInt()
+	if !ok {
+		return false
+	}
+	n, ok := instructions[len(instructions)-2].smallInt()
+	if !ok || m > n || n != len(instructions)-3 {
+		return false
+	}
+	for _, key := range instructions[1 : len(instructions)-2] {
+		if !key.isPush() || len(key.data) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Classify reports the template scriptPubKey matches, NonStandard for any other script.
+func Classify(scriptPubKey []byte) ScriptClass {
+	if script_vm.IsPayToScriptHash(scriptPubKey) {
+		return ScriptHash
+	}
+	instructions, err := disassemble(scriptPubKey)
+	if err != nil {
+		return NonStandard
+	}
+	switch {
+	case match(instructions, anyPush, opcode(script_vm.OP_CHECKSIG)):
+		return PubKey
+	case match(instructions,
+		opcode(script_vm.OP_DUP), opcode(script_vm.OP_HASH160), push(HashSize),
+		opcode(script_vm.OP_EQUALVERIFY), opcode(script_vm.OP_CHECKSIG)):
+		return PubKeyHash
+	case isMultiSig(instructions):
+		return MultiSig
+	case match(instructions,
+		opcode(script_vm.OP_IF),
+		opcode(script_vm.OP_SHA256), push(SecretHashSize), opcode(script_vm.OP_EQUALVERIFY),
+		opcode(script_vm.OP_DUP), opcode(script_vm.OP_HASH160), push(HashSize),
+		opcode(script_vm.OP_ELSE),
+		anyPush, opcode(script_vm.OP_CHECKLOCKTIMEVERIFY), opcode(script_vm.OP_DROP),
+		opcode(script_vm.OP_DUP), opcode(script_vm.OP_HASH160), push(HashSize),
+		opcode(script_vm.OP_ENDIF),
+		opcode(script_vm.OP_EQUALVERIFY), opcode(script_vm.OP_CHECKSIG)):
+		return HashTimeLock
+	}
+	return NonStandard
+}
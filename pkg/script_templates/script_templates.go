@@ -0,0 +1,253 @@
+package script_templates
+
+import (
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/wallet"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// ScriptClass is the standard template a scriptPubKey matches.
+type ScriptClass int
+
+const (
+	NonStandard ScriptClass = iota
+	PubKey
+	PubKeyHash
+	ScriptHash
+	MultiSig
+	HashTimeLock
+)
+
+const (
+	HashSize        = 20 // size of OP_HASH160 digests
+	SecretHashSize  = 32 // size of OP_SHA256 digests
+	MaxMultiSigKeys = 16
+)
+
+var ErrInvalidTemplate = errors.New("invalid template parameters")
+
+var classNames = map[ScriptClass]string{
+	NonStandard:  "nonstandard",
+	PubKey:       "pubkey",
+	PubKeyHash:   "pubkeyhash",
+	ScriptHash:   "scripthash",
+	MultiSig:     "multisig",
+	HashTimeLock: "htlc",
+}
+
+func (c ScriptClass) String() string {
+	if name, ok := classNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("ScriptClass(%d)", int(c))
+}
+
+// Hash160 is the digest OP_HASH160 computes, ripemd160(sha256(data)). It is the public
+// key hash of sign.PublicKeyHash.
+func Hash160(data []byte) []byte {
+	return sign.PublicKeyHash(data)
+}
+
+// SecretHash is the digest OP_SHA256 computes, the hash lock of a hash time locked
+// contract.
+func SecretHash(secret []byte) []byte {
+	var hash = sha256.Sum256(secret)
+	return hash[:]
+}
+
+// pushData returns the shortest push of data, single bytes up to 16 use OP_0 and
+// OP_1..OP_16 which push the same byte.
+func pushData(data []byte) ([]byte, error) {
+	return script_vm.Compile(script_vm.OP_PUSHDATA, data)
+}
+
+// pushNum pushes a script number.
+func pushNum(n int64) ([]byte, error) {
+	if n == 0 {
+		return []byte{script_vm.OP_0}, nil
+	}
+	return pushData(script_vm.EncodeNum(n))
+}
+
+// build concatenates opcodes and pushes, a []byte item is pushed as data and an opcode
+// is appended as it is.
+func build(items ...any) ([]byte, error) {
+	var script = []byte{}
+	for _, item := range items {
+		switch v := item.(type) {
+		case int:
+			script = append(script, byte(v))
+		case []byte:
+			push, err := pushData(v)
+			if err != nil {
+				return nil, err
+			}
+			script = append(script, push...)
+		default:
+			return nil, fmt.Errorf("unsupported script item %T", item)
+		}
+	}
+	return script, nil
+}
+
+// PayToPubKey locks an output to a signature of publicKey.
+func PayToPubKey(publicKey []byte) ([]byte, error) {
+	if len(publicKey) == 0 {
+		return nil, fmt.Errorf("%w: empty public key", ErrInvalidTemplate)
+	}
+	return build(publicKey, script_vm.OP_CHECKSIG)
+}
+
+// PayToPubKeySig is the scriptSig spending a PayToPubKey output.
+func PayToPubKeySig(signature []byte) ([]byte, error) {
+	return build(signature)
+}
+
+// PayToPubKeyHash locks an output to a signature of the public key hashed to
+// pubKeyHash: OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG.
+func PayToPubKeyHash(pubKeyHash []byte) ([]byte, error) {
+	if len(pubKeyHash) != HashSize {
+		return nil, fmt.Errorf("%w: public key hash of %d bytes", ErrInvalidTemplate, len(pubKeyHash))
+	}
+	return build(
+		script_vm.OP_DUP,
+		script_vm.OP_HASH160,
+		pubKeyHash,
+		script_vm.OP_EQUALVERIFY,
+		script_vm.OP_CHECKSIG,
+	)
+}
+
+// PayToWallet is PayToPubKeyHash of the public key hash of w.
+func PayToWallet(w wallet.Wallet) ([]byte, error) {
+	pubKeyHash, err := w.GetPublicKeyHash()
+	if err != nil {
+		return nil, err
+	}
+	return PayToPubKeyHash(pubKeyHash)
+}
+
+// PayToPubKeyHashSig is the scriptSig spending a PayToPubKeyHash output.
+func PayToPubKeyHashSig(signature []byte, publicKey []byte) ([]byte, error) {
+	return build(signature, publicKey)
+}
+
+// PayToScriptHash locks an output to the hash of redeemScript:
+// OP_HASH160 <Hash160(redeemScript)> OP_EQUAL.
+func PayToScriptHash(redeemScript []byte) ([]byte, error) {
+	if len(redeemScript) == 0 || len(redeemScript) > script_vm.MaxElementSize {
+		return nil, fmt.Errorf("%w: redeem script of %d bytes", ErrInvalidTemplate, len(redeemScript))
+	}
+	return build(
+		script_vm.OP_HASH160,
+		Hash160(redeemScript),
+		script_vm.OP_EQUAL,
+	)
+}
+
+// PayToScriptHashSig is the scriptSig spending a PayToScriptHash output, the pushes
+// satisfying redeemScript followed by the push of redeemScript itself.
+func PayToScriptHashSig(redeemScript []byte, pushes ...[]byte) ([]byte, error) {
+	var items = make([]any, 0, len(pushes)+1)
+	for _, push := range pushes {
+		items = append(items, push)
+	}
+	return build(append(items, redeemScript)...)
+}
+
+// MultiSigScript requires m signatures of different publicKeys:
+// <m> <key 1> ... <key n> <n> OP_CHECKMULTISIG.
+func MultiSigScript(m int, publicKeys [][]byte) ([]byte, error) {
+	if len(publicKeys) == 0 || len(publicKeys) > MaxMultiSigKeys || m < 1 || m > len(publicKeys) {
+		return nil, fmt.Errorf("%w: %d of %d keys", ErrInvalidTemplate, m, len(publicKeys))
+	}
+	var items = []any{script_vm.OP_1 + m - 1}
+	for _, key := range publicKeys {
+		if len(key) == 0 {
+			return nil, fmt.Errorf("%w: empty public key", ErrInvalidTemplate)
+		}
+		items = append(items, key)
+	}
+	items = append(items, script_vm.OP_1+len(publicKeys)-1, script_vm.OP_CHECKMULTISIG)
+	return build(items...)
+}
+
+// MultiSigSig is the scriptSig spending a MultiSigScript output with m signatures.
+func MultiSigSig(signatures [][]byte) ([]byte, error) {
+	var items = make([]any, 0, len(signatures))
+	for _, signature := range signatures {
+		items = append(items, signature)
+	}
+	return build(items...)
+}
+
+// HashTimeLockScript pays to recipientHash against the secret hashed to secretHash, or
+// back to refundHash once the transaction lock time reaches lockTime:
+//
+//	OP_IF
+//	  OP_SHA256 <secretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipientHash>
+//	OP_ELSE
+//	  <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refundHash>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func HashTimeLockScript(secretHash []byte, recipientHash []byte, refundHash []byte, lockTime uint32) ([]byte, error) {
+	if len(secretHash) != SecretHashSize || len(recipientHash) != HashSize || len(refundHash) != HashSize {
+		return nil, fmt.Errorf("%w: hashes of %d, %d and %d bytes", ErrInvalidTemplate, len(secretHash), len(recipientHash), len(refundHash))
+	}
+	if lockTime == 0 {
+		return nil, fmt.Errorf("%w: zero lock time", ErrInvalidTemplate)
+	}
+	lock, err := pushNum(int64(lockTime))
+	if err != nil {
+		return nil, err
+	}
+	head, err := build(
+		script_vm.OP_IF,
+		script_vm.OP_SHA256,
+		secretHash,
+		script_vm.OP_EQUALVERIFY,
+		script_vm.OP_DUP,
+		script_vm.OP_HASH160,
+		recipientHash,
+		script_vm.OP_ELSE,
+	)
+	if err != nil {
+		return nil, err
+	}
+	tail, err := build(
+		script_vm.OP_CHECKLOCKTIMEVERIFY,
+		script_vm.OP_DROP,
+		script_vm.OP_DUP,
+		script_vm.OP_HASH160,
+		refundHash,
+		script_vm.OP_ENDIF,
+		script_vm.OP_EQUALVERIFY,
+		script_vm.OP_CHECKSIG,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return append(append(head, lock...), tail...), nil
+}
+
+// HashTimeLockRedeemSig is the scriptSig of the recipient revealing secret.
+func HashTimeLockRedeemSig(signature []byte, publicKey []byte, secret []byte) ([]byte, error) {
+	script, err := build(signature, publicKey, secret)
+	if err != nil {
+		return nil, err
+	}
+	return append(script, script_vm.OP_1), nil
+}
+
+// HashTimeLockRefundSig is the scriptSig of the refund after the lock time. The
+// spending transaction needs a lock time of at least the lock and a non final sequence.
+func HashTimeLockRefundSig(signature []byte, publicKey []byte) ([]byte, error) {
+	script, err := build(signature, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(script, script_vm.OP_0), nil
+}
@@ -0,0 +1,196 @@
+package script_templates
+
+import (
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/sign/sign_ed25519"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/wallet"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+var signer = sign_ed25519.Ed25519Signer{}
+
+func newKeys(t *testing.T) *sign.SignatureKeys {
+	keys, err := signer.GenerateKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateKeyPair failed: %v", err)
+	}
+	return keys
+}
+
+// spendingTx spends one output with the given lock time and input sequence.
+func spendingTx(lockTime uint32, sequence uint32) *script_vm.Tx {
+	return &script_vm.Tx{
+		Inputs:   []script_vm.TxIn{{PrevTxId: transaction.Hash{1}, Sequence: sequence}},
+		Outputs:  []script_vm.TxOut{{Value: 10, ScriptPubKey: []byte{script_vm.OP_1}}},
+		LockTime: lockTime,
+	}
+}
+
+func signInput(t *testing.T, keys *sign.SignatureKeys, tx *script_vm.Tx, scriptPubKey []byte) []byte {
+	signature, err := script_vm.SignInput(signer, keys.PrivateKey, tx, 0, scriptPubKey, script_vm.SigHashAll)
+	if err != nil {
+		t.Fatalf("SignInput failed: %v", err)
+	}
+	return signature
+}
+
+func verify(tx *script_vm.Tx, height uint32, scriptSig []byte, scriptPubKey []byte) error {
+	return script_vm.New(signer).VerifyScript(scriptSig, scriptPubKey, script_vm.TxContext{
+		Tx:         tx,
+		ScriptCode: scriptPubKey,
+		Height:     height,
+	})
+}
+
+func TestPayToPubKeyHash(t *testing.T) {
+	keys := newKeys(t)
+	w, _ := wallet.CreateWallet(keys, []byte{0x00})
+	scriptPubKey, err := PayToWallet(*w)
+	if err != nil {
+		t.Fatalf("PayToWallet failed: %v", err)
+	}
+	if Classify(scriptPubKey) != PubKeyHash {
+		t.Errorf("Classify = %v, want %v", Classify(scriptPubKey), PubKeyHash)
+	}
+	tx := spendingTx(0, script_vm.SequenceFinal)
+	scriptSig, _ := PayToPubKeyHashSig(signInput(t, keys, tx, scriptPubKey), keys.PublicKey)
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err != nil {
+		t.Errorf("spend failed: %v", err)
+	}
+	other := newKeys(t)
+	scriptSig, _ = PayToPubKeyHashSig(signInput(t, other, tx, scriptPubKey), other.PublicKey)
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err == nil {
+		t.Errorf("expected error for the key of another wallet")
+	}
+	if _, err := PayToPubKeyHash(make([]byte, 19)); !errors.Is(err, ErrInvalidTemplate) {
+		t.Errorf("PayToPubKeyHash(19 bytes) error = %v, want %v", err, ErrInvalidTemplate)
+	}
+}
+
+func TestMultiSig(t *testing.T) {
+	keys := []*sign.SignatureKeys{newKeys(t), newKeys(t), newKeys(t)}
+	scriptPubKey, err := MultiSigScript(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey})
+	if err != nil {
+		t.Fatalf("MultiSigScript failed: %v", err)
+	}
+	if Classify(scriptPubKey) != MultiSig {
+		t.Errorf("Classify = %v, want %v", Classify(scriptPubKey), MultiSig)
+	}
+	tx := spendingTx(0, script_vm.SequenceFinal)
+	scriptSig, _ := MultiSigSig([][]byte{signInput(t, keys[2], tx, scriptPubKey), signInput(t, keys[0], tx, scriptPubKey)})
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err != nil {
+		t.Errorf("2 of 3 spend failed: %v", err)
+	}
+	scriptSig, _ = MultiSigSig([][]byte{signInput(t, keys[1], tx, scriptPubKey), signInput(t, keys[1], tx, scriptPubKey)})
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err == nil {
+		t.Errorf("expected error for the same key signing twice")
+	}
+	for _, m := range []int{0, 4} {
+		if _, err := MultiSigScript(m, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey}); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("MultiSigScript(%d of 3) error = %v, want %v", m, err, ErrInvalidTemplate)
+		}
+	}
+}
+
+func TestHashTimeLock(t *testing.T) {
+	recipient, refund := newKeys(t), newKeys(t)
+	secret := []byte("secret")
+	scriptPubKey, err := HashTimeLockScript(SecretHash(secret), Hash160(recipient.PublicKey), Hash160(refund.PublicKey), 100)
+	if err != nil {
+		t.Fatalf("HashTimeLockScript failed: %v", err)
+	}
+	if Classify(scriptPubKey) != HashTimeLock {
+		t.Errorf("Classify = %v, want %v", Classify(scriptPubKey), HashTimeLock)
+	}
+
+	tx := spendingTx(0, script_vm.SequenceFinal)
+	scriptSig, _ := HashTimeLockRedeemSig(signInput(t, recipient, tx, scriptPubKey), recipient.PublicKey, secret)
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err != nil {
+		t.Errorf("redeem failed: %v", err)
+	}
+	scriptSig, _ = HashTimeLockRedeemSig(signInput(t, recipient, tx, scriptPubKey), recipient.PublicKey, []byte("guess"))
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err == nil {
+		t.Errorf("expected error for a wrong secret")
+	}
+
+	early := spendingTx(99, 0)
+	scriptSig, _ = HashTimeLockRefundSig(signInput(t, refund, early, scriptPubKey), refund.PublicKey)
+	if err := verify(early, 99, scriptSig, scriptPubKey); !errors.Is(err, script_vm.ErrUnsatisfiedLockTime) {
+		t.Errorf("early refund error = %v, want %v", err, script_vm.ErrUnsatisfiedLockTime)
+	}
+	late := spendingTx(100, 0)
+	scriptSig, _ = HashTimeLockRefundSig(signInput(t, refund, late, scriptPubKey), refund.PublicKey)
+	if err := verify(late, 100, scriptSig, scriptPubKey); err != nil {
+		t.Errorf("refund failed: %v", err)
+	}
+	scriptSig, _ = HashTimeLockRefundSig(signInput(t, recipient, late, scriptPubKey), recipient.PublicKey)
+	if err := verify(late, 100, scriptSig, scriptPubKey); err == nil {
+		t.Errorf("expected error for a refund to the recipient")
+	}
+}
+
+func TestClassify(t *testing.T) {
+	keys := newKeys(t)
+	payToPubKey, _ := PayToPubKey(keys.PublicKey)
+	multiSig, _ := MultiSigScript(1, [][]byte{keys.PublicKey})
+	payToScriptHash, _ := PayToScriptHash(multiSig)
+	cases := []struct {
+		name   string
+		script []byte
+		want   ScriptClass
+	}{
+		{"pubkey", payToPubKey, PubKey},
+		{"scripthash", payToScriptHash, ScriptHash},
+		{"redeem_script", multiSig, MultiSig},
+		{"empty", nil, NonStandard},
+		{"truncated_push", []byte{0x05, 0x01}, NonStandard},
+		{"scripthash_with_pushdata1", append(append([]byte{script_vm.OP_HASH160, script_vm.OP_PUSHDATA1, HashSize}, make([]byte, HashSize)...), script_vm.OP_EQUAL), NonStandard},
+		{"multisig_wrong_count", append(bytes.Clone(multiSig[:len(multiSig)-2]), script_vm.OP_2, script_vm.OP_CHECKMULTISIG), NonStandard},
+		{"return", []byte{script_vm.OP_RETURN}, NonStandard},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := Classify(tc.script); got != tc.want {
+				t.Errorf("Classify(%x) = %v, want %v", tc.script, got, tc.want)
+			}
+		})
+	}
+	if NonStandard.String() != "nonstandard" || HashTimeLock.String() != "htlc" {
+		t.Errorf("unexpected class names %q and %q", NonStandard, HashTimeLock)
+	}
+}
+
+func TestPayToScriptHash(t *testing.T) {
+	keys := []*sign.SignatureKeys{newKeys(t), newKeys(t)}
+	redeemScript, _ := MultiSigScript(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey})
+	scriptPubKey, err := PayToScriptHash(redeemScript)
+	if err != nil {
+		t.Fatalf("PayToScriptHash failed: %v", err)
+	}
+	tx := spendingTx(0, script_vm.SequenceFinal)
+	// signatures commit to the redeem script, not to the scriptPubKey
+	scriptSig, _ := PayToScriptHashSig(redeemScript, signInput(t, keys[0], tx, redeemScript), signInput(t, keys[1], tx, redeemScript))
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err != nil {
+		t.Errorf("P2SH spend failed: %v", err)
+	}
+
+	scriptSig, _ = PayToScriptHashSig(redeemScript, signInput(t, keys[0], tx, redeemScript))
+	if err := verify(tx, 1, scriptSig, scriptPubKey); err == nil {
+		t.Errorf("expected error for a missing signature of the redeem script")
+	}
+	vm := script_vm.New(signer)
+	vm.SetFlags(script_vm.VerifyNone)
+	if err := vm.VerifyScript(scriptSig, scriptPubKey, script_vm.TxContext{Tx: tx, ScriptCode: scriptPubKey}); err != nil {
+		t.Errorf("spend without P2SH evaluation failed: %v", err)
+	}
+
+	other, _ := MultiSigScript(1, [][]byte{keys[0].PublicKey})
+	scriptSig, _ = PayToScriptHashSig(other, signInput(t, keys[0], tx, other))
+	if err := verify(tx, 1, scriptSig, scriptPubKey); !errors.Is(err, script_vm.ErrEvalFalse) {
+		t.Errorf("spend with another redeem script error = %v, want %v", err, script_vm.ErrEvalFalse)
+	}
+}
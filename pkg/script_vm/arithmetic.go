@@ -0,0 +1,206 @@
+package script_vm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Splice, bitwise and arithmetic opcodes. The comparison opcodes are declared in
+// script_vm.go.
+const (
+	OP_CAT       = 0x7E // Concatenates the two top elements
+	OP_SUBSTR    = 0x7F // Pops size and begin, replaces the top with its substring
+	OP_SIZE      = 0x82 // Pushes the size of the top element, keeping it
+	OP_AND       = 0x84 // Bitwise AND of two elements of equal size
+	OP_OR        = 0x85 // Bitwise OR of two elements of equal size
+	OP_XOR       = 0x86 // Bitwise XOR of two elements of equal size
+	OP_1ADD      = 0x8B // Adds 1 to the top number
+	OP_1SUB      = 0x8C // Subtracts 1 from the top number
+	OP_NEGATE    = 0x8F // Negates the top number
+	OP_ABS       = 0x90 // Replaces the top number with its absolute value
+	OP_NOT       = 0x91 // 1 if the top number is 0, otherwise 0
+	OP_0NOTEQUAL = 0x92 // 0 if the top number is 0, otherwise 1
+	OP_ADD       = 0x93 // a + b
+	OP_SUB       = 0x94 // a - b
+	OP_WITHIN    = 0xA5 // 1 if min <= x < max for x min max, otherwise 0
+)
+
+// maxNumSize is the longest number accepted by arithmetic opcodes. Results may be
+// longer, they are pushed but can not be used as operands again.
+const maxNumSize = 4
+
+var ErrNumOverflow = errors.New("number overflow")
+
+// popOperand pops a number operand of an arithmetic opcode.
+func (v *VM) popOperand() (int64, error) {
+	top, err := v.stack.Pop()
+	if err != nil {
+		return 0, err
+	}
+	if len(top) > maxNumSize {
+		return 0, fmt.Errorf("%w: operand %x is longer than %d bytes", ErrNumOverflow, top, maxNumSize)
+	}
+	return DecodeNum(top, maxNumSize)
+}
+
+func boolNum(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// unaryNum replaces the top number a with f(a).
+func unaryNum(f func(a int64) int64) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		a, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(f(a)))
+		return nil
+	}
+}
+
+// binaryNum replaces the numbers a and b, b being the top, with f(a, b).
+func binaryNum(f func(a, b int64) int64) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		b, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		a, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(f(a, b)))
+		return nil
+	}
+}
+
+// bitwise replaces the two top elements of equal size with f applied to each byte pair.
+func bitwise(f func(a, b byte) byte) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		b, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		a, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		if len(a) != len(b) {
+			return fmt.Errorf("%s operands have different sizes %d and %d", OpCodeNames[op.code], len(a), len(b))
+		}
+		var result = make([]byte, len(a))
+		for i := range a {
+			result[i] = f(a[i], b[i])
+		}
+		ctx.vm.stack.Push(result)
+		return nil
+	}
+}
+
+var arithmeticHandlers = map[OPCode]opHandler{
+	OP_CAT: func(ctx *handlerContext, op operation) error {
+		b, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		a, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		if len(a)+len(b) > ctx.vm.limits.MaxElementSize {
+			return fmt.Errorf("%w: %d bytes", ErrElementTooLarge, len(a)+len(b))
+		}
+		ctx.vm.stack.Push(append(append([]byte{}, a...), b...))
+		return nil
+	},
+	OP_SUBSTR: func(ctx *handlerContext, op operation) error {
+		size, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		begin, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		data, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		if begin < 0 || size < 0 || begin+size > int64(len(data)) {
+			return fmt.Errorf("substring %d+%d is out of %d bytes", begin, size, len(data))
+		}
+		ctx.vm.stack.Push(bytes.Clone(data[begin : begin+size]))
+		return nil
+	},
+	OP_SIZE: func(ctx *handlerContext, op operation) error {
+		top, err := ctx.vm.stack.Pick()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(int64(len(top))))
+		return nil
+	},
+	OP_AND: bitwise(func(a, b byte) byte { return a & b }),
+	OP_OR:  bitwise(func(a, b byte) byte { return a | b }),
+	OP_XOR: bitwise(func(a, b byte) byte { return a ^ b }),
+
+	OP_1ADD:   unaryNum(func(a int64) int64 { return a + 1 }),
+	OP_1SUB:   unaryNum(func(a int64) int64 { return a - 1 }),
+	OP_NEGATE: unaryNum(func(a int64) int64 { return -a }),
+	OP_ABS: unaryNum(func(a int64) int64 {
+		if a < 0 {
+			return -a
+		}
+		return a
+	}),
+	OP_NOT:       unaryNum(func(a int64) int64 { return boolNum(a == 0) }),
+	OP_0NOTEQUAL: unaryNum(func(a int64) int64 { return boolNum(a != 0) }),
+
+	OP_ADD:                binaryNum(func(a, b int64) int64 { return a + b }),
+	OP_SUB:                binaryNum(func(a, b int64) int64 { return a - b }),
+	OP_BOOLAND:            binaryNum(func(a, b int64) int64 { return boolNum(a != 0 && b != 0) }),
+	OP_BOOLOR:             binaryNum(func(a, b int64) int64 { return boolNum(a != 0 || b != 0) }),
+	OP_NUMEQUAL:           binaryNum(func(a, b int64) int64 { return boolNum(a == b) }),
+	OP_NUMNOTEQUAL:        binaryNum(func(a, b int64) int64 { return boolNum(a != b) }),
+	OP_LESSTHAN:           binaryNum(func(a, b int64) int64 { return boolNum(a < b) }),
+	OP_GREATERTHAN:        binaryNum(func(a, b int64) int64 { return boolNum(a > b) }),
+	OP_LESSTHANOREQUAL:    binaryNum(func(a, b int64) int64 { return boolNum(a <= b) }),
+	OP_GREATERTHANOREQUAL: binaryNum(func(a, b int64) int64 { return boolNum(a >= b) }),
+	OP_MIN:                binaryNum(func(a, b int64) int64 { return min(a, b) }),
+	OP_MAX:                binaryNum(func(a, b int64) int64 { return max(a, b) }),
+	OP_NUMEQUALVERIFY: func(ctx *handlerContext, op operation) error {
+		b, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		a, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		if a != b {
+			return errors.New("numequal verify failed")
+		}
+		return nil
+	},
+	OP_WITHIN: func(ctx *handlerContext, op operation) error {
+		upper, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		lower, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		x, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(boolNum(lower <= x && x < upper)))
+		return nil
+	},
+}
@@ -0,0 +1,334 @@
+package script_vm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Assembler syntax, words are separated by whitespace and any number of them may share
+// a line:
+//
+//	OP_DUP, DUP       opcodes with or without the OP_ prefix
+//	42, -1            integers, pushed as minimal script numbers
+//	0x0102            hex data
+//	"text"            quoted strings with Go escapes
+//	<name>            data of the parameter name
+//	NAME              the words of a macro
+//	# comment         the rest of the line is a comment
+//	#define NAME ...  defines a macro of the words after its name
+//
+// OP_PUSHDATA, OP_PUSHDATA1, OP_PUSHDATA2 and OP_PUSHDATA4 push the next word of the
+// line, which is hex data without the 0x prefix, a string or a parameter.
+const defineDirective = "#define"
+
+var (
+	ErrUnknownWord    = errors.New("unknown word")
+	ErrInvalidLiteral = errors.New("invalid literal")
+	ErrMissingParam   = errors.New("missing parameter")
+	ErrMissingData    = errors.New("push without data")
+	ErrInvalidMacro   = errors.New("invalid macro")
+	ErrMacroRecursion = errors.New("recursive macro")
+)
+
+// AsmError is an error of the assembler source at Line and Column, both starting at 1.
+type AsmError struct {
+	Rule   error
+	Line   int
+	Column int
+	Detail string
+}
+
+func (e *AsmError) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("line %d:%d: %s", e.Line, e.Column, e.Rule.Error())
+	}
+	return fmt.Sprintf("line %d:%d: %s: %s", e.Line, e.Column, e.Rule.Error(), e.Detail)
+}
+
+func (e *AsmError) Unwrap() error {
+	return e.Rule
+}
+
+// token is a word of the source and where it starts.
+type token struct {
+	text   string
+	line   int
+	column int
+}
+
+func asmError(tok token, rule error, format string, args ...any) error {
+	return &AsmError{Rule: rule, Line: tok.line, Column: tok.column, Detail: fmt.Sprintf(format, args...)}
+}
+
+// tokenize splits a line into words, stopping at a comment. Quoted strings may contain
+// whitespace and #.
+func tokenize(line string, row int, offset int) ([]token, error) {
+	var tokens = []token{}
+	for i := 0; i < len(line); {
+		switch c := line[i]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+			continue
+		case c == '#':
+			return tokens, nil
+		}
+		var start = i
+		if line[i] == '"' {
+			i++
+			for i < len(line) && line[i] != '"' {
+				if line[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			if i >= len(line) {
+				return nil, asmError(token{line: row, column: offset + start + 1}, ErrInvalidLiteral, "unterminated string")
+			}
+			i++
+		} else {
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\r' {
+				i++
+			}
+		}
+		tokens = append(tokens, token{text: line[start:i], line: row, column: offset + start + 1})
+	}
+	return tokens, nil
+}
+
+func isIdentifier(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if c != '_' && (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// lookupOpCode finds an opcode by its name with or without the OP_ prefix.
+func lookupOpCode(name string) (OPCode, bool) {
+	if code, ok := NamesOpCode[name]; ok {
+		return code, true
+	}
+	code, ok := NamesOpCode["OP_"+name]
+	return code, ok
+}
+
+func isPushOpCode(code OPCode) bool {
+	return code == OP_PUSHDATA || code == OP_PUSHDATA1 || code == OP_PUSHDATA2 || code == OP_PUSHDATA4
+}
+
+func isInteger(s string) bool {
+	var digits = strings.TrimPrefix(s, "-")
+	if digits == "" {
+		return false
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+type assembler struct {
+	params    map[string][]byte
+	macros    map[string][]token
+	expanding map[string]bool
+	words     int
+	script    []byte
+	// legacy skips the hex argument of a line starting with a non push opcode, which
+	// the one opcode per line format of VM.ParseString accepted and ignored
+	legacy bool
+}
+
+// Assemble compiles the assembler source src, placeholders are replaced by the data of
+// params. Errors are *AsmError wrapping the failed rule.
+func Assemble(src string, params map[string][]byte) ([]byte, error) {
+	return assemble(src, params, false)
+}
+
+func assemble(src string, params map[string][]byte, legacy bool) ([]byte, error) {
+	var a = &assembler{
+		params:    params,
+		macros:    map[string][]token{},
+		expanding: map[string]bool{},
+		script:    []byte{},
+		legacy:    legacy,
+	}
+	for i, line := range strings.Split(src, "\n") {
+		var trimmed = strings.TrimLeft(line, " \t")
+		var offset = len(line) - len(trimmed)
+		if rest, ok := strings.CutPrefix(trimmed, defineDirective); ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t') {
+			if err := a.define(rest, i+1, offset+len(defineDirective)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		tokens, err := tokenize(line, i+1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if a.legacy && a.isLegacyArgument(tokens) {
+			tokens = append(tokens[:1], tokens[2:]...)
+		}
+		if err := a.emit(tokens); err != nil {
+			return nil, err
+		}
+	}
+	return a.script, nil
+}
+
+// isLegacyArgument reports whether the second word of a line is the hex argument of a
+// non push opcode starting it, like 0102 of "OP_DUP 0102".
+func (a *assembler) isLegacyArgument(tokens []token) bool {
+	if len(tokens) < 2 {
+		return false
+	}
+	op, ok := lookupOpCode(tokens[0].text)
+	if !ok || isPushOpCode(op) {
+		return false
+	}
+	var arg = tokens[1].text
+	if _, ok := NamesOpCode[arg]; ok || a.macros[arg] != nil || strings.HasPrefix(arg, "0x") {
+		return false
+	}
+	_, err := hex.DecodeString(arg)
+	return err == nil
+}
+
+// define adds the macro of a #define line.
+func (a *assembler) define(line string, row int, offset int) error {
+	tokens, err := tokenize(line, row, offset)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 {
+		return asmError(token{line: row, column: offset + 1}, ErrInvalidMacro, "missing name")
+	}
+	var name = tokens[0]
+	if !isIdentifier(name.text) {
+		return asmError(name, ErrInvalidMacro, "%q is not a name", name.text)
+	}
+	if _, ok := lookupOpCode(name.text); ok {
+		return asmError(name, ErrInvalidMacro, "%s is an opcode", name.text)
+	}
+	if _, ok := a.macros[name.text]; ok {
+		return asmError(name, ErrInvalidMacro, "%s is already defined", name.text)
+	}
+	a.macros[name.text] = tokens[1:]
+	return nil
+}
+
+// emit compiles tokens, the data of a push opcode has to follow it on the same line.
+func (a *assembler) emit(tokens []token) error {
+	for i := 0; i < len(tokens); i++ {
+		var tok = tokens[i]
+		if a.words++; a.words > MaxScriptSize {
+			return asmError(tok, ErrScriptTooLarge, "more than %d words", MaxScriptSize)
+		}
+		if body, ok := a.macros[tok.text]; ok {
+			if a.expanding[tok.text] {
+				return asmError(tok, ErrMacroRecursion, "%s", tok.text)
+			}
+			a.expanding[tok.text] = true
+			var err = a.emit(body)
+			delete(a.expanding, tok.text)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var code []byte
+		var err error
+		if op, ok := lookupOpCode(tok.text); ok && isPushOpCode(op) {
+			if i+1 >= len(tokens) || tokens[i+1].line != tok.line {
+				return asmError(tok, ErrMissingData, "%s", tok.text)
+			}
+			i++
+			var data []byte
+			if data, err = a.data(tokens[i], true); err != nil {
+				return err
+			}
+			code, err = Compile(op, data)
+			tok = tokens[i]
+		} else if ok {
+			code = []byte{byte(op)}
+		} else if isInteger(tok.text) {
+			code, err = a.number(tok)
+		} else if tok.text[0] == '"' || tok.text[0] == '<' || strings.HasPrefix(tok.text, "0x") {
+			var data []byte
+			if data, err = a.data(tok, false); err != nil {
+				return err
+			}
+			code, err = Compile(OP_PUSHDATA, data)
+		} else {
+			return asmError(tok, ErrUnknownWord, "%s", tok.text)
+		}
+		if err != nil {
+			var asmErr *AsmError
+			if errors.As(err, &asmErr) {
+				return err
+			}
+			return asmError(tok, err, "%s", tok.text)
+		}
+		a.script = append(a.script, code...)
+		if len(a.script) > MaxScriptSize {
+			return asmError(tok, ErrScriptTooLarge, "%d bytes", len(a.script))
+		}
+	}
+	return nil
+}
+
+// number pushes an integer, -1 to 16 with their own opcodes.
+func (a *assembler) number(tok token) ([]byte, error) {
+	n, err := strconv.ParseInt(tok.text, 10, 64)
+	if err != nil {
+		return nil, asmError(tok, ErrInvalidLiteral, "%s is out of range", tok.text)
+	}
+	switch n {
+	case -1:
+		return []byte{OP_1NEGATE}, nil
+	case 0:
+		return []byte{OP_0}, nil
+	}
+	return Compile(OP_PUSHDATA, EncodeNum(n))
+}
+
+// data decodes a string, a parameter or hex data. Hex data needs the 0x prefix unless
+// bareHex is set.
+func (a *assembler) data(tok token, bareHex bool) ([]byte, error) {
+	switch {
+	case tok.text[0] == '"':
+		s, err := strconv.Unquote(tok.text)
+		if err != nil {
+			return nil, asmError(tok, ErrInvalidLiteral, "bad string %s", tok.text)
+		}
+		return []byte(s), nil
+	case tok.text[0] == '<':
+		var name = strings.TrimSuffix(strings.TrimPrefix(tok.text, "<"), ">")
+		if !strings.HasSuffix(tok.text, ">") || !isIdentifier(name) {
+			return nil, asmError(tok, ErrInvalidLiteral, "bad placeholder %s", tok.text)
+		}
+		data, ok := a.params[name]
+		if !ok {
+			return nil, asmError(tok, ErrMissingParam, "%s", name)
+		}
+		return data, nil
+	}
+	var digits, prefixed = strings.CutPrefix(tok.text, "0x")
+	if !prefixed && !bareHex {
+		return nil, asmError(tok, ErrInvalidLiteral, "%s", tok.text)
+	}
+	data, err := hex.DecodeString(digits)
+	if err != nil {
+		return nil, asmError(tok, ErrInvalidLiteral, "bad hex data %s", tok.text)
+	}
+	return data, nil
+}
@@ -0,0 +1,174 @@
+package script_vm
+
+import (
+	"fmt"
+)
+
+// Contract opcodes give contract code access to its call and to the chain state. They
+// fail in scripts executed without a Host.
+const (
+	OP_CALLER        = 0xC0 // Pushes the address of the caller
+	OP_CONTRACT      = 0xC1 // Pushes the address of the executed contract
+	OP_CALLVALUE     = 0xC2 // Pushes the coins sent to the contract by the call
+	OP_METHOD        = 0xC3 // Pushes the called method name
+	OP_ARG           = 0xC4 // Replaces the top index N with the N-th call argument
+	OP_ARGCOUNT      = 0xC5 // Pushes the number of call arguments
+	OP_BALANCE       = 0xC6 // Replaces the top address with its coin balance
+	OP_TRANSFER      = 0xC7 // Pops value and recipient, sends coins of the contract
+	OP_TOKENBALANCE  = 0xC8 // Replaces the top address with its balance of the contract token
+	OP_TOKENTRANSFER = 0xC9 // Pops value, recipient and sender, moves units of the contract token
+	OP_SLOAD         = 0xCA // Replaces the top key with its value in the contract state
+	OP_SSTORE        = 0xCB // Pops value and key, stores them in the contract state
+)
+
+// maxValueSize is the longest number accepted as a balance or transfer value.
+const maxValueSize = 8
+
+// Host is the environment a contract runs in. A host must apply the changes made by
+// the contract only after the whole execution succeeded.
+type Host interface {
+	Caller() []byte
+	Contract() []byte
+	CallValue() int64
+	Method() string
+	Args() [][]byte
+	Balance(address []byte) int64
+	Transfer(to []byte, value int64) error
+	TokenBalance(holder []byte) int64
+	TransferToken(from []byte, to []byte, value int64) error
+	// Load returns the value of key in the contract state, empty when it is not set.
+	Load(key []byte) []byte
+	// Store sets key in the contract state, an empty value deletes it.
+	Store(key []byte, value []byte) error
+}
+
+// contractHandler wraps a handler that needs the host of a contract.
+func contractHandler(handler func(ctx *handlerContext, host Host) error) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		if ctx.host == nil {
+			return fmt.Errorf("%s is only available to contracts", OpCodeNames[op.code])
+		}
+		return handler(ctx, ctx.host)
+	}
+}
+
+func (v *VM) popNum(maxSize int) (int64, error) {
+	top, err := v.stack.Pop()
+	if err != nil {
+		return 0, err
+	}
+	return DecodeNum(top, maxSize)
+}
+
+var contractHandlers = map[OPCode]opHandler{
+	OP_CALLER: contractHandler(func(ctx *handlerContext, host Host) error {
+		ctx.vm.stack.Push(host.Caller())
+		return nil
+	}),
+	OP_CONTRACT: contractHandler(func(ctx *handlerContext, host Host) error {
+		ctx.vm.stack.Push(host.Contract())
+		return nil
+	}),
+	OP_CALLVALUE: contractHandler(func(ctx *handlerContext, host Host) error {
+		ctx.vm.stack.Push(EncodeNum(host.CallValue()))
+		return nil
+	}),
+	OP_METHOD: contractHandler(func(ctx *handlerContext, host Host) error {
+		ctx.vm.stack.Push([]byte(host.Method()))
+		return nil
+	}),
+	OP_ARG: contractHandler(func(ctx *handlerContext, host Host) error {
+		index, err := ctx.vm.popNum(4)
+		if err != nil {
+			return err
+		}
+		var args = host.Args()
+		if index < 0 || index >= int64(len(args)) {
+			return fmt.Errorf("argument %d is out of range, the call has %d arguments", index, len(args))
+		}
+		ctx.vm.stack.Push(args[index])
+		return nil
+	}),
+	OP_ARGCOUNT: contractHandler(func(ctx *handlerContext, host Host) error {
+		ctx.vm.stack.Push(EncodeNum(int64(len(host.Args()))))
+		return nil
+	}),
+	OP_BALANCE: contractHandler(func(ctx *handlerContext, host Host) error {
+		address, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(host.Balance(address)))
+		return nil
+	}),
+	OP_TRANSFER: contractHandler(func(ctx *handlerContext, host Host) error {
+		value, err := ctx.vm.popNum(maxValueSize)
+		if err != nil {
+			return err
+		}
+		to, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		return host.Transfer(to, value)
+	}),
+	OP_TOKENBALANCE: contractHandler(func(ctx *handlerContext, host Host) error {
+		holder, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(EncodeNum(host.TokenBalance(holder)))
+		return nil
+	}),
+	OP_TOKENTRANSFER: contractHandler(func(ctx *handlerContext, host Host) error {
+		value, err := ctx.vm.popNum(maxValueSize)
+		if err != nil {
+			return err
+		}
+		to, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		from, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		return host.TransferToken(from, to, value)
+	}),
+	OP_SLOAD: contractHandler(func(ctx *handlerContext, host Host) error {
+		key, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(host.Load(key))
+		return nil
+	}),
+	OP_SSTORE: contractHandler(func(ctx *handlerContext, host Host) error {
+		value, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		key, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		if err := ctx.vm.useGas(GasStoreWord * words(len(value))); err != nil {
+			return err
+		}
+		return host.Store(key, value)
+	}),
+}
+
+// RunContract executes contract code with access to host. The contract succeeds when
+// it leaves a true value on top of the stack.
+func (v *VM) RunContract(code []byte, host Host, signedData []byte) ([]byte, error) {
+	err := v.ParseScript(code)
+	if err != nil {
+		return nil, err
+	}
+	return v.execute(&handlerContext{
+		vm:   v,
+		host: host,
+		tx:   TxContext{SignedData: signedData},
+	})
+}
@@ -0,0 +1,153 @@
+package script_vm
+
+import (
+	"encoding/hex"
+	"errors"
+)
+
+var ErrDebugFinished = errors.New("execution is finished")
+
+// TraceStep records one operation of a debugged execution. Stacks are hex items with
+// the top first, the skip state and the condition stack are taken before the operation.
+type TraceStep struct {
+	PC             int      `json:"pc"`
+	OpCode         string   `json:"opcode"`
+	Data           string   `json:"data,omitempty"`
+	Skipped        bool     `json:"skipped"`
+	ConditionStack []bool   `json:"condition_stack"`
+	StackBefore    []string `json:"stack_before"`
+	AltStackBefore []string `json:"alt_stack_before"`
+	StackAfter     []string `json:"stack_after"`
+	AltStackAfter  []string `json:"alt_stack_after"`
+	GasUsed        uint64   `json:"gas_used"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// Debugger executes the parsed operations of a VM one at a time and records a trace.
+// The program counter is the index of the next operation.
+type Debugger struct {
+	vm          *VM
+	ctx         *handlerContext
+	ops         []operation
+	pc          int
+	breakpoints map[int]bool
+	trace       []TraceStep
+	result      []byte
+	err         error
+	done        bool
+	// paused is set while Continue stopped at the breakpoint of the program counter
+	paused bool
+}
+
+// Debug takes the parsed operations of the VM for a step by step execution for the
+// spending transaction described by tx, they are not executed by Execute any more.
+func (v *VM) Debug(tx TxContext) *Debugger {
+	return v.debug(&handlerContext{
+		vm: v,
+		tx: tx,
+	})
+}
+
+func (v *VM) debug(ctx *handlerContext) *Debugger {
+	var d = Debugger{
+		vm:          v,
+		ctx:         ctx,
+		breakpoints: make(map[int]bool),
+	}
+	for op, ok := v.queue.Next(); ok; op, ok = v.queue.Next() {
+		d.ops = append(d.ops, op)
+	}
+	if len(d.ops) == 0 {
+		d.finish()
+	}
+	return &d
+}
+
+func hexItems(items [][]byte) []string {
+	var result = make([]string, 0, len(items))
+	for _, item := range items {
+		result = append(result, hex.EncodeToString(item))
+	}
+	return result
+}
+
+func (d *Debugger) finish() {
+	d.result, d.err = d.vm.result()
+	d.done = true
+}
+
+// Step executes the operation at the program counter and returns its trace record. The
+// last operation or a failing one finishes the execution.
+func (d *Debugger) Step() (*TraceStep, error) {
+	if d.done {
+		return nil, ErrDebugFinished
+	}
+	var op = d.ops[d.pc]
+	var step = TraceStep{
+		PC:             d.pc,
+		OpCode:         OpCodeNames[op.scriptCode],
+		Data:           hex.EncodeToString(op.data),
+		Skipped:        d.vm.skip && !op.condition,
+		ConditionStack: d.vm.conditionStack.ToArray(),
+		StackBefore:    hexItems(d.vm.stack.ToArray()),
+		AltStackBefore: hexItems(d.vm.altStack.ToArray()),
+	}
+	if step.OpCode == "" {
+		step.OpCode = OpCodeNames[op.code]
+	}
+	var err = d.vm.step(d.ctx, op)
+	d.paused = false
+	step.StackAfter = hexItems(d.vm.stack.ToArray())
+	step.AltStackAfter = hexItems(d.vm.altStack.ToArray())
+	step.GasUsed = d.vm.GasUsed()
+	d.pc++
+	if err != nil {
+		step.Error = err.Error()
+		d.err = err
+		d.done = true
+	} else if d.pc == len(d.ops) {
+		d.finish()
+	}
+	d.trace = append(d.trace, step)
+	return &step, nil
+}
+
+// Continue executes operations until the execution finishes or the program counter
+// reaches a breakpoint. It reports whether it stopped at a breakpoint, continuing from
+// it executes the operation of the breakpoint.
+func (d *Debugger) Continue() bool {
+	for !d.done {
+		if d.breakpoints[d.pc] && !d.paused {
+			d.paused = true
+			return true
+		}
+		d.Step()
+	}
+	return false
+}
+
+// SetBreakpoint stops Continue before the operation at pc.
+func (d *Debugger) SetBreakpoint(pc int) {
+	d.breakpoints[pc] = true
+}
+
+func (d *Debugger) ClearBreakpoint(pc int) {
+	delete(d.breakpoints, pc)
+}
+
+func (d *Debugger) PC() int {
+	return d.pc
+}
+
+func (d *Debugger) Done() bool {
+	return d.done
+}
+
+// Result is the result of a finished execution, the same as Execute returns.
+func (d *Debugger) Result() ([]byte, error) {
+	return d.result, d.err
+}
+
+func (d *Debugger) Trace() []TraceStep {
+	return d.trace
+}
@@ -0,0 +1,122 @@
+package script_vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	DefaultGasLimit = 1_000_000
+	MaxStackDepth   = 1000
+	MaxElementSize  = 520
+	MaxScriptSize   = 10_000
+)
+
+var (
+	ErrOutOfGas        = errors.New("out of gas")
+	ErrStackOverflow   = errors.New("stack depth limit exceeded")
+	ErrElementTooLarge = errors.New("stack element size limit exceeded")
+	ErrScriptTooLarge  = errors.New("script size limit exceeded")
+)
+
+// Gas costs of operations. Operations not listed in gasCosts cost GasBase, operations
+// skipped by a false branch cost GasBase as well.
+const (
+	GasBase      = 1
+	GasPushWord  = 1 // every started 32 bytes of pushed data
+	GasHash      = 30
+	GasCheckSig  = 100 // every public key of OP_CHECKMULTISIG costs GasCheckSig again
+	GasBalance   = 20
+	GasTransfer  = 100
+	GasLoad      = 50
+	GasStore     = 200
+	GasStoreWord = 20 // every started 32 bytes of a stored value
+)
+
+var gasCosts = map[OPCode]uint64{
+	OP_SHA256:              GasHash,
+	OP_HASH160:             GasHash,
+	OP_HASH256:             GasHash,
+	OP_RIPEMD160:           GasHash,
+	OP_SHA1:                GasHash,
+	OP_CHECKSIG:            GasCheckSig,
+	OP_CHECKSIGVERIFY:      GasCheckSig,
+	OP_CHECKMULTISIG:       GasCheckSig,
+	OP_CHECKMULTISIGVERIFY: GasCheckSig,
+	OP_BALANCE:             GasBalance,
+	OP_TOKENBALANCE:        GasBalance,
+	OP_TRANSFER:            GasTransfer,
+	OP_TOKENTRANSFER:       GasTransfer,
+	OP_SLOAD:               GasLoad,
+	OP_SSTORE:              GasStore,
+}
+
+// Limits bound the resources of one execution.
+type Limits struct {
+	Gas            uint64
+	MaxStackDepth  int
+	MaxElementSize int
+	MaxScriptSize  int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		Gas:            DefaultGasLimit,
+		MaxStackDepth:  MaxStackDepth,
+		MaxElementSize: MaxElementSize,
+		MaxScriptSize:  MaxScriptSize,
+	}
+}
+
+func words(size int) uint64 {
+	return uint64(size+31) / 32
+}
+
+// opGas is the cost of executing op.
+func opGas(op operation) uint64 {
+	if op.code == OP_PUSHDATA {
+		return GasBase + GasPushWord*words(len(op.data))
+	}
+	if cost, ok := gasCosts[op.code]; ok {
+		return cost
+	}
+	return GasBase
+}
+
+// SetLimits replaces the limits of the next executions, the gas used so far is kept.
+func (v *VM) SetLimits(limits Limits) {
+	v.limits = limits
+}
+
+// GasUsed is the gas consumed by the VM so far. An execution running out of gas uses
+// the whole limit.
+func (v *VM) GasUsed() uint64 {
+	return v.gasUsed
+}
+
+// useGas consumes gas or fails with ErrOutOfGas when the limit does not cover it.
+func (v *VM) useGas(gas uint64) error {
+	var left uint64
+	if v.gasUsed < v.limits.Gas {
+		left = v.limits.Gas - v.gasUsed
+	}
+	if gas > left {
+		v.gasUsed += left
+		return fmt.Errorf("%w: %d needed, %d left", ErrOutOfGas, gas, left)
+	}
+	v.gasUsed += gas
+	return nil
+}
+
+// checkStack fails when the last operation grew the stacks over the limits, the depth
+// limit counts the items of both the main and the alt stack.
+func (v *VM) checkStack() error {
+	if depth := v.stack.Size() + v.altStack.Size(); depth > v.limits.MaxStackDepth {
+		return fmt.Errorf("%w: %d elements", ErrStackOverflow, depth)
+	}
+	top, err := v.stack.Pick()
+	if err == nil && len(top) > v.limits.MaxElementSize {
+		return fmt.Errorf("%w: %d bytes", ErrElementTooLarge, len(top))
+	}
+	return nil
+}
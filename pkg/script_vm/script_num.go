@@ -0,0 +1,52 @@
+package script_vm
+
+import "fmt"
+
+// EncodeNum returns the minimal little endian sign and magnitude encoding of n, the
+// highest bit of the last byte is the sign. Zero is the empty array.
+func EncodeNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	var negative = n < 0
+	var magnitude = uint64(n)
+	if negative {
+		magnitude = -magnitude
+	}
+	var result = []byte{}
+	for magnitude > 0 {
+		result = append(result, byte(magnitude))
+		magnitude >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		result = append(result, 0)
+	}
+	if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+// DecodeNum reads a number encoded by EncodeNum that is at most maxSize bytes long.
+func DecodeNum(data []byte, maxSize int) (int64, error) {
+	if len(data) > maxSize {
+		return 0, fmt.Errorf("number of %d bytes exceeds %d bytes", len(data), maxSize)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var magnitude uint64
+	for i, b := range data {
+		if i == len(data)-1 {
+			b &= 0x7f
+		}
+		magnitude |= uint64(b) << (8 * i)
+	}
+	if magnitude > 1<<63-1 {
+		return 0, fmt.Errorf("number %x overflows int64", data)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		return -int64(magnitude), nil
+	}
+	return int64(magnitude), nil
+}
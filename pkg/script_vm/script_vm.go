@@ -5,10 +5,8 @@ import (
 	"blockchain_demo/pkg/utils"
 	"blockchain_demo/pkg/utils/queue"
 	"blockchain_demo/pkg/utils/stack"
-	"bufio"
 	"encoding/hex"
 	"errors"
-	"strings"
 
 	"fmt"
 	"slices"
@@ -143,10 +141,83 @@ var OpCodeNames = map[OPCode]string{
 	OP_RETURN:              "OP_RETURN",
 	OP_CHECKMULTISIG:       "OP_CHECKMULTISIG",
 	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	// arithmetic and splice opcodes, arithmetic.go
+	OP_CAT:                 "OP_CAT",
+	OP_SUBSTR:              "OP_SUBSTR",
+	OP_SIZE:                "OP_SIZE",
+	OP_AND:                 "OP_AND",
+	OP_OR:                  "OP_OR",
+	OP_XOR:                 "OP_XOR",
+	OP_1ADD:                "OP_1ADD",
+	OP_1SUB:                "OP_1SUB",
+	OP_NEGATE:              "OP_NEGATE",
+	OP_ABS:                 "OP_ABS",
+	OP_NOT:                 "OP_NOT",
+	OP_0NOTEQUAL:           "OP_0NOTEQUAL",
+	OP_ADD:                 "OP_ADD",
+	OP_SUB:                 "OP_SUB",
+	OP_BOOLAND:             "OP_BOOLAND",
+	OP_BOOLOR:              "OP_BOOLOR",
+	OP_NUMEQUAL:            "OP_NUMEQUAL",
+	OP_NUMEQUALVERIFY:      "OP_NUMEQUALVERIFY",
+	OP_NUMNOTEQUAL:         "OP_NUMNOTEQUAL",
+	OP_LESSTHAN:            "OP_LESSTHAN",
+	OP_GREATERTHAN:         "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL:     "OP_LESSTHANOREQUAL",
+	OP_GREATERTHANOREQUAL:  "OP_GREATERTHANOREQUAL",
+	OP_MIN:                 "OP_MIN",
+	OP_MAX:                 "OP_MAX",
+	OP_WITHIN:              "OP_WITHIN",
+	// stack opcodes, stack_ops.go
+	OP_DEPTH:               "OP_DEPTH",
+	OP_NIP:                 "OP_NIP",
+	OP_OVER:                "OP_OVER",
+	OP_PICK:                "OP_PICK",
+	OP_ROLL:                "OP_ROLL",
+	OP_ROT:                 "OP_ROT",
+	OP_SWAP:                "OP_SWAP",
+	OP_TUCK:                "OP_TUCK",
+	OP_TOALTSTACK:          "OP_TOALTSTACK",
+	OP_FROMALTSTACK:        "OP_FROMALTSTACK",
+	OP_2DROP:               "OP_2DROP",
+	OP_2DUP:                "OP_2DUP",
+	OP_3DUP:                "OP_3DUP",
+	OP_2OVER:               "OP_2OVER",
+	OP_2ROT:                "OP_2ROT",
+	OP_2SWAP:               "OP_2SWAP",
+	OP_RIPEMD160:           "OP_RIPEMD160",
+	OP_SHA1:                "OP_SHA1",
+	// locktime opcodes, timelock.go
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+	// contract opcodes, contract.go
+	OP_CALLER:              "OP_CALLER",
+	OP_CONTRACT:            "OP_CONTRACT",
+	OP_CALLVALUE:           "OP_CALLVALUE",
+	OP_METHOD:              "OP_METHOD",
+	OP_ARG:                 "OP_ARG",
+	OP_ARGCOUNT:            "OP_ARGCOUNT",
+	OP_BALANCE:             "OP_BALANCE",
+	OP_TRANSFER:            "OP_TRANSFER",
+	OP_TOKENBALANCE:        "OP_TOKENBALANCE",
+	OP_TOKENTRANSFER:       "OP_TOKENTRANSFER",
+	OP_SLOAD:               "OP_SLOAD",
+	OP_SSTORE:              "OP_SSTORE",
 }
 
 var NamesOpCode = utils.ReverseMap(OpCodeNames)
 
+// ErrEvalFalse fails an execution that does not leave a true value on top of the stack.
+var ErrEvalFalse = errors.New("top of stack is not true, execution failed")
+
+// MaxMultiSigKeys is the most public keys OP_CHECKMULTISIG checks signatures against.
+const MaxMultiSigKeys = 20
+
+var (
+	ErrPubKeyCount = errors.New("invalid public key count")
+	ErrSigCount    = errors.New("invalid signature count")
+)
+
 type operation struct{
 	scriptCode OPCode
 	code OPCode
@@ -158,16 +229,21 @@ type opHandler func(ctx *handlerContext, op operation) error
 
 type VM struct {
 	stack  *stack.Stack[[]byte]
+	altStack *stack.Stack[[]byte]
 	queue  *queue.Queue[operation]
 	signer sign.Signer
 	handlers map[OPCode]opHandler
 	conditionStack stack.Stack[bool]
 	skip bool
+	limits Limits
+	gasUsed uint64
+	flags VerifyFlags
 }
 
 type handlerContext struct {
-	vm         *VM
-	signedData []byte
+	vm   *VM
+	host Host
+	tx   TxContext
 }
 
 func IsActive(op OPCode) bool {
@@ -179,7 +255,22 @@ func IsActive(op OPCode) bool {
 	return false
 }
 
-var	handlers = map[OPCode]opHandler{
+// handlers executes every opcode, the groups declared in other files are added to the
+// core opcodes.
+var handlers = mergeHandlers(coreHandlers, arithmeticHandlers, stackHandlers, timelockHandlers, contractHandlers)
+
+// mergeHandlers returns one map of the handlers of all groups.
+func mergeHandlers(groups ...map[OPCode]opHandler) map[OPCode]opHandler {
+	var merged = map[OPCode]opHandler{}
+	for _, group := range groups {
+		for code, handler := range group {
+			merged[code] = handler
+		}
+	}
+	return merged
+}
+
+var	coreHandlers = map[OPCode]opHandler{
 		OP_PUSHDATA: func(ctx *handlerContext, op operation) error {
 			ctx.vm.stack.Push(op.data)
 			return nil
@@ -219,6 +310,7 @@ var	handlers = map[OPCode]opHandler{
 			}
 			cond, err := ctx.vm.conditionStack.Pick()
 			if err != nil {
+				ctx.vm.skip = false
 				return nil
 			}
 			ctx.vm.skip = !cond
@@ -278,7 +370,7 @@ var	handlers = map[OPCode]opHandler{
 			return nil
 		},
 		OP_VERIFY: func(ctx *handlerContext, op operation) error {
-			if ok, _, err := ctx.vm.isTopTrue(); err == nil || !ok {
+			if ok, _, err := ctx.vm.isTopTrue(); err != nil || !ok {
 				return fmt.Errorf("verify failed")
 			}
 			return nil
@@ -328,7 +420,7 @@ var	handlers = map[OPCode]opHandler{
 			return nil
 		},
 		OP_CHECKSIG: func(ctx *handlerContext, op operation) error {
-			ok, err := ctx.vm.checksig(ctx.signedData)
+			ok, err := ctx.vm.checksig(ctx.tx)
 			if err != nil {
 				return err
 			}
@@ -340,7 +432,7 @@ var	handlers = map[OPCode]opHandler{
 			return nil
 		},
 		OP_CHECKSIGVERIFY: func(ctx *handlerContext, op operation) error {
-			ok, err := ctx.vm.checksig(ctx.signedData)
+			ok, err := ctx.vm.checksig(ctx.tx)
 			if err != nil {
 				return err
 			}
@@ -350,7 +442,7 @@ var	handlers = map[OPCode]opHandler{
 			return nil
 		},
 		OP_CHECKMULTISIG: func(ctx *handlerContext, op operation) error {
-			ok, err := ctx.vm.checkmultisig(ctx.signedData)
+			ok, err := ctx.vm.checkmultisig(ctx.tx)
 			if err != nil {
 				return err
 			}
@@ -362,7 +454,7 @@ var	handlers = map[OPCode]opHandler{
 			return nil
 		},
 		OP_CHECKMULTISIGVERIFY: func(ctx *handlerContext, op operation) error {
-			ok, err := ctx.vm.checkmultisig(ctx.signedData)
+			ok, err := ctx.vm.checkmultisig(ctx.tx)
 			if err != nil {
 				return err
 			}
@@ -376,11 +468,14 @@ var	handlers = map[OPCode]opHandler{
 func New(signer sign.Signer) *VM {
 	return &VM{
 		stack:  stack.New[[]byte](),
+		altStack: stack.New[[]byte](),
 		signer: signer,
 		queue: queue.New[operation](),
 		handlers: handlers,
 		skip: false,
 		conditionStack: stack.Stack[bool]{},
+		limits: DefaultLimits(),
+		flags: DefaultFlags,
 	}
 }
 
@@ -420,7 +515,8 @@ func (v *VM) isTopTrue() (bool, []byte, error) {
 	return compare(top, make([]byte, len(top))) != 0, top, nil
 }
 
-func (v *VM) checksig(data []byte) (bool, error) {
+// checksig verifies a signature of the message tx requires for it.
+func (v *VM) checksig(tx TxContext) (bool, error) {
 	pubKey, err := v.stack.Pop()
 	if err != nil {
 		return false, err
@@ -430,32 +526,57 @@ func (v *VM) checksig(data []byte) (bool, error) {
 		return false, err
 	}
 
+	data, err := tx.signedMessage(signature)
+	if err != nil {
+		return false, err
+	}
 	return v.signer.Verify(data, signature, pubKey)
 }
 
-func (v *VM) checkmultisig(data []byte) (bool, error) {
-	count, err := v.stack.Pop()
+// checkmultisig verifies that each of the needed signatures matches another of the
+// public keys, the counts are script numbers below the keys and signatures.
+func (v *VM) checkmultisig(tx TxContext) (bool, error) {
+	count, err := v.popOperand()
 	if err != nil {
 		return false, err
 	}
-	pubkeys := make([][]byte, int(count[0]))
-	for i := 0; i < int(count[0]); i++ {
+	if count < 0 || count > MaxMultiSigKeys {
+		return false, fmt.Errorf("%w: %d", ErrPubKeyCount, count)
+	}
+	if int(count) > v.stack.Size() {
+		return false, fmt.Errorf("%w: %d public keys", stack.ErrEmpty, count)
+	}
+	if err := v.useGas(GasCheckSig * uint64(count)); err != nil {
+		return false, err
+	}
+	pubkeys := make([][]byte, int(count))
+	for i := range pubkeys {
 		pubKey, err := v.stack.Pop()
 		if err != nil {
 			return false, err
 		}
 		pubkeys[i] = pubKey
 	}
-	need, err := v.stack.Pop()
+	need, err := v.popOperand()
 	if err != nil {
 		return false, err
 	}
-	for i := 0; i < int(need[0]); i++ {
+	if need < 0 || need > count {
+		return false, fmt.Errorf("%w: %d of %d", ErrSigCount, need, count)
+	}
+	if int(need) > v.stack.Size() {
+		return false, fmt.Errorf("%w: %d signatures", stack.ErrEmpty, need)
+	}
+	for i := 0; i < int(need); i++ {
 		found := false
 		signature, err := v.stack.Pop()
 		if err != nil {
 			return false, err
 		}
+		data, err := tx.signedMessage(signature)
+		if err != nil {
+			return false, err
+		}
 		for k, pubKey := range pubkeys {
 			ok, err := v.signer.Verify(data, signature, pubKey)
 			if err == nil && ok {
@@ -472,7 +593,18 @@ func (v *VM) checkmultisig(data []byte) (bool, error) {
 	return true, nil
 }
 
+// readPush returns length bytes of pushed data starting at from.
+func readPush(script []byte, from int, length int) ([]byte, error) {
+	if length > len(script)-from {
+		return nil, fmt.Errorf("push of %d bytes at %d exceeds the script", length, from)
+	}
+	return script[from : from+length], nil
+}
+
 func (v *VM) ParseScript(script []byte) error {
+	if len(script) > v.limits.MaxScriptSize {
+		return fmt.Errorf("%w: %d bytes", ErrScriptTooLarge, len(script))
+	}
 	pointer := 0
 	for pointer < len(script) {
 		inc := 1
@@ -482,25 +614,33 @@ func (v *VM) ParseScript(script []byte) error {
 		case opCode == OP_0:
 			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer : pointer+1]})
 		case opCode == OP_1NEGATE:
-			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer : pointer+1]})
+			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: EncodeNum(-1)})
 		case opCode >= OP_1 && opCode <= OP_16:
 			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: []byte{byte(opCode) - OP_1 + 1}})
 		case opCode >= OP_PUSHDATA && opCode <= OP_PUSHDATA_4B:
-			dataLength = int(opCode)
-			inc = dataLength + 1
-			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer+1 : pointer+1+dataLength]})
-		case opCode == OP_PUSHDATA1:
-			dataLength = int(script[pointer+1])
-			inc = dataLength + 2
-			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer+2 : pointer+2+dataLength]})
-		case opCode == OP_PUSHDATA2:
-			dataLength = int(script[pointer+1]) | int(script[pointer+2])<<8
-			inc = dataLength + 3
-			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer+3 : pointer+3+dataLength]})
-		case opCode == OP_PUSHDATA4:
-			dataLength = int(script[pointer+1]) | int(script[pointer+2])<<8 | int(script[pointer+3])<<16 | int(script[pointer+4])<<24
-			inc = dataLength + 5
-			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: script[pointer+5 : pointer+5+dataLength]})
+			data, err := readPush(script, pointer+1, int(opCode))
+			if err != nil {
+				return err
+			}
+			inc = len(data) + 1
+			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: data})
+		case opCode == OP_PUSHDATA1 || opCode == OP_PUSHDATA2 || opCode == OP_PUSHDATA4:
+			sizeBytes := map[OPCode]int{OP_PUSHDATA1: 1, OP_PUSHDATA2: 2, OP_PUSHDATA4: 4}[opCode]
+			if pointer+1+sizeBytes > len(script) {
+				return fmt.Errorf("%s at %d is truncated", OpCodeNames[opCode], pointer)
+			}
+			for i := 0; i < sizeBytes; i++ {
+				dataLength |= int(script[pointer+1+i]) << (8 * i)
+			}
+			if dataLength > v.limits.MaxElementSize {
+				return fmt.Errorf("%w: push of %d bytes at %d", ErrElementTooLarge, dataLength, pointer)
+			}
+			data, err := readPush(script, pointer+1+sizeBytes, dataLength)
+			if err != nil {
+				return err
+			}
+			inc = dataLength + sizeBytes + 1
+			v.queue.Enqueue(operation{scriptCode: opCode, code: OP_PUSHDATA, data: data})
 		case opCode == OP_IF || opCode == OP_NOTIF:
 			v.queue.Enqueue(operation{scriptCode: opCode, code: opCode, data: nil, condition: true})
 		case opCode == OP_ELSE:
@@ -521,6 +661,8 @@ func (v *VM) ParseScript(script []byte) error {
 func Compile(op OPCode, data []byte) ([]byte, error) {
 	if op == OP_PUSHDATA && len(data) == 0 {
 		return nil, errors.New("OP_PUSHDATA cannot be used with empty data")
+	} else if op == OP_PUSHDATA && len(data) == 1 && data[0] == 0 {
+		return []byte{OP_0}, nil
 	} else if op == OP_PUSHDATA && len(data) == 1 && data[0] <= 16 {
 		// If data is a single byte between 0 and 16, use the corresponding OP_1 to OP_16
 		return []byte{byte(OP_1 + data[0] - 1)}, nil
@@ -538,75 +680,74 @@ func Compile(op OPCode, data []byte) ([]byte, error) {
 	return []byte{byte(op)}, nil
 }
 
+// ParseString compiles a script written in the assembler syntax of Assemble, without
+// parameters. As in the one opcode per line format, hex data after a non push opcode
+// starting a line is ignored, so "OP_DUP 0102" is only OP_DUP.
 func (v *VM) ParseString(s string) ([]byte, error) {
-	row := 1
-	script := make([]byte, 0)
-	scanner := bufio.NewScanner(strings.NewReader(s))
-	for scanner.Scan() {
-		line := scanner.Text()
-		line = strings.TrimSpace(line)
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue // Skip empty lines and comments
-		}
-		result := strings.Split(line, " ")
-		op := result[0]
-		var data []byte
-		if len(result) > 1 {
-			var err error
-			data, err = hex.DecodeString(result[1])
-			if err != nil {
-				return nil, fmt.Errorf("failed to decode hex data in row %v: %w", row, err)
-			}
-		}
-		opCode, ok := NamesOpCode[op]
-		if !ok {	
-			return nil, fmt.Errorf("failed to decode hex data in row %v: %s", row, op)
-		}
-		scriptOp, err := Compile(opCode, data)
-		if err != nil {
-			return nil, fmt.Errorf("failed to compile opcode %s in row %v: %w", op, row, err)
-		}
-		script = append(script, scriptOp...)
-		row++
-	}	
-	return script, nil
+	return assemble(s, nil, true)
 }
 
-func (v *VM) Run(script []byte, signedData []byte) ([]byte, error) {
+func (v *VM) Run(script []byte, tx TxContext) ([]byte, error) {
 	err := v.ParseScript(script)
 	if err != nil {
 		return nil, err
 	}
-	res, err := v.Execute(signedData)
+	res, err := v.Execute(tx)
 	if err != nil {	
 		return res, err
 	}
 	return res, nil
 }
 
-func (v *VM) Execute(signedData []byte) ([]byte, error) {
-
+// Execute executes the parsed operations for the spending transaction described by tx.
+func (v *VM) Execute(tx TxContext) ([]byte, error) {
 	ctx := &handlerContext{
-		vm:         v,
-		signedData: signedData,
+		vm: v,
+		tx: tx,
 	}
+	return v.execute(ctx)
+}
+
+func (v *VM) execute(ctx *handlerContext) ([]byte, error) {
+	if err := v.run(ctx); err != nil {
+		return nil, err
+	}
+	return v.result()
+}
 
+// run executes the parsed operations without checking the result.
+func (v *VM) run(ctx *handlerContext) error {
 	for op := range v.queue.Iterator() {
-		if v.skip && !op.condition {
-			continue
+		if err := v.step(ctx, op); err != nil {
+			return err
 		}
-		handler, ok := v.handlers[op.code]
-		if ok {
-			err := handler(ctx, op)
-			if err != nil {
-				return nil, err
-			}
+	}
+	return nil
+}
+
+// step executes op, an operation skipped by a false branch only consumes gas.
+func (v *VM) step(ctx *handlerContext, op operation) error {
+	if v.skip && !op.condition {
+		return v.useGas(GasBase)
+	}
+	if err := v.useGas(opGas(op)); err != nil {
+		return fmt.Errorf("%s: %w", OpCodeNames[op.code], err)
+	}
+	handler, ok := v.handlers[op.code]
+	if ok {
+		err := handler(ctx, op)
+		if err != nil {
+			return err
 		}
 	}
+	return v.checkStack()
+}
 
+// result pops the top of the stack after the last operation, it must be true.
+func (v *VM) result() ([]byte, error) {
 	ok, top, err := v.isTopTrue()
 	if err != nil || !ok {
-		return top, fmt.Errorf("top of stack is not true, execution failed")
+		return top, ErrEvalFalse
 	}
 	return top, nil
 }
@@ -6,11 +6,18 @@ import (
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/coin_transfer"
 	"blockchain_demo/pkg/utils"
+	"blockchain_demo/pkg/utils/stack"
 	"blockchain_demo/pkg/wallet"
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -84,7 +91,7 @@ func TestVM_P2PKH(t *testing.T) {
 	fmt.Printf("Check hash: %#x\n", signedData)
 	fmt.Println("Parsed script:")
 	fmt.Println(vm)
-	_, err = vm.Execute(signedData[:])
+	_, err = vm.Execute(TxContext{SignedData: signedData[:]})
 	if err != nil {
 		t.Fatalf("VM failed: %v", err)
 	}	
@@ -114,7 +121,7 @@ func TestVM_AllOpcodes(t *testing.T) {
 		wantErr bool
 		}{
 		{"OP_0", []byte{OP_0}, []byte{OP_0}, false},
-		{"OP_1NEGATE", []byte{OP_1NEGATE}, []byte{OP_1NEGATE}, false},
+		{"OP_1NEGATE", []byte{OP_1NEGATE}, []byte{0x81}, false},
 		{"OP_1", []byte{OP_1}, []byte{1}, false},
 		{"OP_16", []byte{OP_16}, []byte{16}, false},
 		{"OP_PUSHDATA0_01", append([]byte{1}, []byte{0xAB}...), []byte{0xAB}, false},
@@ -139,7 +146,7 @@ func TestVM_AllOpcodes(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			vm := New(&signer)
 			signedData := tx.GetTxId()
-			res, err := vm.Run(tc.script, signedData[:])
+			res, err := vm.Run(tc.script, TxContext{SignedData: signedData[:]})
 			if tc.wantErr {
 				if err == nil {
 					t.Errorf("expected error, got nil")
@@ -203,7 +210,7 @@ func TestVM_IfElse(t *testing.T) {
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
 			vm := New(&signer)
-			res, err := vm.Run(tc.script, tx)
+			res, err := vm.Run(tc.script, TxContext{SignedData: tx})
 			if tc.wantErr {
 				if err == nil {
 					t.Errorf("expected error, got nil")
@@ -269,7 +276,7 @@ func TestVM_CheckMultiSig(t *testing.T) {
 
 	vm := New(&signer)
 	signedData := tx.GetTxId()
-	_, err = vm.Run(script, signedData[:])
+	_, err = vm.Run(script, TxContext{SignedData: signedData[:]})
 	if err != nil {
 		t.Fatalf("VM failed: %v", err)
 	}
@@ -466,6 +473,97 @@ func TestVM_String_ParseString_RoundTrip(t *testing.T) {
 	}
 }
 
+func TestAssemble(t *testing.T) {
+	pubKey := bytes.Repeat([]byte{0xab}, 32)
+	params := map[string][]byte{"pubkey": pubKey, "zero": {0x00}}
+	cases := []struct {
+		name     string
+		src      string
+		expected []byte
+	}{
+		{"numbers", "0 -1 1 16 17 -2 1000", []byte{OP_0, OP_1NEGATE, OP_1, OP_16, 1, 0x11, 1, 0x82, 2, 0xe8, 0x03}},
+		{"opcodes_without_prefix", "DUP OP_DROP", []byte{OP_DUP, OP_DROP}},
+		{"hex", "0x0102 0x00", []byte{2, 1, 2, OP_0}},
+		{"strings", `"ab" "a b#\"" "\x05"`, []byte{2, 'a', 'b', 5, 'a', ' ', 'b', '#', '"', OP_5}},
+		{"placeholders", "<pubkey> CHECKSIG <zero>", append(append([]byte{32}, pubKey...), OP_CHECKSIG, OP_0)},
+		{"push_opcodes", `OP_PUSHDATA1 0a OP_PUSHDATA "x" OP_PUSHDATA <zero>`, []byte{OP_PUSHDATA1, 1, 0x0a, 1, 'x', OP_0}},
+		{"comments", "1 # 2\n# 3\n  4 #5", []byte{OP_1, OP_4}},
+		{"macros", "#define TWO 2\n#define ADD_TWO TWO ADD # comment\n1 ADD_TWO ADD_TWO 5 EQUAL", []byte{OP_1, OP_2, OP_ADD, OP_2, OP_ADD, OP_5, OP_EQUAL}},
+		{"empty_macro", "#define NOTHING\nNOTHING 1", []byte{OP_1}},
+		{"legacy_string", "OP_DUP  #0x76\nOP_PUSHDATA 0102 #0x2\nOP_PUSHDATA 00 #0x0", []byte{OP_DUP, 2, 1, 2, OP_0}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Assemble(tc.src, params)
+			if err != nil {
+				t.Fatalf("Assemble failed: %v", err)
+			}
+			if !bytes.Equal(got, tc.expected) {
+				t.Errorf("Assemble = %x, want %x", got, tc.expected)
+			}
+		})
+	}
+
+	// ParseString ignores the hex argument of a non push opcode like the old format did
+	legacy := "OP_DUP 0102\nOP_HASH160 abcd\nOP_PUSHDATA 0102\nOP_1 OP_2\nOP_EQUAL 10"
+	if got, err := New(nil).ParseString(legacy); err != nil || !bytes.Equal(got, []byte{OP_DUP, OP_HASH160, 2, 1, 2, OP_1, OP_2, OP_EQUAL}) {
+		t.Errorf("ParseString(legacy) = %x, %v", got, err)
+	}
+	if got, err := Assemble("OP_DUP 0102", nil); err != nil || !bytes.Equal(got, []byte{OP_DUP, 1, 0x66}) {
+		t.Errorf("Assemble(OP_DUP 0102) = %x, %v, want 760166", got, err)
+	}
+
+	errCases := []struct {
+		name   string
+		src    string
+		want   error
+		line   int
+		column int
+	}{
+		{"unknown_word", "1\n  DUP FOO", ErrUnknownWord, 2, 7},
+		{"bad_hex", "0x0g", ErrInvalidLiteral, 1, 1},
+		{"bare_hex", "abcd", ErrUnknownWord, 1, 1},
+		{"unterminated_string", `1 "abc`, ErrInvalidLiteral, 1, 3},
+		{"missing_param", "DUP <sig>", ErrMissingParam, 1, 5},
+		{"bad_placeholder", "<a b>", ErrInvalidLiteral, 1, 1},
+		{"push_without_data", "OP_PUSHDATA\n01", ErrMissingData, 1, 1},
+		{"empty_push", `1 ""`, nil, 1, 3},
+		{"out_of_range", "99999999999999999999", ErrInvalidLiteral, 1, 1},
+		{"macro_opcode_name", "#define DUP 1", ErrInvalidMacro, 1, 9},
+		{"macro_redefined", "#define A 1\n #define A 2", ErrInvalidMacro, 2, 10},
+		{"macro_recursion", "#define A B\n#define B A\nA", ErrMacroRecursion, 2, 11},
+		{"error_in_macro", "#define A 1 FOO\nA", ErrUnknownWord, 1, 13},
+		{"macro_expansion_limit", "#define A 1 DROP\n#define B A A A A A A A A A A\n#define C B B B B B B B B B B\n#define D C C C C C C C C C C\n#define E D D D D D D D D D D\nE", ErrScriptTooLarge, 1, 11},
+	}
+	for _, tc := range errCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Assemble(tc.src, params)
+			var asmErr *AsmError
+			if !errors.As(err, &asmErr) {
+				t.Fatalf("Assemble error = %v, want an *AsmError", err)
+			}
+			if tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("Assemble error = %v, want %v", err, tc.want)
+			}
+			if asmErr.Line != tc.line || asmErr.Column != tc.column {
+				t.Errorf("error at %d:%d, want %d:%d (%v)", asmErr.Line, asmErr.Column, tc.line, tc.column, err)
+			}
+			if prefix := fmt.Sprintf("line %d:%d: ", tc.line, tc.column); !strings.HasPrefix(err.Error(), prefix) {
+				t.Errorf("error %q does not start with %q", err, prefix)
+			}
+		})
+	}
+
+	// assembled scripts run like parsed ones
+	script, err := Assemble("#define DOUBLE DUP ADD\n3 DOUBLE <six> EQUAL", map[string][]byte{"six": {6}})
+	if err != nil {
+		t.Fatalf("Assemble failed: %v", err)
+	}
+	if _, err := New(nil).Run(script, TxContext{}); err != nil {
+		t.Errorf("assembled script failed: %v", err)
+	}
+}
+
 func TestVM_Parse_And_Compile(t *testing.T) {
 	signer := sign_ed25519.Ed25519Signer{}	
 
@@ -494,8 +592,626 @@ func TestVM_Parse_And_Compile(t *testing.T) {
 	if err != nil {	
 		t.Fatalf("failed to parse script: %v", err)
 	}
-	_, err = vm2.Execute(signedData[:])
+	_, err = vm2.Execute(TxContext{SignedData: signedData[:]})
 	if err != nil {
 		t.Fatalf("VM failed: %v", err)
 	}	
 }
+
+func TestScriptNum(t *testing.T) {
+	cases := []struct {
+		n    int64
+		want []byte
+	}{
+		{0, []byte{}},
+		{1, []byte{0x01}},
+		{-1, []byte{0x81}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x00}},
+		{-128, []byte{0x80, 0x80}},
+		{255, []byte{0xff, 0x00}},
+		{256, []byte{0x00, 0x01}},
+		{1<<63 - 1, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x7f}},
+	}
+	for _, tc := range cases {
+		got := EncodeNum(tc.n)
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("EncodeNum(%d) = %x, want %x", tc.n, got, tc.want)
+		}
+		n, err := DecodeNum(got, 8)
+		if err != nil || n != tc.n {
+			t.Errorf("DecodeNum(%x) = %d, %v, want %d", got, n, err, tc.n)
+		}
+	}
+	if _, err := DecodeNum([]byte{1, 2, 3, 4, 5}, 4); err == nil {
+		t.Errorf("expected error for a number above the size limit")
+	}
+}
+
+func TestVM_Arithmetic(t *testing.T) {
+	push := func(n int64) []byte {
+		if n == 0 {
+			return []byte{OP_0}
+		}
+		script, _ := Compile(OP_PUSHDATA, EncodeNum(n))
+		return script
+	}
+	cases := []struct {
+		name    string
+		script  [][]byte
+		want    []byte
+		wantErr bool
+	}{
+		{"OP_ADD", [][]byte{push(2), push(3), {OP_ADD}}, EncodeNum(5), false},
+		{"OP_ADD_negative", [][]byte{push(-200), push(72), {OP_ADD}}, EncodeNum(-128), false},
+		{"OP_ADD_overflow_result", [][]byte{push(0x7fffffff), push(1), {OP_ADD}}, EncodeNum(0x80000000), false},
+		{"OP_ADD_overflow_operand", [][]byte{push(0x7fffffff), push(1), {OP_ADD}, push(1), {OP_ADD}}, nil, true},
+		{"OP_SUB", [][]byte{push(2), push(3), {OP_SUB}}, EncodeNum(-1), false},
+		{"OP_1ADD", [][]byte{push(-1), {OP_1ADD}}, EncodeNum(0), false},
+		{"OP_1SUB", [][]byte{push(0), {OP_1SUB}}, EncodeNum(-1), false},
+		{"OP_NEGATE", [][]byte{push(5), {OP_NEGATE}}, EncodeNum(-5), false},
+		{"OP_ABS", [][]byte{push(-5), {OP_ABS}}, EncodeNum(5), false},
+		{"OP_NOT", [][]byte{push(7), {OP_NOT}}, EncodeNum(0), false},
+		{"OP_NOT_negative_zero", [][]byte{{1, 0x80}, {OP_NOT}}, EncodeNum(1), false},
+		{"OP_0NOTEQUAL", [][]byte{push(7), {OP_0NOTEQUAL}}, EncodeNum(1), false},
+		{"OP_BOOLAND", [][]byte{push(1), push(0), {OP_BOOLAND}}, EncodeNum(0), false},
+		{"OP_BOOLOR", [][]byte{push(1), push(0), {OP_BOOLOR}}, EncodeNum(1), false},
+		{"OP_NUMEQUAL_non_minimal", [][]byte{{2, 0x05, 0x00}, push(5), {OP_NUMEQUAL}}, EncodeNum(1), false},
+		{"OP_NUMEQUALVERIFY", [][]byte{push(5), push(5), {OP_NUMEQUALVERIFY}, push(1)}, EncodeNum(1), false},
+		{"OP_NUMEQUALVERIFY_false", [][]byte{push(5), push(6), {OP_NUMEQUALVERIFY}, push(1)}, nil, true},
+		{"OP_NUMNOTEQUAL", [][]byte{push(5), push(6), {OP_NUMNOTEQUAL}}, EncodeNum(1), false},
+		{"OP_LESSTHAN", [][]byte{push(5), push(6), {OP_LESSTHAN}}, EncodeNum(1), false},
+		{"OP_GREATERTHAN", [][]byte{push(5), push(6), {OP_GREATERTHAN}}, EncodeNum(0), false},
+		{"OP_LESSTHANOREQUAL", [][]byte{push(6), push(6), {OP_LESSTHANOREQUAL}}, EncodeNum(1), false},
+		{"OP_GREATERTHANOREQUAL", [][]byte{push(-7), push(6), {OP_GREATERTHANOREQUAL}}, EncodeNum(0), false},
+		{"OP_MIN", [][]byte{push(-7), push(6), {OP_MIN}}, EncodeNum(-7), false},
+		{"OP_MAX", [][]byte{push(-7), push(6), {OP_MAX}}, EncodeNum(6), false},
+		{"OP_WITHIN", [][]byte{push(5), push(5), push(6), {OP_WITHIN}}, EncodeNum(1), false},
+		{"OP_WITHIN_upper", [][]byte{push(6), push(5), push(6), {OP_WITHIN}}, EncodeNum(0), false},
+		{"OP_ADD_missing_operand", [][]byte{push(5), {OP_ADD}}, nil, true},
+		{"OP_CAT", [][]byte{{2, 0xaa, 0xbb}, {1, 0xcc}, {OP_CAT}}, []byte{0xaa, 0xbb, 0xcc}, false},
+		{"OP_CAT_too_large", [][]byte{{OP_PUSHDATA2, 0x08, 0x02}, make([]byte, MaxElementSize), {OP_DUP, OP_CAT}}, nil, true},
+		{"OP_SUBSTR", [][]byte{{4, 0xaa, 0xbb, 0xcc, 0xdd}, push(1), push(2), {OP_SUBSTR}}, []byte{0xbb, 0xcc}, false},
+		{"OP_SUBSTR_out_of_range", [][]byte{{2, 0xaa, 0xbb}, push(1), push(2), {OP_SUBSTR}}, nil, true},
+		{"OP_SIZE", [][]byte{{3, 0xaa, 0xbb, 0xcc}, {OP_SIZE}}, EncodeNum(3), false},
+		{"OP_AND", [][]byte{{2, 0x0f, 0xf0}, {2, 0xff, 0x30}, {OP_AND}}, []byte{0x0f, 0x30}, false},
+		{"OP_OR", [][]byte{{2, 0x0f, 0xf0}, {2, 0xf0, 0x01}, {OP_OR}}, []byte{0xff, 0xf1}, false},
+		{"OP_XOR", [][]byte{{2, 0x0f, 0xf0}, {2, 0xff, 0xf0}, {OP_XOR}}, []byte{0xf0, 0x00}, false},
+		{"OP_XOR_size_mismatch", [][]byte{{2, 0x0f, 0xf0}, {1, 0xff}, {OP_XOR}}, nil, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := New(nil).Run(bytes.Join(tc.script, nil), TxContext{})
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("expected error, got %x", res)
+				}
+				return
+			}
+			// a false result fails the execution but is still returned
+			if !bytes.Equal(res, tc.want) {
+				t.Errorf("expected %x, got %x (%v)", tc.want, res, err)
+			}
+		})
+	}
+}
+
+func TestVM_ParseScript_TruncatedPush(t *testing.T) {
+	scripts := [][]byte{
+		{0x05, 0x01, 0x02},
+		{OP_PUSHDATA1},
+		{OP_PUSHDATA1, 0x03, 0x01},
+		{OP_PUSHDATA2, 0xff},
+		{OP_PUSHDATA4, 0xff, 0xff, 0xff, 0xff},
+	}
+	for _, script := range scripts {
+		if err := New(nil).ParseScript(script); err == nil {
+			t.Errorf("expected error for truncated script %x", script)
+		}
+	}
+}
+
+func TestVM_Gas(t *testing.T) {
+	// OP_1 and OP_2 push one byte for 2 gas each, OP_NOP costs 1
+	script := []byte{OP_1, OP_NOP, OP_2, OP_DROP}
+	vm := New(nil)
+	if _, err := vm.Run(script, TxContext{}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.GasUsed() != 6 {
+		t.Errorf("GasUsed = %d, want 6", vm.GasUsed())
+	}
+
+	// the skipped OP_SHA256 costs GasBase instead of GasHash
+	vm = New(nil)
+	if _, err := vm.Run([]byte{OP_0, OP_IF, OP_SHA256, OP_ENDIF, OP_1}, TxContext{}); err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+	if vm.GasUsed() != 2+1+GasBase+1+2 {
+		t.Errorf("GasUsed = %d, want %d", vm.GasUsed(), 2+1+GasBase+1+2)
+	}
+
+	vm = New(nil)
+	limits := DefaultLimits()
+	limits.Gas = 5
+	vm.SetLimits(limits)
+	if _, err := vm.Run(script, TxContext{}); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("Run = %v, want ErrOutOfGas", err)
+	}
+	if vm.GasUsed() != 5 {
+		t.Errorf("GasUsed = %d after running out of gas, want 5", vm.GasUsed())
+	}
+}
+
+func TestVM_Limits(t *testing.T) {
+	if err := New(nil).ParseScript(make([]byte, MaxScriptSize+1)); !errors.Is(err, ErrScriptTooLarge) {
+		t.Errorf("ParseScript = %v, want ErrScriptTooLarge", err)
+	}
+	push, _ := Compile(OP_PUSHDATA, make([]byte, MaxElementSize+1))
+	if err := New(nil).ParseScript(push); !errors.Is(err, ErrElementTooLarge) {
+		t.Errorf("ParseScript = %v, want ErrElementTooLarge", err)
+	}
+	if err := New(nil).ParseScript([]byte{OP_PUSHDATA4, 0xff, 0xff, 0xff, 0xff}); !errors.Is(err, ErrElementTooLarge) {
+		t.Errorf("ParseScript = %v, want ErrElementTooLarge", err)
+	}
+
+	script := []byte{OP_1}
+	for i := 0; i < MaxStackDepth; i++ {
+		script = append(script, OP_DUP)
+	}
+	if _, err := New(nil).Run(script, TxContext{}); !errors.Is(err, ErrStackOverflow) {
+		t.Errorf("Run = %v, want ErrStackOverflow", err)
+	}
+	if _, err := New(nil).Run(script[:MaxStackDepth], TxContext{}); err != nil {
+		t.Errorf("Run at the depth limit failed: %v", err)
+	}
+}
+
+type testHost struct {
+	coins     map[string]int64
+	tokens    map[string]int64
+	state     map[string][]byte
+	transfers int
+}
+
+func (h *testHost) Caller() []byte    { return []byte("caller") }
+func (h *testHost) Contract() []byte  { return []byte("contract") }
+func (h *testHost) CallValue() int64  { return 5 }
+func (h *testHost) Method() string    { return "pay" }
+func (h *testHost) Args() [][]byte    { return [][]byte{[]byte("bob"), EncodeNum(300)} }
+func (h *testHost) Balance(address []byte) int64 {
+	return h.coins[string(address)]
+}
+func (h *testHost) Transfer(to []byte, value int64) error {
+	if h.coins["contract"] < value {
+		return fmt.Errorf("contract balance is too low")
+	}
+	h.coins["contract"] -= value
+	h.coins[string(to)] += value
+	h.transfers++
+	return nil
+}
+func (h *testHost) TokenBalance(holder []byte) int64 {
+	return h.tokens[string(holder)]
+}
+func (h *testHost) TransferToken(from []byte, to []byte, value int64) error {
+	h.tokens[string(from)] -= value
+	h.tokens[string(to)] += value
+	return nil
+}
+
+func (h *testHost) Load(key []byte) []byte {
+	return h.state[string(key)]
+}
+func (h *testHost) Store(key []byte, value []byte) error {
+	h.state[string(key)] = value
+	return nil
+}
+
+func TestVM_RunContract(t *testing.T) {
+	code, err := New(nil).ParseString(`
+		OP_METHOD
+		OP_PUSHDATA 706179
+		OP_EQUALVERIFY
+		OP_0
+		OP_ARG
+		OP_1
+		OP_ARG
+		OP_TRANSFER
+		OP_CALLER
+		OP_0
+		OP_ARG
+		OP_CALLVALUE
+		OP_TOKENTRANSFER
+		OP_ARGCOUNT
+	`)
+	if err != nil {
+		t.Fatalf("ParseString failed: %v", err)
+	}
+	host := &testHost{coins: map[string]int64{"contract": 1000}, tokens: map[string]int64{"caller": 10}}
+	res, err := New(nil).RunContract(code, host, nil)
+	if err != nil {
+		t.Fatalf("RunContract failed: %v", err)
+	}
+	if !bytes.Equal(res, []byte{2}) || host.coins["bob"] != 300 || host.tokens["bob"] != 5 || host.tokens["caller"] != 5 {
+		t.Errorf("unexpected result %x, coins %v, tokens %v", res, host.coins, host.tokens)
+	}
+
+	host = &testHost{coins: map[string]int64{"contract": 100}, tokens: map[string]int64{}}
+	if _, err := New(nil).RunContract(code, host, nil); err == nil || host.transfers != 0 {
+		t.Errorf("expected error for a transfer above the contract balance")
+	}
+	if _, err := New(nil).Run([]byte{OP_CALLER}, TxContext{}); err == nil {
+		t.Errorf("expected error for a contract opcode outside of a contract")
+	}
+}
+
+func TestVM_RunContract_State(t *testing.T) {
+	code, err := New(nil).ParseString(`
+		OP_1
+		OP_PUSHDATA 2a
+		OP_SSTORE
+		OP_1
+		OP_SLOAD
+	`)
+	if err != nil {
+		t.Fatalf("ParseString failed: %v", err)
+	}
+	host := &testHost{state: map[string][]byte{}}
+	res, err := New(nil).RunContract(code, host, nil)
+	if err != nil || !bytes.Equal(res, []byte{0x2a}) || !bytes.Equal(host.state["\x01"], []byte{0x2a}) {
+		t.Errorf("RunContract = %x, %v, state %v", res, err, host.state)
+	}
+}
+
+// parseTestScript compiles the short script notation of testdata/script_tests.json.
+func parseTestScript(asm string) ([]byte, error) {
+	script := []byte{}
+	for _, word := range strings.Fields(asm) {
+		if n, err := strconv.ParseInt(word, 10, 64); err == nil {
+			switch {
+			case n == -1:
+				script = append(script, OP_1NEGATE)
+			case n == 0:
+				script = append(script, OP_0)
+			case n >= 1 && n <= 16:
+				script = append(script, byte(OP_1+n-1))
+			default:
+				push, err := Compile(OP_PUSHDATA, EncodeNum(n))
+				if err != nil {
+					return nil, err
+				}
+				script = append(script, push...)
+			}
+			continue
+		}
+		if strings.HasPrefix(word, "0x") {
+			raw, err := hex.DecodeString(word[2:])
+			if err != nil {
+				return nil, fmt.Errorf("bad raw bytes %s: %w", word, err)
+			}
+			script = append(script, raw...)
+			continue
+		}
+		if len(word) >= 2 && strings.HasPrefix(word, "'") && strings.HasSuffix(word, "'") {
+			if len(word) == 2 {
+				script = append(script, OP_0)
+				continue
+			}
+			push, err := Compile(OP_PUSHDATA, []byte(word[1:len(word)-1]))
+			if err != nil {
+				return nil, err
+			}
+			script = append(script, push...)
+			continue
+		}
+		code, ok := NamesOpCode[word]
+		if !ok {
+			code, ok = NamesOpCode["OP_"+word]
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown word %s", word)
+		}
+		script = append(script, byte(code))
+	}
+	return script, nil
+}
+
+// scriptResult names the outcome of an execution the way script_tests.json does.
+func scriptResult(err error) string {
+	switch {
+	case err == nil:
+		return "OK"
+	case errors.Is(err, ErrEvalFalse):
+		return "EVAL_FALSE"
+	case errors.Is(err, stack.ErrEmpty):
+		return "INVALID_STACK_OPERATION"
+	case errors.Is(err, ErrNumOverflow):
+		return "NUM_OVERFLOW"
+	case errors.Is(err, ErrStackOverflow):
+		return "STACK_SIZE"
+	case errors.Is(err, ErrElementTooLarge):
+		return "PUSH_SIZE"
+	case errors.Is(err, ErrScriptTooLarge):
+		return "SCRIPT_SIZE"
+	case errors.Is(err, ErrOutOfGas):
+		return "OUT_OF_GAS"
+	case errors.Is(err, ErrNegativeLockTime):
+		return "NEGATIVE_LOCKTIME"
+	case errors.Is(err, ErrUnsatisfiedLockTime):
+		return "UNSATISFIED_LOCKTIME"
+	case errors.Is(err, ErrSigPushOnly):
+		return "SIG_PUSHONLY"
+	case errors.Is(err, ErrUnbalancedConditional):
+		return "UNBALANCED_CONDITIONAL"
+	case errors.Is(err, ErrPubKeyCount):
+		return "PUBKEY_COUNT"
+	case errors.Is(err, ErrSigCount):
+		return "SIG_COUNT"
+	}
+	return "UNKNOWN_ERROR"
+}
+
+func TestVM_ScriptVectors(t *testing.T) {
+	data, err := os.ReadFile("testdata/script_tests.json")
+	if err != nil {
+		t.Fatalf("ReadFile failed: %v", err)
+	}
+	var vectors [][]string
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	for i, vector := range vectors {
+		if len(vector) == 1 {
+			continue // comment
+		}
+		if len(vector) < 4 {
+			t.Fatalf("vector %d has %d fields", i, len(vector))
+		}
+		scriptSig, err := parseTestScript(vector[0])
+		if err != nil {
+			t.Fatalf("vector %d: scriptSig: %v", i, err)
+		}
+		scriptPubKey, err := parseTestScript(vector[1])
+		if err != nil {
+			t.Fatalf("vector %d: scriptPubKey: %v", i, err)
+		}
+		flags, err := ParseFlags(vector[2])
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+		vm := New(nil)
+		vm.SetFlags(flags)
+		err = vm.VerifyScript(scriptSig, scriptPubKey, TxContext{})
+		if got := scriptResult(err); got != vector[3] {
+			t.Errorf("vector %d %q: got %s (%v), want %s", i, vector, got, err, vector[3])
+		}
+	}
+}
+
+func TestVM_Debugger(t *testing.T) {
+	script := []byte{OP_1, OP_2, OP_TOALTSTACK, OP_0, OP_IF, OP_RETURN, OP_ENDIF, OP_FROMALTSTACK, OP_ADD}
+	vm := New(nil)
+	if err := vm.ParseScript(script); err != nil {
+		t.Fatalf("ParseScript failed: %v", err)
+	}
+	d := vm.Debug(TxContext{})
+	step, err := d.Step()
+	if err != nil || step.PC != 0 || step.OpCode != "OP_1" || len(step.StackBefore) != 0 || !slices.Equal(step.StackAfter, []string{"01"}) {
+		t.Fatalf("Step = %+v, %v", step, err)
+	}
+	d.SetBreakpoint(5)
+	if !d.Continue() || d.PC() != 5 || d.Done() {
+		t.Fatalf("Continue did not stop at the breakpoint, pc %d", d.PC())
+	}
+	trace := d.Trace()
+	if last := trace[len(trace)-1]; last.OpCode != "OP_IF" || !slices.Equal(last.AltStackBefore, []string{"02"}) || !slices.Equal(last.AltStackAfter, []string{"02"}) {
+		t.Errorf("last step = %+v", last)
+	}
+	step, _ = d.Step()
+	if step.OpCode != "OP_RETURN" || !step.Skipped || !slices.Equal(step.ConditionStack, []bool{false}) {
+		t.Errorf("OP_RETURN step = %+v, want it skipped", step)
+	}
+	if d.Continue() || !d.Done() {
+		t.Fatalf("Continue did not finish the execution")
+	}
+	if res, err := d.Result(); err != nil || !bytes.Equal(res, []byte{3}) {
+		t.Errorf("Result = %x, %v, want 03", res, err)
+	}
+	if len(d.Trace()) != len(script) || d.Trace()[len(script)-1].GasUsed != vm.GasUsed() {
+		t.Errorf("trace has %d steps, want %d", len(d.Trace()), len(script))
+	}
+	if _, err := d.Step(); !errors.Is(err, ErrDebugFinished) {
+		t.Errorf("Step after the end = %v, want ErrDebugFinished", err)
+	}
+
+	// a failing operation finishes the execution with its error in the trace
+	vm = New(nil)
+	vm.ParseScript([]byte{OP_1, OP_ADD, OP_1})
+	d = vm.Debug(TxContext{})
+	d.Continue()
+	trace = d.Trace()
+	if _, err := d.Result(); !d.Done() || err == nil || len(trace) != 2 || trace[1].Error == "" {
+		t.Errorf("failed execution: done %v, result error %v, trace %+v", d.Done(), err, trace)
+	}
+
+	// a breakpoint at the first operation stops before it, continuing executes it
+	vm = New(nil)
+	vm.ParseScript([]byte{OP_1, OP_2, OP_ADD})
+	d = vm.Debug(TxContext{})
+	d.SetBreakpoint(0)
+	d.SetBreakpoint(2)
+	if !d.Continue() || d.PC() != 0 || len(d.Trace()) != 0 {
+		t.Fatalf("Continue did not stop at the first operation, pc %d", d.PC())
+	}
+	if !d.Continue() || d.PC() != 2 || len(d.Trace()) != 2 {
+		t.Fatalf("Continue did not stop at the next breakpoint, pc %d", d.PC())
+	}
+	if d.Continue() || !d.Done() {
+		t.Errorf("Continue did not finish the execution")
+	}
+}
+
+func TestVM_Timelock(t *testing.T) {
+	lock := func(n int64, op OPCode) []byte {
+		push, _ := Compile(OP_PUSHDATA, EncodeNum(n))
+		return append(push, byte(op), OP_DROP, OP_1)
+	}
+	// spend sets the lock time and the sequence of the single input of the spending tx
+	spend := func(lockTime uint32, sequence uint32, tx TxContext) TxContext {
+		tx.Tx = &Tx{Inputs: []TxIn{{Sequence: sequence}}, LockTime: lockTime}
+		return tx
+	}
+	const time = LockTimeThreshold + 1000
+	cases := []struct {
+		name   string
+		script []byte
+		tx     TxContext
+		want   error
+	}{
+		{"cltv_height", lock(100, OP_CHECKLOCKTIMEVERIFY), spend(100, 0, TxContext{Height: 100}), nil},
+		{"cltv_height_before_lock", lock(101, OP_CHECKLOCKTIMEVERIFY), spend(100, 0, TxContext{Height: 100}), ErrUnsatisfiedLockTime},
+		{"cltv_tx_not_final_at_height", lock(100, OP_CHECKLOCKTIMEVERIFY), spend(100, 0, TxContext{Height: 99}), ErrUnsatisfiedLockTime},
+		{"cltv_time", lock(time, OP_CHECKLOCKTIMEVERIFY), spend(time, 0, TxContext{MedianTime: time}), nil},
+		{"cltv_tx_not_final_at_time", lock(time, OP_CHECKLOCKTIMEVERIFY), spend(time, 0, TxContext{MedianTime: time - 1}), ErrUnsatisfiedLockTime},
+		{"cltv_units_differ", lock(100, OP_CHECKLOCKTIMEVERIFY), spend(time, 0, TxContext{MedianTime: time}), ErrUnsatisfiedLockTime},
+		{"cltv_final_sequence", lock(100, OP_CHECKLOCKTIMEVERIFY), spend(100, SequenceFinal, TxContext{Height: 100}), ErrUnsatisfiedLockTime},
+		{"cltv_negative", lock(-1, OP_CHECKLOCKTIMEVERIFY), spend(0, 0, TxContext{}), ErrNegativeLockTime},
+		{"cltv_empty_stack", []byte{OP_CHECKLOCKTIMEVERIFY}, spend(0, 0, TxContext{}), stack.ErrEmpty},
+		{"csv_blocks", lock(10, OP_CHECKSEQUENCEVERIFY), spend(0, 10, TxContext{}), nil},
+		{"csv_blocks_before_lock", lock(11, OP_CHECKSEQUENCEVERIFY), spend(0, 10, TxContext{}), ErrUnsatisfiedLockTime},
+		{"csv_time", lock(SequenceLockTimeTypeFlag|5, OP_CHECKSEQUENCEVERIFY), spend(0, SequenceLockTimeTypeFlag|5, TxContext{}), nil},
+		{"csv_units_differ", lock(SequenceLockTimeTypeFlag|5, OP_CHECKSEQUENCEVERIFY), spend(0, 5, TxContext{}), ErrUnsatisfiedLockTime},
+		{"csv_disabled_lock", lock(SequenceLockTimeDisableFlag, OP_CHECKSEQUENCEVERIFY), spend(0, SequenceFinal, TxContext{}), nil},
+		{"csv_disabled_sequence", lock(1, OP_CHECKSEQUENCEVERIFY), spend(0, SequenceFinal, TxContext{}), ErrUnsatisfiedLockTime},
+		{"csv_negative", lock(-1, OP_CHECKSEQUENCEVERIFY), spend(0, 0, TxContext{}), ErrNegativeLockTime},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			vm := New(nil)
+			if err := vm.ParseScript(tc.script); err != nil {
+				t.Fatalf("ParseScript failed: %v", err)
+			}
+			_, err := vm.Execute(tc.tx)
+			if tc.want == nil && err != nil || tc.want != nil && !errors.Is(err, tc.want) {
+				t.Errorf("Execute = %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestVM_SigHash(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	keys, _ := signer.GenerateKeyPair()
+	scriptPubKey := append(append([]byte{byte(len(keys.PublicKey))}, keys.PublicKey...), OP_CHECKSIG)
+	newTx := func() *Tx {
+		return &Tx{
+			Inputs: []TxIn{
+				{PrevTxId: transaction.Hash{1}, PrevIndex: 0, Sequence: 1},
+				{PrevTxId: transaction.Hash{2}, PrevIndex: 1, Sequence: 2},
+			},
+			Outputs: []TxOut{
+				{Value: 10, ScriptPubKey: []byte{OP_1}},
+				{Value: 20, ScriptPubKey: []byte{OP_2}},
+			},
+			LockTime: 7,
+		}
+	}
+	// verify runs <sig> | <pubkey> OP_CHECKSIG for input of tx
+	verify := func(tx *Tx, input int, signature []byte) error {
+		script := append([]byte{byte(len(signature))}, signature...)
+		_, err := New(signer).Run(append(script, scriptPubKey...), TxContext{Tx: tx, Input: input, ScriptCode: scriptPubKey})
+		return err
+	}
+	cases := []struct {
+		name     string
+		input    int
+		hashType SigHashType
+		change   func(tx *Tx)
+		valid    bool
+	}{
+		{"all", 0, SigHashAll, func(tx *Tx) {}, true},
+		{"all_output_changed", 0, SigHashAll, func(tx *Tx) { tx.Outputs[1].Value++ }, false},
+		{"all_other_sequence_changed", 0, SigHashAll, func(tx *Tx) { tx.Inputs[1].Sequence++ }, false},
+		{"all_locktime_changed", 0, SigHashAll, func(tx *Tx) { tx.LockTime++ }, false},
+		{"none_outputs_changed", 0, SigHashNone, func(tx *Tx) { tx.Outputs = tx.Outputs[:1]; tx.Outputs[0].Value = 1 }, true},
+		{"none_other_sequence_changed", 0, SigHashNone, func(tx *Tx) { tx.Inputs[1].Sequence++ }, true},
+		{"none_own_sequence_changed", 0, SigHashNone, func(tx *Tx) { tx.Inputs[0].Sequence++ }, false},
+		{"none_other_input_removed", 0, SigHashNone, func(tx *Tx) { tx.Inputs = tx.Inputs[:1] }, false},
+		{"single_other_output_changed", 1, SigHashSingle, func(tx *Tx) { tx.Outputs[0].ScriptPubKey = []byte{OP_3} }, true},
+		{"single_output_appended", 0, SigHashSingle, func(tx *Tx) { tx.Outputs = append(tx.Outputs, TxOut{Value: 1}) }, true},
+		{"single_own_output_changed", 1, SigHashSingle, func(tx *Tx) { tx.Outputs[1].Value++ }, false},
+		{"single_output_removed", 1, SigHashSingle, func(tx *Tx) { tx.Outputs = tx.Outputs[1:] }, false},
+		{"anyonecanpay_other_input_removed", 0, SigHashAll | SigHashAnyoneCanPay, func(tx *Tx) { tx.Inputs = tx.Inputs[:1] }, true},
+		{"anyonecanpay_output_changed", 0, SigHashAll | SigHashAnyoneCanPay, func(tx *Tx) { tx.Outputs[0].Value++ }, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tx := newTx()
+			signature, err := SignInput(signer, keys.PrivateKey, tx, tc.input, scriptPubKey, tc.hashType)
+			if err != nil || signature[SignatureSize-1] != byte(tc.hashType) {
+				t.Fatalf("SignInput = %x, %v", signature, err)
+			}
+			if err := verify(tx, tc.input, signature); err != nil {
+				t.Fatalf("unchanged transaction failed: %v", err)
+			}
+			tc.change(tx)
+			if err := verify(tx, tc.input, signature); (err == nil) != tc.valid {
+				t.Errorf("changed transaction: %v, want valid %v", err, tc.valid)
+			}
+		})
+	}
+
+	// an input signed with ANYONECANPAY may be moved by added inputs
+	tx := newTx()
+	signature, _ := SignInput(signer, keys.PrivateKey, tx, 1, scriptPubKey, SigHashAll|SigHashAnyoneCanPay)
+	tx.Inputs = append([]TxIn{{PrevTxId: transaction.Hash{3}}}, tx.Inputs...)
+	if err := verify(tx, 2, signature); err != nil {
+		t.Errorf("moved ANYONECANPAY input failed: %v", err)
+	}
+
+	// the hash type byte is part of the signed message
+	signature, _ = SignInput(signer, keys.PrivateKey, tx, 0, scriptPubKey, SigHashNone)
+	signature[SignatureSize-1] = byte(SigHashAll)
+	if err := verify(tx, 0, signature); err == nil {
+		t.Errorf("expected error for a changed hash type byte")
+	}
+	if _, err := SigHash(tx, 0, scriptPubKey, 0x04); !errors.Is(err, ErrSigHashType) {
+		t.Errorf("SigHash(0x04) = %v, want ErrSigHashType", err)
+	}
+	if _, err := SigHash(tx, 2, scriptPubKey, SigHashSingle); !errors.Is(err, ErrSigHashType) {
+		t.Errorf("SigHash(SINGLE) without a matching output = %v, want ErrSigHashType", err)
+	}
+}
+
+func TestVM_VerifyScript(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	cases := []struct {
+		name         string
+		scriptSig    []byte
+		scriptPubKey []byte
+		want         error
+	}{
+		{"valid", []byte{OP_1}, []byte{OP_1, OP_EQUAL}, nil},
+		{"stack_carried_over", []byte{OP_2, OP_3}, []byte{OP_ADD, OP_5, OP_EQUAL}, nil},
+		{"false", []byte{OP_0}, []byte{OP_1, OP_EQUAL}, ErrEvalFalse},
+		{"empty_stack", nil, nil, ErrEvalFalse},
+		{"branch_into_pubkey", []byte{OP_0, OP_IF}, []byte{OP_ENDIF, OP_1}, ErrUnbalancedConditional},
+		{"branch_left_open", []byte{OP_1}, []byte{OP_1, OP_IF, OP_1}, ErrUnbalancedConditional},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := New(signer).VerifyScript(tc.scriptSig, tc.scriptPubKey, TxContext{})
+			if (tc.want == nil) != (err == nil) || (tc.want != nil && !errors.Is(err, tc.want)) {
+				t.Errorf("VerifyScript = %v, want %v", err, tc.want)
+			}
+		})
+	}
+
+	// both scripts use the same gas limit
+	vm := New(signer)
+	vm.SetLimits(Limits{Gas: 3, MaxStackDepth: MaxStackDepth, MaxElementSize: MaxElementSize, MaxScriptSize: MaxScriptSize})
+	if err := vm.VerifyScript([]byte{OP_1, OP_1}, []byte{OP_EQUAL, OP_VERIFY, OP_1}, TxContext{}); !errors.Is(err, ErrOutOfGas) {
+		t.Errorf("VerifyScript over the gas limit = %v, want %v", err, ErrOutOfGas)
+	}
+}
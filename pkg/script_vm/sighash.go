@@ -0,0 +1,173 @@
+package script_vm
+
+import (
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/transaction"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// SigHashType is the last byte of a script signature. It selects the parts of the
+// spending transaction the signature commits to.
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01 // all inputs and outputs
+	SigHashNone         SigHashType = 0x02 // all inputs, no outputs
+	SigHashSingle       SigHashType = 0x03 // all inputs, the output with the index of the signed input
+	SigHashAnyoneCanPay SigHashType = 0x80 // combined with the above, only the signed input
+)
+
+// SignatureSize is the size of a script signature, the signature of the signer followed
+// by the hash type in place of its unused recovery id byte.
+const SignatureSize = 65
+
+var ErrSigHashType = errors.New("invalid signature hash type")
+
+type TxIn struct {
+	PrevTxId  transaction.Hash
+	PrevIndex uint32
+	Sequence  uint32
+}
+
+type TxOut struct {
+	Value        int64
+	ScriptPubKey []byte
+}
+
+// Tx is the part of a spending transaction covered by signature hashes. Input scripts
+// are not part of it, they hold the signatures.
+type Tx struct {
+	Inputs   []TxIn
+	Outputs  []TxOut
+	LockTime uint32
+}
+
+// TxContext describes the spending transaction and the chain a script is executed on.
+// Without Tx signatures are verified against SignedData and the timelock opcodes see a
+// zero lock time and sequence. Enforcing relative locks against the age of the spent
+// output is left to the transaction processor.
+type TxContext struct {
+	Tx         *Tx
+	Input      int    // index of the input whose script is executed
+	ScriptCode []byte // script the signatures commit to, the scriptPubKey of the spent output
+	SignedData []byte
+	Height     uint32 // height of the block including the transaction
+	MedianTime int64  // median time of the blocks before it
+}
+
+func (c TxContext) lockTime() uint32 {
+	if c.Tx == nil {
+		return 0
+	}
+	return c.Tx.LockTime
+}
+
+func (c TxContext) sequence() uint32 {
+	if c.Tx == nil || c.Input < 0 || c.Input >= len(c.Tx.Inputs) {
+		return 0
+	}
+	return c.Tx.Inputs[c.Input].Sequence
+}
+
+func writeScript(hasher interface{ Write([]byte) (int, error) }, script []byte) {
+	binary.Write(hasher, binary.BigEndian, uint32(len(script)))
+	hasher.Write(script)
+}
+
+// SigHash is the message signed for input of tx, sha256(sha256(serialized copy)). The
+// copy keeps scriptCode as the script of the signed input and leaves out what hashType
+// does not commit to: other inputs for SigHashAnyoneCanPay, the outputs for SigHashNone,
+// the outputs after the signed input for SigHashSingle. Other inputs keep their sequence
+// only for SigHashAll, so they can be replaced otherwise.
+func SigHash(tx *Tx, input int, scriptCode []byte, hashType SigHashType) ([]byte, error) {
+	if input < 0 || input >= len(tx.Inputs) {
+		return nil, fmt.Errorf("input %d is out of range, the transaction has %d inputs", input, len(tx.Inputs))
+	}
+	var base = hashType &^ SigHashAnyoneCanPay
+	if base != SigHashAll && base != SigHashNone && base != SigHashSingle {
+		return nil, fmt.Errorf("%w: %#x", ErrSigHashType, byte(hashType))
+	}
+	if base == SigHashSingle && input >= len(tx.Outputs) {
+		return nil, fmt.Errorf("%w: no output %d for SIGHASH_SINGLE", ErrSigHashType, input)
+	}
+
+	var hasher = sha256.New()
+	var inputs = tx.Inputs
+	var signed = input
+	if hashType&SigHashAnyoneCanPay != 0 {
+		inputs = tx.Inputs[input : input+1]
+		signed = 0
+	}
+	binary.Write(hasher, binary.BigEndian, uint32(len(inputs)))
+	for i, in := range inputs {
+		hasher.Write(in.PrevTxId[:])
+		binary.Write(hasher, binary.BigEndian, in.PrevIndex)
+		var sequence = in.Sequence
+		if i == signed {
+			writeScript(hasher, scriptCode)
+		} else {
+			writeScript(hasher, nil)
+			if base != SigHashAll {
+				sequence = 0
+			}
+		}
+		binary.Write(hasher, binary.BigEndian, sequence)
+	}
+
+	var outputs = tx.Outputs
+	switch base {
+	case SigHashNone:
+		outputs = nil
+	case SigHashSingle:
+		outputs = tx.Outputs[:input+1]
+	}
+	binary.Write(hasher, binary.BigEndian, uint32(len(outputs)))
+	for i, out := range outputs {
+		if base == SigHashSingle && i < input {
+			// outputs before the signed one are blanked, only their number is committed
+			binary.Write(hasher, binary.BigEndian, int64(-1))
+			writeScript(hasher, nil)
+			continue
+		}
+		binary.Write(hasher, binary.BigEndian, out.Value)
+		writeScript(hasher, out.ScriptPubKey)
+	}
+	binary.Write(hasher, binary.BigEndian, tx.LockTime)
+	binary.Write(hasher, binary.BigEndian, uint32(hashType))
+
+	var hash = sha256.Sum256(hasher.Sum(nil))
+	return hash[:], nil
+}
+
+// SignInput signs input of tx for a script committing to scriptCode and returns the
+// signature with the hash type byte, ready to be pushed by a scriptSig.
+func SignInput(signer sign.Signer, privateKey []byte, tx *Tx, input int, scriptCode []byte, hashType SigHashType) ([]byte, error) {
+	hash, err := SigHash(tx, input, scriptCode, hashType)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.Sign(hash, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(signature) != SignatureSize {
+		return nil, fmt.Errorf("signature of %d bytes has no hash type byte", len(signature))
+	}
+	signature[SignatureSize-1] = byte(hashType)
+	return signature, nil
+}
+
+// signedMessage is the message a script signature has to sign, the signature hash of
+// the spending transaction for its hash type byte.
+func (c TxContext) signedMessage(signature []byte) ([]byte, error) {
+	if c.Tx == nil {
+		return c.SignedData, nil
+	}
+	if len(signature) != SignatureSize {
+		return nil, fmt.Errorf("signature of %d bytes, want %d", len(signature), SignatureSize)
+	}
+	return SigHash(c.Tx, c.Input, c.ScriptCode, SigHashType(signature[SignatureSize-1]))
+}
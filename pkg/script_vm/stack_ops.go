@@ -0,0 +1,153 @@
+package script_vm
+
+import (
+	"blockchain_demo/pkg/utils"
+	"crypto/sha1"
+	"fmt"
+)
+
+// copyItems pushes copies of the items at the given depths, depths are read before
+// anything is pushed.
+func copyItems(depths ...int) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		var items = make([][]byte, 0, len(depths))
+		for _, depth := range depths {
+			item, err := ctx.vm.stack.PickAt(depth)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		for _, item := range items {
+			ctx.vm.stack.Push(item)
+		}
+		return nil
+	}
+}
+
+// moveItems removes the items at the given depths one after another and pushes them in
+// the same order, every depth is taken after the previous removal. A failed removal
+// fails the execution, so the stack is not restored.
+func moveItems(depths ...int) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		var items = make([][]byte, 0, len(depths))
+		for _, depth := range depths {
+			item, err := ctx.vm.stack.RemoveAt(depth)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		for _, item := range items {
+			ctx.vm.stack.Push(item)
+		}
+		return nil
+	}
+}
+
+// hashTop replaces the top item with hash of it.
+func hashTop(hash func(data []byte) ([]byte, error)) opHandler {
+	return func(ctx *handlerContext, op operation) error {
+		top, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		digest, err := hash(top)
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(digest)
+		return nil
+	}
+}
+
+// stackHandlers executes the stack opcodes, which are declared in script_vm.go. Comments
+// show the top items before and after an opcode with the top on the right.
+var stackHandlers = map[OPCode]opHandler{
+	OP_DEPTH: func(ctx *handlerContext, op operation) error {
+		ctx.vm.stack.Push(EncodeNum(int64(ctx.vm.stack.Size())))
+		return nil
+	},
+	// x1 x2 → x2
+	OP_NIP: func(ctx *handlerContext, op operation) error {
+		_, err := ctx.vm.stack.RemoveAt(1)
+		return err
+	},
+	// x1 x2 → x1 x2 x1
+	OP_OVER: copyItems(1),
+	// xn ... x0 n → xn ... x0 xn
+	OP_PICK: func(ctx *handlerContext, op operation) error {
+		n, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		return copyItems(int(n))(ctx, op)
+	},
+	// xn ... x0 n → ... x0 xn
+	OP_ROLL: func(ctx *handlerContext, op operation) error {
+		n, err := ctx.vm.popOperand()
+		if err != nil {
+			return err
+		}
+		return moveItems(int(n))(ctx, op)
+	},
+	// x1 x2 x3 → x2 x3 x1
+	OP_ROT: moveItems(2),
+	// x1 x2 → x2 x1
+	OP_SWAP: moveItems(1),
+	// x1 x2 → x2 x1 x2
+	OP_TUCK: func(ctx *handlerContext, op operation) error {
+		top, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		second, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		ctx.vm.stack.Push(top)
+		ctx.vm.stack.Push(second)
+		ctx.vm.stack.Push(top)
+		return nil
+	},
+	OP_TOALTSTACK: func(ctx *handlerContext, op operation) error {
+		top, err := ctx.vm.stack.Pop()
+		if err != nil {
+			return err
+		}
+		ctx.vm.altStack.Push(top)
+		return nil
+	},
+	OP_FROMALTSTACK: func(ctx *handlerContext, op operation) error {
+		top, err := ctx.vm.altStack.Pop()
+		if err != nil {
+			return fmt.Errorf("alt %w", err)
+		}
+		ctx.vm.stack.Push(top)
+		return nil
+	},
+	OP_2DROP: func(ctx *handlerContext, op operation) error {
+		if _, err := ctx.vm.stack.Pop(); err != nil {
+			return err
+		}
+		_, err := ctx.vm.stack.Pop()
+		return err
+	},
+	// x1 x2 → x1 x2 x1 x2
+	OP_2DUP: copyItems(1, 0),
+	// x1 x2 x3 → x1 x2 x3 x1 x2 x3
+	OP_3DUP: copyItems(2, 1, 0),
+	// x1 x2 x3 x4 → x1 x2 x3 x4 x1 x2
+	OP_2OVER: copyItems(3, 2),
+	// x1 x2 x3 x4 x5 x6 → x3 x4 x5 x6 x1 x2
+	OP_2ROT: moveItems(5, 4),
+	// x1 x2 x3 x4 → x3 x4 x1 x2
+	OP_2SWAP: moveItems(3, 2),
+	OP_RIPEMD160: hashTop(func(data []byte) ([]byte, error) {
+		return utils.GetHash160(nil, data)
+	}),
+	OP_SHA1: hashTop(func(data []byte) ([]byte, error) {
+		var digest = sha1.Sum(data)
+		return digest[:], nil
+	}),
+}
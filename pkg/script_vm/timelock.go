@@ -0,0 +1,93 @@
+package script_vm
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Timelock opcodes compare the number on top of the stack with the spending transaction
+// and leave the stack unchanged, like their Bitcoin counterparts (BIP 65 and BIP 112).
+const (
+	OP_CHECKLOCKTIMEVERIFY = 0xB1 // Fails unless the transaction lock time reached the top number
+	OP_CHECKSEQUENCEVERIFY = 0xB2 // Fails unless the input sequence reached the top relative lock
+)
+
+const (
+	LockTimeThreshold = 500_000_000 // lock times below are block heights, others unix times
+
+	SequenceFinal               = 0xffffffff
+	SequenceLockTimeDisableFlag = 1 << 31 // the sequence is not a relative lock
+	SequenceLockTimeTypeFlag    = 1 << 22 // the relative lock is in units of 512 seconds, not blocks
+	SequenceLockTimeMask        = 0x0000ffff
+)
+
+// maxLockNumSize is the longest lock number, five bytes hold every uint32.
+const maxLockNumSize = 5
+
+var (
+	ErrNegativeLockTime    = errors.New("negative locktime")
+	ErrUnsatisfiedLockTime = errors.New("unsatisfied locktime")
+)
+
+// pickLock reads the lock number on top of the stack without popping it.
+func (v *VM) pickLock() (int64, error) {
+	top, err := v.stack.Pick()
+	if err != nil {
+		return 0, err
+	}
+	lock, err := DecodeNum(top, maxLockNumSize)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", ErrNumOverflow, err)
+	}
+	if lock < 0 {
+		return 0, fmt.Errorf("%w: %d", ErrNegativeLockTime, lock)
+	}
+	return lock, nil
+}
+
+var timelockHandlers = map[OPCode]opHandler{
+	OP_CHECKLOCKTIMEVERIFY: func(ctx *handlerContext, op operation) error {
+		lock, err := ctx.vm.pickLock()
+		if err != nil {
+			return err
+		}
+		var tx = ctx.tx
+		var lockTime = tx.lockTime()
+		if (lock < LockTimeThreshold) != (lockTime < LockTimeThreshold) {
+			return fmt.Errorf("%w: lock %d and transaction lock time %d have different units", ErrUnsatisfiedLockTime, lock, lockTime)
+		}
+		if lock > int64(lockTime) {
+			return fmt.Errorf("%w: lock %d is after transaction lock time %d", ErrUnsatisfiedLockTime, lock, lockTime)
+		}
+		if tx.sequence() == SequenceFinal {
+			return fmt.Errorf("%w: the input sequence is final", ErrUnsatisfiedLockTime)
+		}
+		if lockTime < LockTimeThreshold && lockTime > tx.Height {
+			return fmt.Errorf("%w: transaction lock time %d is after height %d", ErrUnsatisfiedLockTime, lockTime, tx.Height)
+		}
+		if lockTime >= LockTimeThreshold && int64(lockTime) > tx.MedianTime {
+			return fmt.Errorf("%w: transaction lock time %d is after median time %d", ErrUnsatisfiedLockTime, lockTime, tx.MedianTime)
+		}
+		return nil
+	},
+	OP_CHECKSEQUENCEVERIFY: func(ctx *handlerContext, op operation) error {
+		lock, err := ctx.vm.pickLock()
+		if err != nil {
+			return err
+		}
+		if lock&SequenceLockTimeDisableFlag != 0 {
+			return nil
+		}
+		var sequence = int64(ctx.tx.sequence())
+		if sequence&SequenceLockTimeDisableFlag != 0 {
+			return fmt.Errorf("%w: the input sequence %#x is not a relative lock", ErrUnsatisfiedLockTime, sequence)
+		}
+		if lock&SequenceLockTimeTypeFlag != sequence&SequenceLockTimeTypeFlag {
+			return fmt.Errorf("%w: lock %#x and sequence %#x have different units", ErrUnsatisfiedLockTime, lock, sequence)
+		}
+		if lock&SequenceLockTimeMask > sequence&SequenceLockTimeMask {
+			return fmt.Errorf("%w: lock %#x is after sequence %#x", ErrUnsatisfiedLockTime, lock, sequence)
+		}
+		return nil
+	},
+}
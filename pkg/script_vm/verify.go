@@ -0,0 +1,139 @@
+package script_vm
+
+import (
+	"blockchain_demo/pkg/utils/queue"
+	"blockchain_demo/pkg/utils/stack"
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// VerifyFlags enables consensus rules of VerifyScript that a chain may turn on or off.
+type VerifyFlags uint32
+
+const (
+	VerifyNone VerifyFlags = 0
+	// VerifyP2SH evaluates the redeem script of pay to script hash outputs (BIP 16).
+	VerifyP2SH VerifyFlags = 1 << 0
+	// VerifySigPushOnly requires every scriptSig to only push data, P2SH scriptSigs have
+	// to even without it.
+	VerifySigPushOnly VerifyFlags = 1 << 1
+)
+
+// DefaultFlags are the rules of a new VM.
+const DefaultFlags = VerifyP2SH
+
+// ScriptHashSize is the size of the OP_HASH160 digest of a pay to script hash output.
+const ScriptHashSize = 20
+
+var FlagNames = map[string]VerifyFlags{
+	"NONE":        VerifyNone,
+	"P2SH":        VerifyP2SH,
+	"SIGPUSHONLY": VerifySigPushOnly,
+}
+
+var (
+	ErrUnbalancedConditional = errors.New("unbalanced conditional")
+	ErrSigPushOnly           = errors.New("scriptSig is not push only")
+)
+
+// ParseFlags reads comma separated FlagNames, an empty string is VerifyNone.
+func ParseFlags(s string) (VerifyFlags, error) {
+	var flags = VerifyNone
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		flag, ok := FlagNames[name]
+		if !ok {
+			return 0, fmt.Errorf("unknown verify flag %q", name)
+		}
+		flags |= flag
+	}
+	return flags, nil
+}
+
+// SetFlags replaces the rules of the next VerifyScript calls.
+func (v *VM) SetFlags(flags VerifyFlags) {
+	v.flags = flags
+}
+
+// IsPayToScriptHash reports whether script is exactly OP_HASH160 <20 bytes> OP_EQUAL,
+// the pattern of pay to script hash outputs.
+func IsPayToScriptHash(script []byte) bool {
+	return len(script) == ScriptHashSize+3 &&
+		script[0] == OP_HASH160 &&
+		script[1] == ScriptHashSize &&
+		script[ScriptHashSize+2] == OP_EQUAL
+}
+
+// isPushOnly reports whether the parsed operations only push data.
+func (v *VM) isPushOnly() bool {
+	for _, op := range v.queue.ToArray() {
+		if op.code != OP_PUSHDATA {
+			return false
+		}
+	}
+	return true
+}
+
+// runScript parses and executes script on the current stack. A branch opened by script
+// has to be closed by it.
+func (v *VM) runScript(ctx *handlerContext, script []byte, pushOnly bool) error {
+	if err := v.ParseScript(script); err != nil {
+		return err
+	}
+	if pushOnly && !v.isPushOnly() {
+		v.queue = queue.New[operation]()
+		return ErrSigPushOnly
+	}
+	if err := v.run(ctx); err != nil {
+		return err
+	}
+	if !v.conditionStack.IsEmpty() {
+		return ErrUnbalancedConditional
+	}
+	return nil
+}
+
+// VerifyScript executes scriptSig and then scriptPubKey on the stack left by it, as the
+// spend of an output locked by scriptPubKey described by tx. The scripts share the gas
+// limit and the spend is valid only if the top of the final stack is true.
+//
+// With VerifyP2SH a scriptPubKey matching IsPayToScriptHash also executes the redeem
+// script, the last item pushed by scriptSig, on the other items. Signatures of the
+// redeem script commit to it instead of tx.ScriptCode.
+func (v *VM) VerifyScript(scriptSig []byte, scriptPubKey []byte, tx TxContext) error {
+	var ctx = &handlerContext{
+		vm: v,
+		tx: tx,
+	}
+	var p2sh = v.flags&VerifyP2SH != 0 && IsPayToScriptHash(scriptPubKey)
+	if err := v.runScript(ctx, scriptSig, p2sh || v.flags&VerifySigPushOnly != 0); err != nil {
+		return fmt.Errorf("scriptSig: %w", err)
+	}
+	var pushed = v.stack.ToArray()
+	if err := v.runScript(ctx, scriptPubKey, false); err != nil {
+		return fmt.Errorf("scriptPubKey: %w", err)
+	}
+	if _, err := v.result(); err != nil || !p2sh {
+		return err
+	}
+
+	if len(pushed) == 0 {
+		return fmt.Errorf("redeem script: %w", ErrEvalFalse)
+	}
+	var redeemScript = bytes.Clone(pushed[0])
+	var items = pushed[1:]
+	slices.Reverse(items)
+	v.stack = stack.FromArray(items)
+	ctx.tx.ScriptCode = redeemScript
+	if err := v.runScript(ctx, redeemScript, false); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+	_, err := v.result()
+	return err
+}
@@ -36,11 +36,11 @@ func (signer EcdsaSigner) Sign(data []byte, privateKey []byte) ([]byte, error) {
 		return nil, fmt.Errorf("failed to sign")
 	}
 
-	// Serialize the signature (r, s) into a 65-byte array
+	// Serialize the signature (r, s) into a 65-byte array, both padded to 32 bytes
 	signature := make([]byte, 65)
-	copy(signature[:32], r.Bytes())
-	copy(signature[32:64], s.Bytes())
-	signature[64] = 0 // Recovery ID placeholder (not used here)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:64])
+	signature[64] = 0 // Hash type byte, set by script signatures (script_vm.SignInput)
 
 	return signature, nil
 }
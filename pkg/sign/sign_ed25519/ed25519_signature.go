@@ -28,7 +28,7 @@ func (signer Ed25519Signer) Sign(data []byte, privateKey []byte) ([]byte, error)
 	// Serialize the signature (r, s) into a 65-byte array
 	signature := make([]byte, 65)
 	copy(signature[:64], sign)
-	signature[64] = 0 // Recovery ID placeholder (not used here)
+	signature[64] = 0 // Hash type byte, set by script signatures (script_vm.SignInput)
 
 	return signature, nil
 }
@@ -1,5 +1,11 @@
 package sign
 
+import (
+	"crypto/sha256"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
 type SignatureKeys struct {
 	PrivateKey []byte
 	PublicKey  []byte
@@ -10,3 +16,12 @@ type Signer interface {
 	Sign(data []byte, privateKey []byte) ([]byte, error)
     Verify(data []byte, signature []byte, publicKey []byte) (bool, error)
 }
+
+// PublicKeyHash returns the 20 byte address owned by publicKey,
+// ripemd160(sha256(publicKey)).
+func PublicKeyHash(publicKey []byte) []byte {
+	var hashed = sha256.Sum256(publicKey)
+	var hasher = ripemd160.New()
+	hasher.Write(hashed[:])
+	return hasher.Sum(nil)
+}
@@ -12,7 +12,7 @@ import (
 
 const CoinTransfer transaction.TransactionType = "coin_transfer"
 
-var EmptyAddress = [20]byte{}
+var EmptyAddress = transaction.CoinbaseAddress
 type CoinTransferTransaction struct {
 	transaction.BaseTransaction
 	Recipient transaction.HexBytes `json:"recipient" json-hex:"true"`
@@ -28,11 +28,17 @@ func NewTransaction(sender string, value int64, fee int64, params map[string]any
 		return nil, recipientErr
 	}
 
+	var nonce, nonceErr = utils.GetOptionalInt64FromParam(params, "nonce")
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+
 	var tx = CoinTransferTransaction{
 		BaseTransaction: transaction.BaseTransaction{
 			TxType:    CoinTransfer,
 			TxId:      [32]byte{},
 			Sender:    senderBytes,
+			Nonce:     nonce,
 			Value:     value,
 			Fee:       fee,
 			Timestamp: time.Now().UnixNano(),
@@ -75,7 +81,7 @@ func (tx *CoinTransferTransaction) Verify(signer sign.Signer) error {
 	}
 	var err = tx.BaseTransaction.Verify(signer)
 	if err != nil {
-		return fmt.Errorf("TxId signature is invalid")
+		return err
 	}
 	return nil
 }
@@ -22,6 +22,8 @@ type ContractCallTransaction struct {
 	ContractAddress transaction.HexBytes       `json:"contractAddress" json-hex:"true"`
 	Method          ContractMethod 			   `json:"method"`
 	InitParams      ContractCallParams
+	// Args are passed to the contract code after the to and amount params.
+	Args []transaction.HexBytes `json:"args,omitempty"`
 }
 
 type ContractMethod string
@@ -30,13 +32,12 @@ const (
 	Transfer ContractMethod = "transfer"
 )
 
-// Или с использованием карты для более эффективной проверки
-var validContractTypes = map[ContractMethod]bool{
-	Transfer: true,
-}
+// MaxMethodLength bounds the method name, the methods themselves are defined by the
+// contract code.
+const MaxMethodLength = 64
 
 func IsValid(s string) (ContractMethod, bool) {
-	return ContractMethod(s), validContractTypes[ContractMethod(s)]
+	return ContractMethod(s), len(s) > 0 && len(s) <= MaxMethodLength
 }
 
 func NewTransaction(sender string, value int64, fee int64, params map[string]any) (*ContractCallTransaction, error) {
@@ -62,11 +63,22 @@ func NewTransaction(sender string, value int64, fee int64, params map[string]any
 		return nil, methodErr
 	}
 
+	var args, argsErr = utils.GetOptionalHexListFromParam(params, "args")
+	if argsErr != nil {
+		return nil, argsErr
+	}
+
+	var nonce, nonceErr = utils.GetOptionalInt64FromParam(params, "nonce")
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+
 	var tx = ContractCallTransaction{
 		BaseTransaction: transaction.BaseTransaction{
 			TxType:    ContractCall,
 			TxId:      [32]byte{},
 			Sender:    senderBytes,
+			Nonce:     nonce,
 			Value:     value,
 			Fee:       fee,
 			Timestamp: time.Now().UnixNano(),
@@ -77,6 +89,9 @@ func NewTransaction(sender string, value int64, fee int64, params map[string]any
 		Method:    method,
 		InitParams:      ContractCallParams{To: toBytes, Amount: amount},
 	}
+	for _, arg := range args {
+		tx.Args = append(tx.Args, arg)
+	}
 	var hash, err = tx.CalcHash()
 	if err != nil {
 		return nil, err
@@ -91,6 +106,9 @@ func (tx *ContractCallTransaction) GetDataForHash() []any {
 	data = append(data, string(tx.Method))
 	data = append(data, tx.InitParams.To)
 	data = append(data, tx.InitParams.Amount)
+	for _, arg := range tx.Args {
+		data = append(data, uint32(len(arg)), arg)
+	}
 
 	return data
 }
@@ -114,7 +132,7 @@ func (tx *ContractCallTransaction) Verify(signer sign.Signer) error {
 	}
 	var err = tx.BaseTransaction.Verify(signer)
 	if err != nil {
-		return fmt.Errorf("TxId signature is invalid")
+		return err
 	}
 	return nil
 }
@@ -4,14 +4,21 @@ import (
 	"blockchain_demo/pkg/sign"
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/utils"
+	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 )
 
 const ContractDeploy transaction.TransactionType = "contract_deploy"
 
+// ErrContractAddress rejects a deploy to an address other than the ContractAddress of
+// its sender and nonce, which could be an existing account.
+var ErrContractAddress = errors.New("contract address is not derived from the sender and nonce")
+
 type InitParams struct {
 	Owner          transaction.HexBytes `json:"owner" json-hex:"true"`
 	InitialSupplay uint64 `json:"initialSupply"`
@@ -24,15 +31,21 @@ type ContractDeployTransaction struct {
 	InitParams InitParams
 }
 
+// ContractAddress is the address of the contract deployed by sender with nonce, the
+// hash160 of the sender followed by the big endian nonce. Deriving it keeps a deploy
+// from taking over an existing account.
+func ContractAddress(sender []byte, nonce uint64) []byte {
+	var data = binary.BigEndian.AppendUint64(bytes.Clone(sender), nonce)
+	return sign.PublicKeyHash(data)
+}
+
+// NewTransaction creates a deploy to the ContractAddress of the sender and nonce, an
+// optional contractAddress param has to equal it.
 func NewTransaction(sender string, value int64, fee int64, params map[string]any) (*ContractDeployTransaction, error) {
 	var senderBytes, senderErr = hex.DecodeString(sender)
 	if senderErr != nil || len(senderBytes) != 20 {
 		return nil, fmt.Errorf("unsupported sender format: %s", sender)
 	}
-	var contractAddress, contractErr = utils.GetBytesFromHexParam(params, "contractAddress")
-	if contractErr != nil {
-		return nil, contractErr
-	}
 	var codeBytes, codeErr = utils.GetBytesFromHexParam(params, "code")
 	if codeErr != nil {
 		return nil, codeErr
@@ -46,11 +59,27 @@ func NewTransaction(sender string, value int64, fee int64, params map[string]any
 		return nil, initialSupplayErr
 	}
 
+	var nonce, nonceErr = utils.GetOptionalInt64FromParam(params, "nonce")
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+	var contractAddress = ContractAddress(senderBytes, nonce)
+	if _, exists := params["contractAddress"]; exists {
+		var supplied, contractErr = utils.GetBytesFromHexParam(params, "contractAddress")
+		if contractErr != nil {
+			return nil, contractErr
+		}
+		if !bytes.Equal(supplied, contractAddress) {
+			return nil, fmt.Errorf("%w: %x", ErrContractAddress, supplied)
+		}
+	}
+
 	var tx = ContractDeployTransaction{
 		BaseTransaction: transaction.BaseTransaction{
 			TxType:    ContractDeploy,
 			TxId:      [32]byte{},
 			Sender:    senderBytes,
+			Nonce:     nonce,
 			Value:     value,
 			Fee:       fee,
 			Timestamp: time.Now().UnixNano(),
@@ -100,7 +129,7 @@ func (tx *ContractDeployTransaction) Verify(signer sign.Signer) error {
 	}
 	var err = tx.BaseTransaction.Verify(signer)
 	if err != nil {
-		return fmt.Errorf("TxId signature is invalid")
+		return err
 	}
 	return nil
 }
@@ -33,11 +33,17 @@ func NewTransaction(sender string, value int64, fee int64, params map[string]any
 		return nil, tokentErr
 	}
 
+	var nonce, nonceErr = utils.GetOptionalInt64FromParam(params, "nonce")
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+
 	var tx = TokenTransferTransaction{
 		BaseTransaction: transaction.BaseTransaction{
 			TxType:    TokenTransfer,
 			TxId:      [32]byte{},
 			Sender:    senderBytes,
+			Nonce:     nonce,
 			Value:     value,
 			Fee:       fee,
 			Timestamp: time.Now().UnixNano(),
@@ -82,7 +88,7 @@ func (tx *TokenTransferTransaction) Verify(signer sign.Signer) error {
 	}
 	var err = tx.BaseTransaction.Verify(signer)
 	if err != nil {
-		return fmt.Errorf("TxId signature is invalid")
+		return err
 	}
 	return nil
 }
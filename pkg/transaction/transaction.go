@@ -2,6 +2,7 @@ package transaction
 
 import (
 	"blockchain_demo/pkg/sign"
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -10,6 +11,10 @@ import (
 
 type TransactionType string
 
+// CoinbaseAddress is the sender of coinbase transactions. They mint the block reward
+// instead of spending from an account, so no public key is bound to this sender.
+var CoinbaseAddress = [20]byte{}
+
 type Hash [32]byte
 
 func (b Hash) MarshalJSON() ([]byte, error) {
@@ -55,6 +60,7 @@ type Transaction interface {
 	GetFee() int64
 	GetTime() int64
 	GetSender() []byte
+	GetNonce() uint64
 	AddSing(signer sign.Signer, signature *sign.SignatureKeys) error
 	Verify(signer sign.Signer) error
 	GetDataForHash() []any
@@ -62,6 +68,18 @@ type Transaction interface {
 	Stringify() ([]byte, error)
 }
 
+// OutPoint references the output Index of transaction TxId.
+type OutPoint struct {
+	TxId  Hash   `json:"tx_id"`
+	Index uint32 `json:"index"`
+}
+
+// Spender is implemented by transactions consuming outputs of earlier transactions,
+// two transactions spending the same output conflict.
+type Spender interface {
+	SpentOutPoints() []OutPoint
+}
+
 type TransactionConstructor func(sender string, value int64, fee int64, params map[string]any) (Transaction, error)
 
 var factory = make(map[TransactionType]TransactionConstructor)
@@ -75,6 +93,7 @@ type BaseTransaction struct {
 	Fee       int64           `json:"fee"`
 	Timestamp int64           `json:"timestamp"`
 	Sender    HexBytes          `json:"sender" json-hex:"true"`
+	Nonce     uint64            `json:"nonce"`
 	Sign      HexBytes          `json:"sign" json-hex:"true"`
 	PublicKey HexBytes          `json:"public_key" json-hex:"true"`
 }
@@ -98,10 +117,17 @@ func (tx *BaseTransaction) GetSender() []byte {
 	return tx.Sender
 }
 
+// GetNonce returns the sequence number of the transaction among the transactions of
+// its sender, it protects a signed transaction from being replayed.
+func (tx *BaseTransaction) GetNonce() uint64 {
+	return tx.Nonce
+}
+
 func (tx *BaseTransaction) GetDataForHash() []any {
 	var data = []any{}
 	data = append(data, string(tx.TxType))
 	data = append(data, tx.Sender)
+	data = append(data, tx.Nonce)
 	data = append(data, tx.Timestamp)
 	data = append(data, tx.Value)
 	data = append(data, tx.Fee)
@@ -119,7 +145,17 @@ func (tx *BaseTransaction) AddSing(signer sign.Signer, signature *sign.Signature
 	return nil
 }
 
+// IsCoinbase reports whether the transaction is sent by CoinbaseAddress.
+func (tx *BaseTransaction) IsCoinbase() bool {
+	return bytes.Equal(tx.Sender, CoinbaseAddress[:])
+}
+
+// Verify checks that PublicKey owns Sender and signed TxId. Coinbase transactions are
+// only checked for the signature.
 func (tx *BaseTransaction) Verify(signer sign.Signer) error {
+	if !tx.IsCoinbase() && !bytes.Equal(sign.PublicKeyHash(tx.PublicKey), tx.Sender) {
+		return fmt.Errorf("public key does not match sender %x", []byte(tx.Sender))
+	}
 	var isValid, err = signer.Verify(tx.TxId[:], tx.Sign[:], tx.PublicKey[:])
 	if err != nil || !isValid {
 		return fmt.Errorf("TxId signature is invalid")
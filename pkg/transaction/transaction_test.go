@@ -1,11 +1,14 @@
 package transaction_test
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"testing"
 
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/sign/sign_ed25519"
 	"blockchain_demo/pkg/transaction"
 	_ "blockchain_demo/pkg/transaction/coin_transfer"
 	_ "blockchain_demo/pkg/transaction/contract_call"
@@ -25,6 +28,7 @@ func TestTransaction_SerializeDeserialize(t *testing.T) {
 			typeName: "coin_transfer",
 			params: map[string]any{
 				"recipient": address,
+				"nonce":     uint64(7),
 			},
 		},
 		{
@@ -34,6 +38,7 @@ func TestTransaction_SerializeDeserialize(t *testing.T) {
 				"to": address,
 				"method": "transfer",
 				"amount": uint64(42),
+				"args": []string{address, "00"},
 			},
 		},
 		{
@@ -71,6 +76,10 @@ func TestTransaction_SerializeDeserialize(t *testing.T) {
 			t.Errorf("type mismatch after deserialization: got %T, want %T", deserialized, tx)
 		}
 
+		if deserialized.GetNonce() != tx.GetNonce() {
+			t.Errorf("nonce mismatch after deserialization: got %d, want %d", deserialized.GetNonce(), tx.GetNonce())
+		}
+
 		// Compare JSON representations
 		origJSON, _ := json.Marshal(tx)
 		desJSON, _ := json.Marshal(deserialized)
@@ -79,3 +88,29 @@ func TestTransaction_SerializeDeserialize(t *testing.T) {
 		}
 	}
 }
+
+func TestTransaction_VerifySender(t *testing.T) {
+	signer := sign_ed25519.Ed25519Signer{}
+	keys, _ := signer.GenerateKeyPair()
+	other, _ := signer.GenerateKeyPair()
+	owner := hex.EncodeToString(sign.PublicKeyHash(keys.PublicKey))
+	params := map[string]any{"recipient": "1234567890abcdef1234567890abcdef12345678"}
+
+	tx, _ := transaction.CreateTransaction("coin_transfer", owner, 10, 1, params)
+	tx.AddSing(signer, keys)
+	if err := tx.Verify(signer); err != nil {
+		t.Errorf("Verify failed for the sender's key: %v", err)
+	}
+
+	tx, _ = transaction.CreateTransaction("coin_transfer", owner, 10, 1, params)
+	tx.AddSing(signer, other)
+	if err := tx.Verify(signer); err == nil {
+		t.Errorf("expected error for a key not owning the sender")
+	}
+
+	tx, _ = transaction.CreateTransaction("coin_transfer", hex.EncodeToString(transaction.CoinbaseAddress[:]), 10, 0, params)
+	tx.AddSing(signer, other)
+	if err := tx.Verify(signer); err != nil {
+		t.Errorf("Verify failed for coinbase: %v", err)
+	}
+}
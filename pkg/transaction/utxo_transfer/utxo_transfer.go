@@ -0,0 +1,201 @@
+package utxo_transfer
+
+import (
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/utils"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const UtxoTransfer transaction.TransactionType = "utxo_transfer"
+
+// Input spends the output at OutPoint, ScriptSig is executed before the scriptPubKey of
+// the spent output.
+type Input struct {
+	transaction.OutPoint
+	ScriptSig transaction.HexBytes `json:"script_sig" json-hex:"true"`
+	Sequence  uint32               `json:"sequence"`
+}
+
+// Output locks Value to ScriptPubKey, it is spent by an input whose scriptSig makes the
+// script succeed.
+type Output struct {
+	Value        int64                `json:"value"`
+	ScriptPubKey transaction.HexBytes `json:"script_pub_key" json-hex:"true"`
+}
+
+// UtxoTransferTransaction spends script locked outputs and creates new ones. Value is
+// paid from the ballance of the sender into the outputs, so coins enter the output set.
+// The inputs and Value must cover the outputs and the fee exactly. The sender signs the
+// transaction as a whole and keeps the nonce order like every other transaction.
+type UtxoTransferTransaction struct {
+	transaction.BaseTransaction
+	Inputs   []Input  `json:"inputs"`
+	Outputs  []Output `json:"outputs"`
+	LockTime uint32   `json:"lock_time"`
+}
+
+// getInputs reads the inputs param, a missing field is no inputs.
+func getInputs(params map[string]any) ([]Input, error) {
+	value, exists := params["inputs"]
+	if !exists {
+		return nil, nil
+	}
+	inputs, ok := value.([]Input)
+	if !ok {
+		return nil, fmt.Errorf("inputs is not a list of inputs")
+	}
+	return inputs, nil
+}
+
+func getOutputs(params map[string]any) ([]Output, error) {
+	value, exists := params["outputs"]
+	if !exists {
+		return nil, fmt.Errorf("outputs not exists in params")
+	}
+	outputs, ok := value.([]Output)
+	if !ok {
+		return nil, fmt.Errorf("outputs is not a list of outputs")
+	}
+	return outputs, nil
+}
+
+func NewTransaction(sender string, value int64, fee int64, params map[string]any) (*UtxoTransferTransaction, error) {
+	var senderBytes, senderErr = hex.DecodeString(sender)
+	if senderErr != nil || len(senderBytes) != 20 {
+		return nil, fmt.Errorf("unsupported sender format: %s", sender)
+	}
+	var inputs, inputsErr = getInputs(params)
+	if inputsErr != nil {
+		return nil, inputsErr
+	}
+	var outputs, outputsErr = getOutputs(params)
+	if outputsErr != nil {
+		return nil, outputsErr
+	}
+	var lockTime, lockTimeErr = utils.GetOptionalInt64FromParam(params, "lockTime")
+	if lockTimeErr != nil {
+		return nil, lockTimeErr
+	}
+
+	var nonce, nonceErr = utils.GetOptionalInt64FromParam(params, "nonce")
+	if nonceErr != nil {
+		return nil, nonceErr
+	}
+
+	var tx = UtxoTransferTransaction{
+		BaseTransaction: transaction.BaseTransaction{
+			TxType:    UtxoTransfer,
+			TxId:      [32]byte{},
+			Sender:    senderBytes,
+			Nonce:     nonce,
+			Value:     value,
+			Fee:       fee,
+			Timestamp: time.Now().UnixNano(),
+			Sign:      nil,
+			PublicKey: []byte{},
+		},
+		Inputs:   inputs,
+		Outputs:  outputs,
+		LockTime: uint32(lockTime),
+	}
+	var hash, err = tx.CalcHash()
+	if err != nil {
+		return nil, err
+	}
+	tx.TxId = [32]byte(hash)
+	return &tx, nil
+}
+
+// SigningTx returns the part of the transaction signed by the signatures of input
+// scripts, see script_vm.SigHash.
+func (tx *UtxoTransferTransaction) SigningTx() *script_vm.Tx {
+	var signing = script_vm.Tx{LockTime: tx.LockTime}
+	for _, in := range tx.Inputs {
+		signing.Inputs = append(signing.Inputs, script_vm.TxIn{
+			PrevTxId:  in.TxId,
+			PrevIndex: in.Index,
+			Sequence:  in.Sequence,
+		})
+	}
+	for _, out := range tx.Outputs {
+		signing.Outputs = append(signing.Outputs, script_vm.TxOut{
+			Value:        out.Value,
+			ScriptPubKey: out.ScriptPubKey,
+		})
+	}
+	return &signing
+}
+
+func (tx *UtxoTransferTransaction) SpentOutPoints() []transaction.OutPoint {
+	var outpoints = make([]transaction.OutPoint, 0, len(tx.Inputs))
+	for _, in := range tx.Inputs {
+		outpoints = append(outpoints, in.OutPoint)
+	}
+	return outpoints
+}
+
+func (tx *UtxoTransferTransaction) GetDataForHash() []any {
+	var data = tx.BaseTransaction.GetDataForHash()
+	data = append(data, uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		data = append(data, in.TxId[:], in.Index, uint32(len(in.ScriptSig)), in.ScriptSig, in.Sequence)
+	}
+	data = append(data, uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		data = append(data, out.Value, uint32(len(out.ScriptPubKey)), out.ScriptPubKey)
+	}
+	data = append(data, tx.LockTime)
+
+	return data
+}
+
+func (tx *UtxoTransferTransaction) CalcHash() ([]byte, error) {
+	var hash, err = utils.GetHash(tx.GetDataForHash()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return hash, nil
+}
+
+func (tx *UtxoTransferTransaction) Verify(signer sign.Signer) error {
+	var hash, hashErr = tx.CalcHash()
+	if hashErr != nil {
+		return fmt.Errorf("unable to calculate hash")
+	}
+	if [32]byte(hash) != tx.TxId {
+		return fmt.Errorf("TxId is invalid")
+	}
+	var err = tx.BaseTransaction.Verify(signer)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (tx *UtxoTransferTransaction) String() string {
+	return fmt.Sprintf("Transaction{TxId: %x, Sender: %x, Inputs: %d, Outputs: %d, Value: %d, Time: %d}",
+		tx.TxId, tx.Sender, len(tx.Inputs), len(tx.Outputs), tx.Value, tx.Timestamp)
+}
+
+func (tx *UtxoTransferTransaction) Stringify() ([]byte, error) {
+	var data, err = json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func init() {
+	transaction.RegisterTransactionType(UtxoTransfer, func(sender string, value int64, fee int64, params map[string]any) (transaction.Transaction, error) {
+		return NewTransaction(sender, value, fee, params)
+	}, func() transaction.Transaction {
+		return &UtxoTransferTransaction{}
+	})
+}
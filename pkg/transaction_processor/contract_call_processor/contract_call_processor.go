@@ -2,52 +2,117 @@ package contract_call_processor
 
 import (
 	"blockchain_demo/pkg/ballance_storage"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/sign"
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/contract_call"
 	"blockchain_demo/pkg/transaction_processor"
 	"fmt"
+	"math"
 )
 
+// GasPerFee is the gas bought by one coin of fee. The fee of a call is its gas limit,
+// the call is charged for the gas it used rounded up to whole coins and the rest of the
+// fee is refunded.
+const GasPerFee = 1000
+
 type ContractCallProcessor struct {
-	storage ballance_storage.BallanceStorage
+	storage   ballance_storage.BallanceStorage
+	contracts contract_storage.ContractStorage
+	signer    sign.Signer
 }
 
-func NewProcessor(storage ballance_storage.BallanceStorage) transaction_processor.TransactionProcessor {
+// NewProcessor executes calls of the contracts kept in contracts. The signer is used by
+// the signature opcodes of contract code.
+func NewProcessor(storage ballance_storage.BallanceStorage, contracts contract_storage.ContractStorage, signer sign.Signer) transaction_processor.TransactionProcessor {
 	var processor = ContractCallProcessor{
-		storage: storage,
+		storage:   storage,
+		contracts: contracts,
+		signer:    signer,
 	}
 
 	return &processor
 }
 
-func (p *ContractCallProcessor) Validate(tx transaction.Transaction) error {
-
+// check validates the call without running the contract and returns its code.
+func (p *ContractCallProcessor) check(tx transaction.Transaction) (*contract_call.ContractCallTransaction, []byte, error) {
 	coinTx, ok := tx.(*contract_call.ContractCallTransaction)
 	if !ok {
-		return fmt.Errorf("invalid transaction type")
+		return nil, nil, fmt.Errorf("invalid transaction type")
 	}
 
-	ballance := p.storage.GetBallance(string(coinTx.ContractAddress))
-
-	if ballance < int64(coinTx.InitParams.Amount)+coinTx.Fee {
-		return fmt.Errorf("sender's balance is too low")
+	if tx.GetFee() <= 0 || tx.GetFee() > math.MaxInt64/GasPerFee {
+		return nil, nil, fmt.Errorf("fee %d does not buy gas", tx.GetFee())
+	}
+	if tx.GetValue() < 0 || coinTx.InitParams.Amount > math.MaxInt64 {
+		return nil, nil, fmt.Errorf("invalid value %d or amount %d", tx.GetValue(), coinTx.InitParams.Amount)
 	}
-	return nil
+	ballance := p.storage.GetBallance(string(coinTx.Sender))
+	if ballance < tx.GetValue()+tx.GetFee() {
+		return nil, nil, fmt.Errorf("sender's balance is too low")
+	}
+	code := p.contracts.GetCode(string(coinTx.ContractAddress))
+	if code == nil {
+		return nil, nil, fmt.Errorf("contract %x is not deployed", coinTx.ContractAddress)
+	}
+	return coinTx, code, nil
 }
 
-func (p *ContractCallProcessor) Process(tx transaction.Transaction) error {
-	coinTx, ok := tx.(*contract_call.ContractCallTransaction)
-	if !ok {
-		return fmt.Errorf("invalid transaction type")
+// execute runs the contract and returns its changes together with the gas it used,
+// which is also returned for a failed call.
+func (p *ContractCallProcessor) execute(tx *contract_call.ContractCallTransaction, code []byte) (*callHost, uint64, error) {
+	var host = newCallHost(p.storage, p.contracts, tx)
+	var txId = tx.GetTxId()
+	var vm = script_vm.New(p.signer)
+	var limits = script_vm.DefaultLimits()
+	limits.Gas = uint64(tx.GetFee()) * GasPerFee
+	vm.SetLimits(limits)
+	if _, err := vm.RunContract(code, host, txId[:]); err != nil {
+		return nil, vm.GasUsed(), fmt.Errorf("contract %x failed after %d gas: %w", tx.ContractAddress, vm.GasUsed(), err)
 	}
+	return host, vm.GasUsed(), nil
+}
+
+// gasFee returns the fee charged for gas, at most the fee of tx.
+func gasFee(tx transaction.Transaction, gas uint64) int64 {
+	var fee = int64((gas + GasPerFee - 1) / GasPerFee)
+	return min(fee, tx.GetFee())
+}
 
-	if err := p.Validate(tx); err != nil {
+// Validate runs the contract without applying its changes, so calls failing against
+// the current state or running out of the gas bought by their fee do not enter the pool.
+func (p *ContractCallProcessor) Validate(tx transaction.Transaction) error {
+	coinTx, code, err := p.check(tx)
+	if err != nil {
 		return err
 	}
+	_, _, err = p.execute(coinTx, code)
+	return err
+}
 
-	total := int64(coinTx.InitParams.Amount) + tx.GetFee()
-	p.storage.SubBallance(string(coinTx.Sender), total)
-	p.storage.AddBallance(string(coinTx.InitParams.To), int64(coinTx.InitParams.Amount))
+func (p *ContractCallProcessor) Process(tx transaction.Transaction) error {
+	_, err := p.ProcessFee(tx)
+	return err
+}
 
-	return nil
+// ProcessFee charges the gas used by the call and applies the changes of the contract
+// only if the whole call succeeds. A failed call stays in the block with its gas paid
+// and no other effect, so it can not invalidate the block that included it.
+func (p *ContractCallProcessor) ProcessFee(tx transaction.Transaction) (int64, error) {
+	coinTx, code, err := p.check(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	// the contract sees the balance of the sender without the whole fee
+	p.storage.SubBallance(string(coinTx.Sender), tx.GetFee())
+	host, gas, err := p.execute(coinTx, code)
+	var fee = gasFee(tx, gas)
+	p.storage.AddBallance(string(coinTx.Sender), tx.GetFee()-fee)
+	if err != nil {
+		// a failed call is valid in a block, it only pays its gas
+		return fee, nil
+	}
+	return fee, host.apply()
 }
@@ -0,0 +1,160 @@
+package contract_call_processor
+
+import (
+	"blockchain_demo/pkg/ballance_storage"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/transaction/contract_call"
+	"fmt"
+)
+
+// effect is a coin or contract token transfer made by a contract.
+type effect struct {
+	token bool
+	from  string
+	to    string
+	value int64
+}
+
+// callHost runs a contract call against the storages without changing them. The
+// transfers of the contract are collected as effects with their balance changes kept
+// aside for reads, state writes are kept aside the same way. apply writes them once the
+// whole call succeeded.
+type callHost struct {
+	storage   ballance_storage.BallanceStorage
+	contracts contract_storage.ContractStorage
+	tx        *contract_call.ContractCallTransaction
+	args      [][]byte
+	coins     map[string]int64
+	tokens    map[string]int64
+	effects   []effect
+	writes    map[string][]byte
+	order     []string
+}
+
+func newCallHost(storage ballance_storage.BallanceStorage, contracts contract_storage.ContractStorage, tx *contract_call.ContractCallTransaction) *callHost {
+	var host = callHost{
+		storage:   storage,
+		contracts: contracts,
+		tx:        tx,
+		args:      [][]byte{tx.InitParams.To, script_vm.EncodeNum(int64(tx.InitParams.Amount))},
+		coins:     make(map[string]int64),
+		tokens:    make(map[string]int64),
+		writes:    make(map[string][]byte),
+	}
+	for _, arg := range tx.Args {
+		host.args = append(host.args, arg)
+	}
+	// the value of the call is sent to the contract before the code runs
+	host.record(effect{from: string(tx.Sender), to: string(tx.ContractAddress), value: tx.Value})
+
+	return &host
+}
+
+func (h *callHost) record(e effect) {
+	var deltas = h.coins
+	if e.token {
+		deltas = h.tokens
+	}
+	deltas[e.from] -= e.value
+	deltas[e.to] += e.value
+	h.effects = append(h.effects, e)
+}
+
+func (h *callHost) apply() error {
+	for _, e := range h.effects {
+		var err error
+		if e.token {
+			err = h.storage.TransferToken(string(h.tx.ContractAddress), e.from, e.to, e.value)
+		} else {
+			err = h.storage.Transfer(e.from, e.to, e.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for _, key := range h.order {
+		if err := h.contracts.Set(string(h.tx.ContractAddress), []byte(key), h.writes[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *callHost) Caller() []byte {
+	return h.tx.Sender
+}
+
+func (h *callHost) Contract() []byte {
+	return h.tx.ContractAddress
+}
+
+func (h *callHost) CallValue() int64 {
+	return h.tx.Value
+}
+
+func (h *callHost) Method() string {
+	return string(h.tx.Method)
+}
+
+func (h *callHost) Args() [][]byte {
+	return h.args
+}
+
+func (h *callHost) Balance(address []byte) int64 {
+	return h.storage.GetBallance(string(address)) + h.coins[string(address)]
+}
+
+// Transfer sends coins of the contract.
+func (h *callHost) Transfer(to []byte, value int64) error {
+	if value < 0 {
+		return fmt.Errorf("transfer value must not be negative, got %d", value)
+	}
+	if ballance := h.Balance(h.tx.ContractAddress); ballance < value {
+		return fmt.Errorf("contract balance is too low: %d < %d", ballance, value)
+	}
+	h.record(effect{from: string(h.tx.ContractAddress), to: string(to), value: value})
+	return nil
+}
+
+func (h *callHost) TokenBalance(holder []byte) int64 {
+	return h.storage.GetTokenBallance(string(h.tx.ContractAddress), string(holder)) + h.tokens[string(holder)]
+}
+
+// TransferToken moves units of the contract token, the contract code decides who may
+// move whose units.
+func (h *callHost) TransferToken(from []byte, to []byte, value int64) error {
+	if value < 0 {
+		return fmt.Errorf("transfer value must not be negative, got %d", value)
+	}
+	if ballance := h.TokenBalance(from); ballance < value {
+		return fmt.Errorf("token balance of %x is too low: %d < %d", from, ballance, value)
+	}
+	h.record(effect{token: true, from: string(from), to: string(to), value: value})
+	return nil
+}
+
+func (h *callHost) Load(key []byte) []byte {
+	if value, ok := h.writes[string(key)]; ok {
+		return value
+	}
+	var value = h.contracts.Get(string(h.tx.ContractAddress), key)
+	if value == nil {
+		return []byte{}
+	}
+	return value
+}
+
+func (h *callHost) Store(key []byte, value []byte) error {
+	if len(key) == 0 || len(key) > contract_storage.MaxKeySize {
+		return fmt.Errorf("key size %d is out of range 1..%d", len(key), contract_storage.MaxKeySize)
+	}
+	if len(value) > contract_storage.MaxValueSize {
+		return fmt.Errorf("value size %d exceeds %d", len(value), contract_storage.MaxValueSize)
+	}
+	if _, ok := h.writes[string(key)]; !ok {
+		h.order = append(h.order, string(key))
+	}
+	h.writes[string(key)] = append([]byte{}, value...)
+	return nil
+}
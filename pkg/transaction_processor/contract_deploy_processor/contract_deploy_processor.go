@@ -2,19 +2,25 @@ package contract_deploy_processor
 
 import (
 	"blockchain_demo/pkg/ballance_storage"
+	"blockchain_demo/pkg/contract_storage"
+	"blockchain_demo/pkg/script_vm"
 	"blockchain_demo/pkg/transaction"
 	"blockchain_demo/pkg/transaction/contract_deploy"
 	"blockchain_demo/pkg/transaction_processor"
+	"bytes"
 	"fmt"
+	"math"
 )
 
 type ContractDeployProcessor struct {
-	storage ballance_storage.BallanceStorage
+	storage   ballance_storage.BallanceStorage
+	contracts contract_storage.ContractStorage
 }
 
-func NewProcessor(storage ballance_storage.BallanceStorage) transaction_processor.TransactionProcessor {
+func NewProcessor(storage ballance_storage.BallanceStorage, contracts contract_storage.ContractStorage) transaction_processor.TransactionProcessor {
 	var processor = ContractDeployProcessor{
-		storage: storage,
+		storage:   storage,
+		contracts: contracts,
 	}
 
 	return &processor
@@ -29,9 +35,21 @@ func (p *ContractDeployProcessor) Validate(tx transaction.Transaction) error {
 
 	ballance := p.storage.GetBallance(string(coinTx.Sender))
 
-	if ballance < int64(coinTx.InitParams.InitialSupplay) {
+	if ballance < tx.GetFee() {
 		return fmt.Errorf("sender's balance is too low")
 	}
+	if !bytes.Equal(coinTx.ContractAddress, contract_deploy.ContractAddress(coinTx.Sender, coinTx.Nonce)) {
+		return fmt.Errorf("%w: %x", contract_deploy.ErrContractAddress, coinTx.ContractAddress)
+	}
+	if p.contracts.GetCode(string(coinTx.ContractAddress)) != nil || p.storage.GetTokenSupply(string(coinTx.ContractAddress)) != 0 {
+		return fmt.Errorf("contract %x is already deployed", coinTx.ContractAddress)
+	}
+	if coinTx.InitParams.InitialSupplay > math.MaxInt64 {
+		return fmt.Errorf("invalid initial supply %d", coinTx.InitParams.InitialSupplay)
+	}
+	if err := script_vm.New(nil).ParseScript(coinTx.Code); err != nil {
+		return fmt.Errorf("invalid contract code: %w", err)
+	}
 	return nil
 }
 
@@ -45,9 +63,13 @@ func (p *ContractDeployProcessor) Process(tx transaction.Transaction) error {
 		return err
 	}
 
-	total := int64(coinTx.InitParams.InitialSupplay) + tx.GetFee()
-	p.storage.SubBallance(string(coinTx.Sender), total)
-	p.storage.AddBallance(string(coinTx.ContractAddress), int64(coinTx.InitParams.InitialSupplay))
-
-	return nil
+	// the code is kept under the contract address, which also names the contract token
+	p.storage.SubBallance(string(coinTx.Sender), tx.GetFee())
+	if err := p.contracts.SetCode(string(coinTx.ContractAddress), coinTx.Code); err != nil {
+		return err
+	}
+	if coinTx.InitParams.InitialSupplay == 0 {
+		return nil
+	}
+	return p.storage.MintToken(string(coinTx.ContractAddress), string(coinTx.InitParams.Owner), int64(coinTx.InitParams.InitialSupplay))
 }
@@ -27,11 +27,19 @@ func (p *TokenTransferProcessor) Validate(tx transaction.Transaction) error {
 		return fmt.Errorf("invalid transaction type")
 	}
 
-	ballance := p.storage.GetBallance(string(coinTx.Sender))
+	if tx.GetValue() <= 0 {
+		return fmt.Errorf("token value must be positive, got %d", tx.GetValue())
+	}
 
-	if ballance < tx.GetValue()+tx.GetFee() {
+	// token units move on the token ledger, the fee is paid in native coin
+	ballance := p.storage.GetBallance(string(coinTx.Sender))
+	if ballance < tx.GetFee() {
 		return fmt.Errorf("sender's balance is too low")
 	}
+	tokens := p.storage.GetTokenBallance(string(coinTx.TokenAddress), string(coinTx.Sender))
+	if tokens < tx.GetValue() {
+		return fmt.Errorf("sender's token balance is too low: %d < %d", tokens, tx.GetValue())
+	}
 	return nil
 }
 
@@ -45,8 +53,6 @@ func (p *TokenTransferProcessor) Process(tx transaction.Transaction) error {
 		return err
 	}
 
-	p.storage.SubBallance(string(coinTx.Sender), tx.GetValue()+tx.GetFee())
-	p.storage.AddBallance(string(coinTx.Recipient), tx.GetValue())
-
-	return nil
+	p.storage.SubBallance(string(coinTx.Sender), tx.GetFee())
+	return p.storage.TransferToken(string(coinTx.TokenAddress), string(coinTx.Sender), string(coinTx.Recipient), tx.GetValue())
 }
@@ -11,6 +11,37 @@ type TransactionProcessor interface {
 	Process(tx transaction.Transaction) error
 }
 
+// FeeProcessor is a processor charging only a part of the fee of a transaction, like
+// contract calls paying for the gas they use.
+type FeeProcessor interface {
+	// ProcessFee processes tx and returns the part of its fee charged to the sender.
+	ProcessFee(tx transaction.Transaction) (int64, error)
+}
+
+// ProcessFee processes tx with processor and returns the part of its fee charged to the
+// sender, the whole fee unless processor is a FeeProcessor.
+func ProcessFee(processor TransactionProcessor, tx transaction.Transaction) (int64, error) {
+	if feeProcessor, ok := processor.(FeeProcessor); ok {
+		return feeProcessor.ProcessFee(tx)
+	}
+	if err := processor.Process(tx); err != nil {
+		return 0, err
+	}
+	return tx.GetFee(), nil
+}
+
+// PartialFee reports whether processor may charge less than the fee of tx, so the fee
+// charged is known only after tx is processed.
+func PartialFee(processor TransactionProcessor, tx transaction.Transaction) bool {
+	if _, ok := processor.(BaseProcessor); ok {
+		if processor, ok = processors[tx.GetTxType()]; !ok {
+			return false
+		}
+	}
+	_, ok := processor.(FeeProcessor)
+	return ok
+}
+
 type BaseProcessor struct {
 }
 
@@ -39,3 +70,12 @@ func (v BaseProcessor) Process(tx transaction.Transaction) error {
 
 	return processor.Process(tx)
 }
+
+func (v BaseProcessor) ProcessFee(tx transaction.Transaction) (int64, error) {
+	processor, exist := processors[tx.GetTxType()]
+	if !exist {
+		return 0, fmt.Errorf("not registered transaction processor for type: %s", tx.GetTxType())
+	}
+
+	return ProcessFee(processor, tx)
+}
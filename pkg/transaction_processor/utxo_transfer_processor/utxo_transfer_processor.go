@@ -0,0 +1,206 @@
+package utxo_transfer_processor
+
+import (
+	"blockchain_demo/pkg/ballance_storage"
+	"blockchain_demo/pkg/script_vm"
+	"blockchain_demo/pkg/sign"
+	"blockchain_demo/pkg/transaction"
+	"blockchain_demo/pkg/transaction/utxo_transfer"
+	"blockchain_demo/pkg/transaction_processor"
+	"blockchain_demo/pkg/utxo_storage"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var (
+	ErrDuplicateInput = errors.New("transaction spends an output twice")
+	ErrNotFinal       = errors.New("transaction lock time is not reached")
+	ErrRelativeLock   = errors.New("relative lock of an input is not reached")
+)
+
+type UtxoTransferProcessor struct {
+	storage ballance_storage.BallanceStorage
+	utxos   utxo_storage.UtxoStorage
+	signer  sign.Signer
+	flags   script_vm.VerifyFlags
+}
+
+// NewProcessor spends and creates the outputs kept in utxos. The signer is used by the
+// signature opcodes of the scripts and flags are the script rules of the chain.
+func NewProcessor(storage ballance_storage.BallanceStorage, utxos utxo_storage.UtxoStorage, signer sign.Signer, flags script_vm.VerifyFlags) transaction_processor.TransactionProcessor {
+	var processor = UtxoTransferProcessor{
+		storage: storage,
+		utxos:   utxos,
+		signer:  signer,
+		flags:   flags,
+	}
+
+	return &processor
+}
+
+// addValue adds value to total, failing instead of overflowing.
+func addValue(total int64, value int64) (int64, error) {
+	if value < 0 || total > math.MaxInt64-value {
+		return 0, fmt.Errorf("invalid value %d", value)
+	}
+	return total + value, nil
+}
+
+// isFinal reports whether the lock time of tx is reached by the block at height with
+// the median time medianTime. The lock time is ignored when every input is final.
+func isFinal(tx *utxo_transfer.UtxoTransferTransaction, height uint32, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < script_vm.LockTimeThreshold && tx.LockTime <= height {
+		return true
+	}
+	if tx.LockTime >= script_vm.LockTimeThreshold && int64(tx.LockTime) <= medianTime {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != script_vm.SequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRelativeLock fails when the input sequence is a relative lock that output has
+// not reached yet, the sequence counts blocks or units of 512 seconds since the output
+// was created.
+func checkRelativeLock(sequence uint32, output *utxo_storage.Output, height uint32, medianTime int64) error {
+	if sequence&script_vm.SequenceLockTimeDisableFlag != 0 {
+		return nil
+	}
+	var lock = int64(sequence & script_vm.SequenceLockTimeMask)
+	if sequence&script_vm.SequenceLockTimeTypeFlag != 0 {
+		if output.MedianTime+lock<<9 > medianTime {
+			return fmt.Errorf("%w: %d seconds after %d", ErrRelativeLock, lock<<9, output.MedianTime)
+		}
+		return nil
+	}
+	if int64(output.Height)+lock > int64(height) {
+		return fmt.Errorf("%w: %d blocks after height %d", ErrRelativeLock, lock, output.Height)
+	}
+	return nil
+}
+
+// check validates the transaction against the output set without executing the scripts
+// and returns the spent outputs.
+func (p *UtxoTransferProcessor) check(tx transaction.Transaction) (*utxo_transfer.UtxoTransferTransaction, []*utxo_storage.Output, error) {
+	utxoTx, ok := tx.(*utxo_transfer.UtxoTransferTransaction)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid transaction type")
+	}
+	if len(utxoTx.Outputs) == 0 {
+		return nil, nil, fmt.Errorf("transaction has no outputs")
+	}
+
+	var height = p.utxos.Height()
+	var medianTime = p.utxos.MedianTime()
+	if !isFinal(utxoTx, height, medianTime) {
+		return nil, nil, fmt.Errorf("%w: %d", ErrNotFinal, utxoTx.LockTime)
+	}
+
+	var in, err = addValue(0, tx.GetValue())
+	if err != nil {
+		return nil, nil, err
+	}
+	var spent = make(map[transaction.OutPoint]bool, len(utxoTx.Inputs))
+	var outputs = make([]*utxo_storage.Output, 0, len(utxoTx.Inputs))
+	for i, input := range utxoTx.Inputs {
+		if spent[input.OutPoint] {
+			return nil, nil, fmt.Errorf("%w: %x:%d", ErrDuplicateInput, input.TxId, input.Index)
+		}
+		spent[input.OutPoint] = true
+		var output = p.utxos.Get(input.OutPoint)
+		if output == nil {
+			return nil, nil, fmt.Errorf("input %d: %w: %x:%d", i, utxo_storage.ErrMissingOutput, input.TxId, input.Index)
+		}
+		if err := checkRelativeLock(input.Sequence, output, height, medianTime); err != nil {
+			return nil, nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		if in, err = addValue(in, output.Value); err != nil {
+			return nil, nil, fmt.Errorf("input %d: %w", i, err)
+		}
+		outputs = append(outputs, output)
+	}
+
+	var out, feeErr = addValue(0, tx.GetFee())
+	if feeErr != nil {
+		return nil, nil, fmt.Errorf("fee: %w", feeErr)
+	}
+	for i, output := range utxoTx.Outputs {
+		if out, err = addValue(out, output.Value); err != nil {
+			return nil, nil, fmt.Errorf("output %d: %w", i, err)
+		}
+	}
+	if in != out {
+		return nil, nil, fmt.Errorf("inputs and value %d do not equal outputs and fee %d", in, out)
+	}
+	if p.storage.GetBallance(string(utxoTx.Sender)) < tx.GetValue() {
+		return nil, nil, fmt.Errorf("sender's balance is too low")
+	}
+	return utxoTx, outputs, nil
+}
+
+// verify executes the scriptSig of every input with the scriptPubKey of the output it
+// spends.
+func (p *UtxoTransferProcessor) verify(tx *utxo_transfer.UtxoTransferTransaction, outputs []*utxo_storage.Output) error {
+	var signing = tx.SigningTx()
+	var height = p.utxos.Height()
+	var medianTime = p.utxos.MedianTime()
+	for i, input := range tx.Inputs {
+		var vm = script_vm.New(p.signer)
+		vm.SetFlags(p.flags)
+		var err = vm.VerifyScript(input.ScriptSig, outputs[i].ScriptPubKey, script_vm.TxContext{
+			Tx:         signing,
+			Input:      i,
+			ScriptCode: outputs[i].ScriptPubKey,
+			Height:     height,
+			MedianTime: medianTime,
+		})
+		if err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (p *UtxoTransferProcessor) Validate(tx transaction.Transaction) error {
+	utxoTx, outputs, err := p.check(tx)
+	if err != nil {
+		return err
+	}
+	return p.verify(utxoTx, outputs)
+}
+
+// Process spends the inputs and creates the outputs. Unlike a failed contract call a
+// failed script is not a valid spend, so it invalidates the block including it.
+func (p *UtxoTransferProcessor) Process(tx transaction.Transaction) error {
+	utxoTx, outputs, err := p.check(tx)
+	if err != nil {
+		return err
+	}
+	if err := p.verify(utxoTx, outputs); err != nil {
+		return err
+	}
+
+	for _, input := range utxoTx.Inputs {
+		if _, err := p.utxos.Spend(input.OutPoint); err != nil {
+			return err
+		}
+	}
+	for i, output := range utxoTx.Outputs {
+		var outpoint = transaction.OutPoint{TxId: utxoTx.TxId, Index: uint32(i)}
+		if err := p.utxos.Add(outpoint, output.Value, output.ScriptPubKey); err != nil {
+			return err
+		}
+	}
+	if tx.GetValue() > 0 {
+		p.storage.SubBallance(string(utxoTx.Sender), tx.GetValue())
+	}
+	return nil
+}
@@ -1,6 +1,11 @@
 package stack
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrEmpty = errors.New("stack is empty")
 
 type (
 	Stack[T any] struct {
@@ -48,7 +53,7 @@ func (s *Stack[T]) Push(v T) {
 func (s *Stack[T]) Pop() (T, error) {
 	if s.top == nil {
 		var zero T
-		return zero, fmt.Errorf("stack is empty")
+		return zero, ErrEmpty
 	}
 	node := s.top
 	s.top = node.prev
@@ -60,7 +65,7 @@ func (s *Stack[T]) Pop() (T, error) {
 func (s *Stack[T]) Pick() (T, error) {
 	if s.top == nil {
 		var zero T
-		return zero, fmt.Errorf("stack is empty")
+		return zero, ErrEmpty
 	}
 	return s.top.value, nil
 }
@@ -72,3 +77,35 @@ func (s *Stack[T]) IsEmpty() bool {
 func (s *Stack[T]) Size() int {
 	return s.size
 }
+
+// PickAt returns the n-th value from the top, PickAt(0) is the same as Pick.
+func (s *Stack[T]) PickAt(n int) (T, error) {
+	if n < 0 || n >= s.size {
+		var zero T
+		return zero, fmt.Errorf("%w at depth %d", ErrEmpty, n)
+	}
+	node := s.top
+	for ; n > 0; n-- {
+		node = node.prev
+	}
+	return node.value, nil
+}
+
+// RemoveAt removes and returns the n-th value from the top, RemoveAt(0) is the same as Pop.
+func (s *Stack[T]) RemoveAt(n int) (T, error) {
+	if n < 0 || n >= s.size {
+		var zero T
+		return zero, fmt.Errorf("%w at depth %d", ErrEmpty, n)
+	}
+	if n == 0 {
+		return s.Pop()
+	}
+	above := s.top
+	for ; n > 1; n-- {
+		above = above.prev
+	}
+	node := above.prev
+	above.prev = node.prev
+	s.size--
+	return node.value, nil
+}
@@ -62,3 +62,28 @@ func TestStack_IsEmpty(t *testing.T) {
 		t.Error("IsEmpty() = false after Pop; want true")
 	}
 }
+
+func TestStack_PickAtRemoveAt(t *testing.T) {
+	s := FromArray([]int{1, 2, 3, 4})
+	v, err := s.PickAt(2)
+	if err != nil || v != 2 {
+		t.Errorf("PickAt(2) = %v, %v; want 2, nil", v, err)
+	}
+	if _, err := s.PickAt(4); err == nil {
+		t.Error("PickAt(4) on a stack of 4 should return error")
+	}
+	v, err = s.RemoveAt(2)
+	if err != nil || v != 2 {
+		t.Errorf("RemoveAt(2) = %v, %v; want 2, nil", v, err)
+	}
+	v, err = s.RemoveAt(0)
+	if err != nil || v != 4 || s.Size() != 2 {
+		t.Errorf("RemoveAt(0) = %v, %v, size %d; want 4, nil, 2", v, err, s.Size())
+	}
+	if arr := s.ToArray(); len(arr) != 2 || arr[0] != 3 || arr[1] != 1 {
+		t.Errorf("ToArray() = %v; want [3 1]", arr)
+	}
+	if _, err := s.RemoveAt(-1); err == nil {
+		t.Error("RemoveAt(-1) should return error")
+	}
+}
@@ -80,6 +80,39 @@ func GetBytesFromHexParam(params map[string]any, field string) ([]byte, error) {
 	return valueBytes, nil
 }
 
+// GetOptionalHexListFromParam reads a list of hex strings, a missing field is an empty
+// list.
+func GetOptionalHexListFromParam(params map[string]any, field string) ([][]byte, error) {
+	value, exists := params[field]
+	if !exists {
+		return nil, nil
+	}
+	var items []any
+	switch v := value.(type) {
+	case []string:
+		for _, item := range v {
+			items = append(items, item)
+		}
+	case []any:
+		items = v
+	default:
+		return nil, fmt.Errorf("%s is not a list of hex strings", field)
+	}
+	var result = make([][]byte, 0, len(items))
+	for i, item := range items {
+		itemStr, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s[%d] is not a hex string", field, i)
+		}
+		itemBytes, err := hex.DecodeString(itemStr)
+		if err != nil {
+			return nil, fmt.Errorf("unsupported %s[%d]: %s", field, i, itemStr)
+		}
+		result = append(result, itemBytes)
+	}
+	return result, nil
+}
+
 func GetInt64FromParam(params map[string]any, field string) (uint64, error) {
 	value, exists := params[field]
 	if !exists {
@@ -113,6 +146,14 @@ func GetInt64FromParam(params map[string]any, field string) (uint64, error) {
 	return valueInt, nil
 }
 
+// GetOptionalInt64FromParam is GetInt64FromParam returning zero for a missing field.
+func GetOptionalInt64FromParam(params map[string]any, field string) (uint64, error) {
+	if _, exists := params[field]; !exists {
+		return 0, nil
+	}
+	return GetInt64FromParam(params, field)
+}
+
 func GetEnumValueFromParam[T any](params map[string]any, field string, isValid func(s string) (T, bool)) (T, error) {
 	var zeroValue T
 	value, exists := params[field]
@@ -0,0 +1,192 @@
+package utxo_storage
+
+import (
+	"blockchain_demo/pkg/transaction"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// MedianTimeBlocks is the number of confirmed blocks whose median time is the time
+// seen by the scripts of the next block, the same window the chain uses for timestamps.
+const MedianTimeBlocks = 11
+
+var (
+	ErrMissingOutput = errors.New("output is spent or does not exist")
+	ErrOutputExists  = errors.New("output already exists")
+)
+
+// Output is an unspent transaction output with the block that created it, relative
+// locks are measured from that block.
+type Output struct {
+	Value        int64
+	ScriptPubKey []byte
+	Height       uint32
+	MedianTime   int64
+}
+
+// UtxoStorage keeps the set of unspent transaction outputs. Changes of a block are
+// pending until Confirm commits them as the next height, RevertTo rewinds committed
+// heights the same way as ballance_storage.BallanceStorage does, so both are kept in
+// step.
+type UtxoStorage interface {
+	// Get returns the unspent output at outpoint including pending changes, nil when it
+	// is spent or does not exist.
+	Get(outpoint transaction.OutPoint) *Output
+	// Add creates an output of the pending block.
+	Add(outpoint transaction.OutPoint, value int64, scriptPubKey []byte) error
+	// Spend removes the output at outpoint and returns it.
+	Spend(outpoint transaction.OutPoint) (*Output, error)
+	// Height is the number of confirmed blocks, which is the index of the pending block.
+	Height() uint32
+	// MedianTime is the median time in unix seconds of the last MedianTimeBlocks
+	// confirmed blocks.
+	MedianTime() int64
+	// Confirm commits the pending changes as a block with time blockTime in unix
+	// nanoseconds, the unit of block.Block.Time.
+	Confirm(blockTime int64) error
+	Reject() error
+	RevertTo(height uint32) error
+}
+
+// undoRecord keeps the outputs replaced at height, nil for outputs that did not exist.
+type undoRecord struct {
+	height   uint32
+	previous map[transaction.OutPoint]*Output
+}
+
+type UtxoStorageMemory struct {
+	state   map[transaction.OutPoint]*Output
+	pending map[transaction.OutPoint]*Output
+	times   []int64
+	undo    []undoRecord
+	mu      sync.Mutex
+}
+
+func NewMemoryStorage() UtxoStorage {
+	var storage = UtxoStorageMemory{
+		state:   make(map[transaction.OutPoint]*Output),
+		pending: make(map[transaction.OutPoint]*Output),
+	}
+
+	return &storage
+}
+
+func (s *UtxoStorageMemory) get(outpoint transaction.OutPoint) *Output {
+	if output, ok := s.pending[outpoint]; ok {
+		return output
+	}
+	return s.state[outpoint]
+}
+
+func (s *UtxoStorageMemory) Get(outpoint transaction.OutPoint) *Output {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var output = s.get(outpoint)
+	if output == nil {
+		return nil
+	}
+	var copied = *output
+	return &copied
+}
+
+func (s *UtxoStorageMemory) Add(outpoint transaction.OutPoint, value int64, scriptPubKey []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if value < 0 {
+		return fmt.Errorf("output %x:%d has negative value %d", outpoint.TxId, outpoint.Index, value)
+	}
+	if s.get(outpoint) != nil {
+		return fmt.Errorf("%w: %x:%d", ErrOutputExists, outpoint.TxId, outpoint.Index)
+	}
+	s.pending[outpoint] = &Output{
+		Value:        value,
+		ScriptPubKey: append([]byte{}, scriptPubKey...),
+		Height:       uint32(len(s.times)),
+		MedianTime:   s.medianTime(),
+	}
+	return nil
+}
+
+func (s *UtxoStorageMemory) Spend(outpoint transaction.OutPoint) (*Output, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var output = s.get(outpoint)
+	if output == nil {
+		return nil, fmt.Errorf("%w: %x:%d", ErrMissingOutput, outpoint.TxId, outpoint.Index)
+	}
+	s.pending[outpoint] = nil
+	var copied = *output
+	return &copied, nil
+}
+
+func (s *UtxoStorageMemory) Height() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return uint32(len(s.times))
+}
+
+func (s *UtxoStorageMemory) medianTime() int64 {
+	if len(s.times) == 0 {
+		return 0
+	}
+	var times = slices.Clone(s.times[max(0, len(s.times)-MedianTimeBlocks):])
+	slices.Sort(times)
+	return times[len(times)/2] / int64(time.Second)
+}
+
+func (s *UtxoStorageMemory) MedianTime() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.medianTime()
+}
+
+func (s *UtxoStorageMemory) Confirm(blockTime int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var previous = make(map[transaction.OutPoint]*Output, len(s.pending))
+	for outpoint, output := range s.pending {
+		previous[outpoint] = s.state[outpoint]
+		if output == nil {
+			delete(s.state, outpoint)
+		} else {
+			s.state[outpoint] = output
+		}
+	}
+	s.pending = make(map[transaction.OutPoint]*Output)
+	s.times = append(s.times, blockTime)
+	s.undo = append(s.undo, undoRecord{height: uint32(len(s.times)), previous: previous})
+	return nil
+}
+
+func (s *UtxoStorageMemory) Reject() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = make(map[transaction.OutPoint]*Output)
+	return nil
+}
+
+// RevertTo drops pending changes and undoes every confirmed height above height.
+func (s *UtxoStorageMemory) RevertTo(height uint32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if height > uint32(len(s.times)) {
+		return fmt.Errorf("can not revert to height %d, current height is %d", height, len(s.times))
+	}
+	s.pending = make(map[transaction.OutPoint]*Output)
+	for uint32(len(s.times)) > height {
+		var record = s.undo[len(s.undo)-1]
+		for outpoint, output := range record.previous {
+			if output == nil {
+				delete(s.state, outpoint)
+			} else {
+				s.state[outpoint] = output
+			}
+		}
+		s.undo = s.undo[:len(s.undo)-1]
+		s.times = s.times[:len(s.times)-1]
+	}
+	return nil
+}
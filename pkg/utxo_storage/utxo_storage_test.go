@@ -0,0 +1,74 @@
+package utxo_storage
+
+import (
+	"blockchain_demo/pkg/transaction"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutputs(t *testing.T) {
+	storage := NewMemoryStorage()
+	outpoint := transaction.OutPoint{TxId: transaction.Hash{1}, Index: 0}
+	if err := storage.Add(outpoint, -1, nil); err == nil {
+		t.Errorf("expected error for a negative value")
+	}
+	storage.Add(outpoint, 10, []byte{0x51})
+	if err := storage.Add(outpoint, 10, nil); !errors.Is(err, ErrOutputExists) {
+		t.Errorf("Add(existing) error = %v, want %v", err, ErrOutputExists)
+	}
+	storage.Reject()
+	if storage.Get(outpoint) != nil {
+		t.Errorf("rejected output is still visible")
+	}
+
+	storage.Add(outpoint, 10, []byte{0x51})
+	storage.Confirm(int64(100 * time.Second))
+	output, err := storage.Spend(outpoint)
+	if err != nil || output.Value != 10 || output.Height != 0 {
+		t.Fatalf("Spend = %v, %v, want the output of height 0", output, err)
+	}
+	if _, err := storage.Spend(outpoint); !errors.Is(err, ErrMissingOutput) {
+		t.Errorf("Spend(spent) error = %v, want %v", err, ErrMissingOutput)
+	}
+	other := transaction.OutPoint{TxId: transaction.Hash{1}, Index: 1}
+	storage.Add(other, 5, nil)
+	storage.Confirm(int64(200 * time.Second))
+	if storage.Height() != 2 || storage.Get(outpoint) != nil {
+		t.Fatalf("Expected height 2 without the spent output, got %d", storage.Height())
+	}
+	if output := storage.Get(other); output.Height != 1 || output.MedianTime != 100 {
+		t.Errorf("output created at height %d median time %d, want 1 and 100", output.Height, output.MedianTime)
+	}
+
+	if err := storage.RevertTo(3); err == nil {
+		t.Errorf("expected error for reverting above the height")
+	}
+	storage.RevertTo(1)
+	if storage.Get(other) != nil || storage.Get(outpoint) == nil {
+		t.Errorf("RevertTo(1) did not undo the second height only")
+	}
+	storage.RevertTo(0)
+	if storage.Get(outpoint) != nil || storage.Height() != 0 {
+		t.Errorf("RevertTo(0) left the output")
+	}
+}
+
+func TestMedianTime(t *testing.T) {
+	storage := NewMemoryStorage()
+	if storage.MedianTime() != 0 {
+		t.Errorf("median time without blocks = %d, want 0", storage.MedianTime())
+	}
+	for _, seconds := range []int64{5, 1, 3} {
+		storage.Confirm(seconds * int64(time.Second))
+	}
+	if storage.MedianTime() != 3 {
+		t.Errorf("median time = %d, want 3", storage.MedianTime())
+	}
+	for i := 0; i < MedianTimeBlocks; i++ {
+		storage.Confirm(int64(10+i) * int64(time.Second))
+	}
+	if storage.MedianTime() != 15 {
+		t.Errorf("median time = %d, want 15 of the last %d blocks", storage.MedianTime(), MedianTimeBlocks)
+	}
+}
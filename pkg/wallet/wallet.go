@@ -61,15 +61,7 @@ func ValidateAddress(pubKey []byte, prefix []byte, address string) error {
 }
 
 func (w Wallet) GetPublicKeyHash() ([]byte, error) {
-	hashed, err := utils.GetHash(w.Keys.PublicKey)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create hash: %v", err)
-	}
-
-	hasher := ripemd160.New()
-	hasher.Write(hashed)
-	netAddress := hasher.Sum(nil)
-	return netAddress, nil
+	return sign.PublicKeyHash(w.Keys.PublicKey), nil
 }
 
 func CheckAddress(address string) error {
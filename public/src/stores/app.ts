@@ -10,6 +10,28 @@ export const useAppStore = defineStore('app', {
       private_key: string
     },
     scriptResult: null as null | { code: string, result: boolean, success: boolean },
+    debugResult: null as null | {
+      code: string
+      trace: Array<{
+        pc: number
+        opcode: string
+        data?: string
+        skipped: boolean
+        condition_stack: boolean[]
+        stack_before: string[]
+        alt_stack_before: string[]
+        stack_after: string[]
+        alt_stack_after: string[]
+        gas_used: number
+        error?: string
+      }>
+      paused: boolean
+      pc: number
+      gas_used: number
+      result?: string
+      error?: string
+      success: boolean
+    },
     compileResult: null as null | { scriptSig: string, scriptPubKey: string, success: boolean },
     parseResult: null as null | { scriptSig: string, scriptPubKey: string, success: boolean },
     loading: false,
@@ -52,6 +74,29 @@ export const useAppStore = defineStore('app', {
         this.loading = false
       }
     },
+    async debugScript (payload: { scriptSig: string, scriptPubKey: string, signedData: string, breakpoints?: number[] }) {
+      this.loading = true
+      this.error = null
+      try {
+        const res = await fetch(`/api/sript/debug`, {
+          method: 'POST',
+          headers: { 'Content-Type': 'application/json' },
+          body: JSON.stringify({
+            script_sig: payload.scriptSig,
+            script_pub_key: payload.scriptPubKey,
+            signed_data: payload.signedData,
+            breakpoints: payload.breakpoints ?? [],
+          }),
+        })
+        if (!res.ok) throw new Error('Failed to debug script')
+        const data = await res.json()
+        this.debugResult = data
+      } catch (e: any) {
+        this.error = e.message || 'Unknown error'
+      } finally {
+        this.loading = false
+      }
+    },
     async compileScript (payload: { scriptSig: string, scriptPubKey: string}) {
       this.loading = true
       this.error = null